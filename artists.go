@@ -0,0 +1,380 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// artistSortOrder orders artists (aliased as a) by sort name, falling back to their name
+const artistSortOrder = `IF(a.sort_name = '', a.name, a.sort_name)`
+
+// sortArticles are leading words moved to the end of a default sort name
+var sortArticles = []string{"The", "A", "An"}
+
+// defaultSortName builds a sort name by moving a leading article to the end,
+// e.g. "The Beatles" becomes "Beatles, The". Personal names such as
+// "Bowie, David" can't be derived and are left as given.
+func defaultSortName(name string) string {
+	for _, article := range sortArticles {
+		if len(name) > len(article)+1 && strings.EqualFold(name[:len(article)+1], article+" ") {
+			return name[len(article)+1:] + ", " + name[:len(article)]
+		}
+	}
+	return name
+}
+
+// selectArtistQuery selects the columns read by scanArtist from artists aliased as a
+const selectArtistQuery = `SELECT a.id, a.name, a.sort_name, a.country, a.active_from, a.active_to, a.version FROM artists a`
+
+// scanArtist reads a row selected by selectArtistQuery
+func scanArtist(row rowScanner) (Artist, error) {
+	var a Artist
+	var activeFrom, activeTo sql.NullInt64
+	err := row.Scan(&a.ID, &a.Name, &a.SortName, &a.Country, &activeFrom, &activeTo, &a.Version)
+	if err != nil {
+		return a, err
+	}
+	if a.SortName == "" {
+		a.SortName = defaultSortName(a.Name)
+	}
+	if activeFrom.Valid {
+		year := int(activeFrom.Int64)
+		a.ActiveFrom = &year
+	}
+	if activeTo.Valid {
+		year := int(activeTo.Int64)
+		a.ActiveTo = &year
+	}
+	a.Aliases = []string{}
+	a.BandIDs = []int{}
+	return a, nil
+}
+
+// loadArtistAliases fills in the aliases of the given artists
+func loadArtistAliases(artists []Artist) error {
+	index := map[int]*Artist{}
+	for i := range artists {
+		index[artists[i].ID] = &artists[i]
+	}
+
+	rows, err := db.Query(`SELECT artist_id, alias FROM artist_aliases ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var artistID int
+		var alias string
+		if err := rows.Scan(&artistID, &alias); err != nil {
+			return err
+		}
+		if a, ok := index[artistID]; ok {
+			a.Aliases = append(a.Aliases, alias)
+		}
+	}
+	return rows.Err()
+}
+
+// loadArtist returns an artist by ID with its aliases, or sql.ErrNoRows if there is none
+func loadArtist(q dbExecutor, id int) (Artist, error) {
+	a, err := scanArtist(q.QueryRow(selectArtistQuery+` WHERE a.id = ?`, id))
+	if err != nil {
+		return a, err
+	}
+
+	rows, err := q.Query(`SELECT alias FROM artist_aliases WHERE artist_id = ? ORDER BY id`, id)
+	if err != nil {
+		return a, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var alias string
+		if err := rows.Scan(&alias); err != nil {
+			return a, err
+		}
+		a.Aliases = append(a.Aliases, alias)
+	}
+	return a, rows.Err()
+}
+
+// replaceArtistAliases replaces the aliases of an artist within tx
+func replaceArtistAliases(tx *sql.Tx, artistID int, aliases []string) error {
+	_, err := tx.Exec(`DELETE FROM artist_aliases WHERE artist_id = ?`, artistID)
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		alias = strings.TrimSpace(alias)
+		if alias == "" {
+			continue
+		}
+		_, err = tx.Exec(`INSERT INTO artist_aliases (artist_id, alias, normalized_alias) VALUES (?, ?, ?)`, artistID, alias, normalizeName(alias))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getArtists handles retrieving all artists ordered by sort name
+func getArtists(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(selectArtistQuery + ` ORDER BY ` + artistSortOrder)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve artists", err)
+		return
+	}
+	defer rows.Close()
+
+	artists := []Artist{}
+	for rows.Next() {
+		a, err := scanArtist(rows)
+		if err != nil {
+			writeInternalError(w, r, "Failed to scan artist", err)
+			return
+		}
+		artists = append(artists, a)
+	}
+	if err := rows.Err(); err != nil {
+		writeInternalError(w, r, "Error iterating over artists", err)
+		return
+	}
+
+	if err := loadArtistAliases(artists); err != nil {
+		writeInternalError(w, r, "Failed to retrieve artist aliases", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(artists)
+}
+
+// getArtistById handles retrieving an artist by ID
+func getArtistById(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid artist ID")
+		return
+	}
+
+	a, err := loadArtist(db, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, r, http.StatusNotFound, "Artist not found")
+		} else {
+			writeInternalError(w, r, "Failed to retrieve artist", err)
+		}
+		return
+	}
+
+	etag := versionETag(a.Version)
+	w.Header().Set("ETag", etag)
+	if notModified(w, r, etag) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// createArtist handles the creation of a new artist
+func createArtist(w http.ResponseWriter, r *http.Request) {
+	var a Artist
+	err := json.NewDecoder(r.Body).Decode(&a)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if err := a.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	if a.SortName == "" {
+		a.SortName = defaultSortName(a.Name)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to create artist", err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO artists (name, sort_name, country, active_from, active_to) VALUES (?, ?, ?, ?, ?)`,
+		a.Name, a.SortName, a.Country, a.ActiveFrom, a.ActiveTo)
+	if err != nil {
+		writeInternalError(w, r, "Failed to create artist", err)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err == nil {
+		err = replaceArtistAliases(tx, int(id), a.Aliases)
+	}
+	if err == nil {
+		var created Artist
+		created, err = loadArtist(tx, int(id))
+		if err == nil {
+			err = recordAudit(tx, requestActor(r), auditArtist, created.ID, auditCreate, nil, created)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeInternalError(w, r, "Failed to create artist", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// updateArtist handles updating an existing artist by ID. The aliases are
+// replaced only if the body has them, so a rename keeps those added by merges.
+// If-Match must carry the current ETag.
+func updateArtist(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid artist ID")
+		return
+	}
+
+	var a Artist
+	err = json.NewDecoder(r.Body).Decode(&a)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if err := a.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	if a.SortName == "" {
+		a.SortName = defaultSortName(a.Name)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to update artist", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRow(`SELECT version FROM artists WHERE id = ? FOR UPDATE`, id).Scan(&version)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Artist not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to update artist", err)
+		return
+	}
+	if !checkIfMatch(w, r, version) {
+		return
+	}
+
+	updated, err := updateArtistTx(tx, requestActor(r), id, a, auditUpdate)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeInternalError(w, r, "Failed to update artist", err)
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(updated.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// updateArtistTx writes a over the artist with the given ID within tx and
+// records action in the audit log. The aliases are replaced only if a has
+// them. It returns sql.ErrNoRows if there is no such artist.
+func updateArtistTx(tx *sql.Tx, actor auditActor, id int, a Artist, action string) (Artist, error) {
+	before, err := loadArtist(tx, id)
+	if err != nil {
+		return a, err
+	}
+	_, err = tx.Exec(`UPDATE artists SET name = ?, sort_name = ?, country = ?, active_from = ?, active_to = ?, version = version + 1 WHERE id = ?`,
+		a.Name, a.SortName, a.Country, a.ActiveFrom, a.ActiveTo, id)
+	if err != nil {
+		return a, err
+	}
+	if a.Aliases != nil {
+		if err := replaceArtistAliases(tx, id, a.Aliases); err != nil {
+			return a, err
+		}
+	}
+	after, err := loadArtist(tx, id)
+	if err != nil {
+		return a, err
+	}
+	return after, recordAudit(tx, actor, auditArtist, id, action, before, after)
+}
+
+// revertArtist handles restoring an artist, with its aliases, to the state
+// recorded by one of its audit entries. If-Match must carry the current
+// ETag, and the revert is itself recorded in the audit log.
+func revertArtist(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid artist ID")
+		return
+	}
+
+	var a Artist
+	if !loadRevertState(w, r, auditArtist, "artist", id, &a) {
+		return
+	}
+	// A snapshot without aliases means the artist had none
+	if a.Aliases == nil {
+		a.Aliases = []string{}
+	}
+	if err := a.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	if a.SortName == "" {
+		a.SortName = defaultSortName(a.Name)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to revert artist", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRow(`SELECT version FROM artists WHERE id = ? FOR UPDATE`, id).Scan(&version)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Artist not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to revert artist", err)
+		return
+	}
+	if !checkIfMatch(w, r, version) {
+		return
+	}
+
+	updated, err := updateArtistTx(tx, requestActor(r), id, a, auditRevert)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeInternalError(w, r, "Failed to revert artist", err)
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(updated.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// actorHeader names the user making a request, for the audit log
+const actorHeader = "X-User"
+
+// auditActor identifies who made a change: the user of an HTTP request or a
+// background process such as the importer
+type auditActor struct {
+	Name      string
+	RequestID string
+}
+
+// importerActor makes the changes applied by seeding and file imports
+var importerActor = auditActor{Name: "importer"}
+
+// requestActor returns the actor of an HTTP request, "anonymous" if the client didn't say
+func requestActor(r *http.Request) auditActor {
+	name := strings.TrimSpace(r.Header.Get(actorHeader))
+	if name == "" {
+		name = "anonymous"
+	}
+	if len(name) > maxNameLength {
+		name = name[:maxNameLength]
+	}
+	return auditActor{Name: name, RequestID: requestID(r)}
+}
+
+// Entity types recorded in the audit log
+const (
+	auditMedia      = "media"
+	auditArtist     = "artist"
+	auditFormat     = "format"
+	auditLabel      = "label"
+	auditCollection = "collection"
+)
+
+// Actions recorded in the audit log
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRevert  = "revert"
+	auditRestore = "restore"
+	auditPurge   = "purge"
+)
+
+// unauditedFields change on every write and are left out of diffs
+var unauditedFields = map[string]bool{"version": true, "updated_at": true}
+
+// AuditEntry is one change in the append-only audit log
+type AuditEntry struct {
+	ID         int64                  `json:"id"`
+	EntityType string                 `json:"entity_type"`
+	EntityID   int                    `json:"entity_id"`
+	Action     string                 `json:"action"`
+	Actor      string                 `json:"actor"`
+	RequestID  string                 `json:"request_id,omitempty"`
+	CreatedAt  string                 `json:"created_at"`
+	Changes    map[string]FieldChange `json:"changes"`
+	Before     json.RawMessage        `json:"before,omitempty"`
+	After      json.RawMessage        `json:"after,omitempty"`
+}
+
+// FieldChange holds the old and new value of a changed field
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// recordAudit appends a change to the audit log. before is nil for a create
+// and after is nil once the entity is gone for good; otherwise both are
+// snapshots of the entity.
+func recordAudit(q dbExecutor, actor auditActor, entityType string, entityID int, action string, before, after interface{}) error {
+	beforeJSON, beforeDoc, err := auditSnapshot(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, afterDoc, err := auditSnapshot(after)
+	if err != nil {
+		return err
+	}
+	changes, err := json.Marshal(diffSnapshots(beforeDoc, afterDoc))
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`INSERT INTO audit_log (entity_type, entity_id, action, actor, request_id, changes, before_state, after_state) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entityType, entityID, action, actor.Name, actor.RequestID, string(changes), beforeJSON, afterJSON)
+	return err
+}
+
+// auditSnapshot returns the JSON of an entity for storage, or nil if there is none,
+// along with its decoded fields for diffing
+func auditSnapshot(entity interface{}) (interface{}, map[string]interface{}, error) {
+	if entity == nil {
+		return nil, map[string]interface{}{}, nil
+	}
+	data, err := json.Marshal(entity)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, nil, err
+	}
+	return string(data), fields, nil
+}
+
+// diffSnapshots lists the fields whose values differ between two snapshots
+func diffSnapshots(before, after map[string]interface{}) map[string]FieldChange {
+	keys := map[string]bool{}
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+
+	changes := map[string]FieldChange{}
+	for key := range keys {
+		if unauditedFields[key] || reflect.DeepEqual(before[key], after[key]) {
+			continue
+		}
+		changes[key] = FieldChange{From: before[key], To: after[key]}
+	}
+	return changes
+}
+
+// loadAuditEntries returns the audit entries matching the WHERE clause, newest first
+func loadAuditEntries(where string, args ...interface{}) ([]AuditEntry, error) {
+	rows, err := db.Query(`
+        SELECT id, entity_type, entity_id, action, actor, request_id,
+            DATE_FORMAT(created_at, '%Y-%m-%dT%H:%i:%s'), changes,
+            IFNULL(before_state, ''), IFNULL(after_state, '')
+        FROM audit_log `+where+` ORDER BY id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var changes, before, after string
+		err := rows.Scan(&e.ID, &e.EntityType, &e.EntityID, &e.Action, &e.Actor, &e.RequestID,
+			&e.CreatedAt, &changes, &before, &after)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			return nil, err
+		}
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// writeHistory responds with the audit log of the entity named by the id route variable
+func writeHistory(w http.ResponseWriter, r *http.Request, entityType, invalidIDMessage string) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, invalidIDMessage)
+		return
+	}
+
+	entries, err := loadAuditEntries(`WHERE entity_type = ? AND entity_id = ?`, entityType, id)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve history", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// getMediaHistory handles retrieving every recorded change to a media, newest first
+func getMediaHistory(w http.ResponseWriter, r *http.Request) {
+	writeHistory(w, r, auditMedia, "Invalid media ID")
+}
+
+// getArtistHistory handles retrieving every recorded change to an artist, newest first
+func getArtistHistory(w http.ResponseWriter, r *http.Request) {
+	writeHistory(w, r, auditArtist, "Invalid artist ID")
+}
+
+// getLabelHistory handles retrieving every recorded change to a label, newest first
+func getLabelHistory(w http.ResponseWriter, r *http.Request) {
+	writeHistory(w, r, auditLabel, "Invalid label ID")
+}
+
+// RevertRequest names the audit entry whose resulting state should be restored
+type RevertRequest struct {
+	AuditID int64 `json:"audit_id"`
+}
+
+// loadRevertState decodes the RevertRequest body and reads the state recorded
+// by that audit entry of the entity into v. It sends an error and returns
+// false if the entry doesn't exist or records a removal.
+func loadRevertState(w http.ResponseWriter, r *http.Request, entityType, noun string, id int, v interface{}) bool {
+	var req RevertRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return false
+	}
+
+	entries, err := loadAuditEntries(`WHERE id = ? AND entity_type = ? AND entity_id = ?`, req.AuditID, entityType, id)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve history", err)
+		return false
+	}
+	if len(entries) == 0 {
+		writeError(w, r, http.StatusNotFound, "Audit entry not found for this "+noun)
+		return false
+	}
+	if entries[0].After == nil {
+		writeError(w, r, http.StatusBadRequest, "Audit entry records a removal; there is no state to revert to")
+		return false
+	}
+
+	if err := json.Unmarshal(entries[0].After, v); err != nil {
+		writeInternalError(w, r, "Failed to read audit entry", err)
+		return false
+	}
+	return true
+}
+
+// revertMedia handles restoring a media to the state recorded by one of its
+// audit entries. If-Match must carry the current ETag, and the revert is
+// itself recorded in the audit log.
+func revertMedia(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid media ID")
+		return
+	}
+
+	var m Media
+	if !loadRevertState(w, r, auditMedia, "media", id, &m) {
+		return
+	}
+	// A snapshot without tracks means the media had none
+	if m.Tracks == nil {
+		m.Tracks = []Track{}
+	}
+
+	version, ok := checkMediaIfMatch(w, r, id)
+	if !ok {
+		return
+	}
+	saveMedia(w, r, id, m, version, auditRevert)
+}
+
+// collectionOwners returns the users with the given media in their collection
+func collectionOwners(q dbExecutor, mediaID int) ([]int, error) {
+	rows, err := q.Query(`SELECT DISTINCT user_id FROM user_media WHERE media_id = ? ORDER BY user_id`, mediaID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+// collectionSnapshot is the audited state of a user's collection
+type collectionSnapshot struct {
+	UserID int         `json:"user_id"`
+	Media  []UserMedia `json:"media"`
+}
+
+// loadCollection returns the media in a user's collection
+func loadCollection(q dbExecutor, userID int) (collectionSnapshot, error) {
+	c := collectionSnapshot{UserID: userID, Media: []UserMedia{}}
+	rows, err := q.Query(`SELECT user_id, media_id, format_id FROM user_media WHERE user_id = ? ORDER BY media_id, format_id`, userID)
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var um UserMedia
+		if err := rows.Scan(&um.UserID, &um.MediaID, &um.FormatID); err != nil {
+			return c, err
+		}
+		c.Media = append(c.Media, um)
+	}
+	return c, rows.Err()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxBulkOperations caps the number of operations in one bulk request
+const maxBulkOperations = 1000
+
+// Bulk modes: atomic rolls everything back on the first failure, best_effort
+// commits the operations that succeed and reports the rest
+const (
+	bulkAtomic     = "atomic"
+	bulkBestEffort = "best_effort"
+)
+
+// Bulk operations
+const (
+	bulkCreate       = "create"
+	bulkPatch        = "patch"
+	bulkDelete       = "delete"
+	bulkAddGenre     = "add-genre"
+	bulkRemoveGenre  = "remove-genre"
+	bulkChangeFormat = "change-format"
+)
+
+// BulkRequest is a list of media operations run in a single transaction
+type BulkRequest struct {
+	Mode       string          `json:"mode"`
+	Operations []BulkOperation `json:"operations"`
+}
+
+// BulkOperation is one operation of a bulk request. Version is required for
+// every operation but create; the operation fails unless the media is still
+// at that version.
+type BulkOperation struct {
+	Op       string                 `json:"op"`
+	ID       int                    `json:"id,omitempty"`
+	Version  int                    `json:"version,omitempty"`
+	Media    *Media                 `json:"media,omitempty"`
+	Patch    map[string]interface{} `json:"patch,omitempty"`
+	Genre    string                 `json:"genre,omitempty"`
+	FormatID int                    `json:"format_id,omitempty"`
+	Format   string                 `json:"format,omitempty"`
+}
+
+// BulkResult reports the outcome of one operation, in request order
+type BulkResult struct {
+	Index  int       `json:"index"`
+	Op     string    `json:"op"`
+	ID     int       `json:"id,omitempty"`
+	Status int       `json:"status"`
+	Error  *APIError `json:"error,omitempty"`
+	Media  *Media    `json:"media,omitempty"`
+}
+
+// BulkResponse reports whether a bulk request was committed and the outcome
+// of each operation that ran
+type BulkResponse struct {
+	Mode       string       `json:"mode"`
+	Committed  bool         `json:"committed"`
+	Succeeded  int          `json:"succeeded"`
+	Failed     int          `json:"failed"`
+	RolledBack int          `json:"rolled_back"`
+	Results    []BulkResult `json:"results"`
+}
+
+// bulkMedia handles running a list of media operations in a single
+// transaction. In atomic mode (the default) the first failure rolls back
+// every operation; in best_effort mode each failed operation is rolled back
+// on its own and the rest are committed.
+func bulkMedia(w http.ResponseWriter, r *http.Request) {
+	var req BulkRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = bulkAtomic
+	}
+	if req.Mode != bulkAtomic && req.Mode != bulkBestEffort {
+		writeError(w, r, http.StatusBadRequest, "mode must be atomic or best_effort")
+		return
+	}
+	if len(req.Operations) == 0 {
+		writeError(w, r, http.StatusBadRequest, "operations are required")
+		return
+	}
+	if len(req.Operations) > maxBulkOperations {
+		writeError(w, r, http.StatusBadRequest, "Too many operations; the limit is "+strconv.Itoa(maxBulkOperations))
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to run bulk operations", err)
+		return
+	}
+	defer tx.Rollback()
+
+	actor := requestActor(r)
+	resp := BulkResponse{Mode: req.Mode, Results: []BulkResult{}}
+	status := http.StatusOK
+	for i, op := range req.Operations {
+		if req.Mode == bulkBestEffort {
+			if _, err := tx.Exec(`SAVEPOINT bulk_item`); err != nil {
+				writeInternalError(w, r, "Failed to run bulk operations", err)
+				return
+			}
+		}
+
+		result := runBulkOperation(tx, r, actor, i, op)
+		resp.Results = append(resp.Results, result)
+		if result.Error == nil {
+			resp.Succeeded++
+			if req.Mode == bulkBestEffort {
+				if _, err := tx.Exec(`RELEASE SAVEPOINT bulk_item`); err != nil {
+					writeInternalError(w, r, "Failed to run bulk operations", err)
+					return
+				}
+			}
+			continue
+		}
+
+		resp.Failed++
+		if req.Mode == bulkAtomic {
+			// The remaining operations don't run; report why the batch stopped
+			// and that the ones before it were undone
+			status = http.StatusUnprocessableEntity
+			if result.Status >= http.StatusInternalServerError {
+				status = result.Status
+			}
+			rollBackBulkResults(r, &resp, i)
+			break
+		}
+		if _, err := tx.Exec(`ROLLBACK TO SAVEPOINT bulk_item`); err != nil {
+			writeInternalError(w, r, "Failed to run bulk operations", err)
+			return
+		}
+	}
+
+	if status == http.StatusOK {
+		if err := tx.Commit(); err != nil {
+			writeInternalError(w, r, "Failed to run bulk operations", err)
+			return
+		}
+		resp.Committed = true
+	}
+	for _, result := range resp.Results {
+		bulkOperationsTotal.inc(result.Op, bulkOutcome(result.Status))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// rollBackBulkResults marks the operations before the one at failed as
+// rolled back: they report 424 Failed Dependency and no longer carry a
+// media, or the ID of one they created.
+func rollBackBulkResults(r *http.Request, resp *BulkResponse, failed int) {
+	for i := 0; i < failed; i++ {
+		result := &resp.Results[i]
+		if result.Op == bulkCreate {
+			result.ID = 0
+		}
+		result.Status = http.StatusFailedDependency
+		result.Media = nil
+		result.Error = &APIError{
+			Code:      errorCode(http.StatusFailedDependency),
+			Message:   "Rolled back because operation " + strconv.Itoa(failed) + " failed",
+			RequestID: requestID(r),
+		}
+	}
+	resp.RolledBack = resp.Succeeded
+	resp.Succeeded = 0
+}
+
+// bulkOutcome names the result of an operation with the given status for the metrics
+func bulkOutcome(status int) string {
+	switch {
+	case status == http.StatusFailedDependency:
+		return "rolled_back"
+	case status >= http.StatusBadRequest:
+		return "failed"
+	default:
+		return "succeeded"
+	}
+}
+
+// runBulkOperation applies one operation within tx and reports its outcome
+func runBulkOperation(tx *sql.Tx, r *http.Request, actor auditActor, index int, op BulkOperation) BulkResult {
+	result := BulkResult{Index: index, Op: op.Op, ID: op.ID}
+	m, status, err := applyBulkOperation(tx, actor, op)
+	if err != nil {
+		var body APIError
+		result.Status, body = errorResponse(r, "Failed to run bulk operation", err)
+		result.Error = &body
+		return result
+	}
+	result.Status = status
+	if m != nil {
+		result.ID = m.ID
+		result.Media = m
+	}
+	return result
+}
+
+// applyBulkOperation applies one operation within tx, returning the media it
+// left behind (nil once deleted) and the status of the equivalent single request
+func applyBulkOperation(tx *sql.Tx, actor auditActor, op BulkOperation) (*Media, int, error) {
+	if op.Op == bulkCreate {
+		if op.Media == nil {
+			return nil, 0, &requestError{http.StatusBadRequest, "media is required for create"}
+		}
+		created, err := insertMediaTx(tx, actor, *op.Media)
+		if err != nil {
+			return nil, 0, err
+		}
+		return &created, http.StatusCreated, nil
+	}
+
+	if op.ID == 0 {
+		return nil, 0, &requestError{http.StatusBadRequest, "id is required for " + op.Op}
+	}
+	if op.Version == 0 {
+		return nil, 0, &requestError{http.StatusPreconditionRequired, "version is required for " + op.Op + "; send the version from the last GET"}
+	}
+	current, err := loadMedia(tx, op.ID)
+	if err == nil && current.DeletedAt != "" {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		return nil, 0, errMediaNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if op.Version != current.Version {
+		return nil, 0, errMediaModified
+	}
+
+	m := current
+	switch op.Op {
+	case bulkDelete:
+		if err := trashMediaTx(tx, actor, op.ID, current.Version); err != nil {
+			return nil, 0, err
+		}
+		return nil, http.StatusNoContent, nil
+	case bulkPatch:
+		if op.Patch == nil {
+			return nil, 0, &requestError{http.StatusBadRequest, "patch is required for patch"}
+		}
+		if m, err = patchedMedia(current, op.Patch); err != nil {
+			return nil, 0, &requestError{http.StatusBadRequest, "Invalid patch: " + err.Error()}
+		}
+	case bulkAddGenre, bulkRemoveGenre:
+		genre := strings.TrimSpace(op.Genre)
+		if genre == "" {
+			return nil, 0, &requestError{http.StatusBadRequest, "genre is required for " + op.Op}
+		}
+		if op.Op == bulkAddGenre {
+			if genre, err = NormalizeGenre(tx, genre); err != nil {
+				return nil, 0, err
+			}
+			m.GenreTags = addGenre(current.GenreTags, genre)
+		} else {
+			m.GenreTags = removeGenre(current.GenreTags, genre)
+		}
+	case bulkChangeFormat:
+		if op.FormatID == 0 && op.Format == "" {
+			return nil, 0, &requestError{http.StatusBadRequest, "format_id or format is required for change-format"}
+		}
+		m.FormatID, m.FormatName = op.FormatID, op.Format
+	default:
+		return nil, 0, &requestError{http.StatusBadRequest, "Unknown operation: " + op.Op}
+	}
+
+	// Leave the tracks alone; none of these operations change them
+	if op.Op != bulkPatch {
+		m.Tracks = nil
+	}
+	updated, err := updateMediaTx(tx, actor, op.ID, m, current.Version, auditUpdate)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &updated, http.StatusOK, nil
+}
+
+// addGenre returns tags with genre appended, unless it is already there in any case
+func addGenre(tags []string, genre string) []string {
+	result := []string{}
+	for _, tag := range tags {
+		if strings.EqualFold(tag, genre) {
+			return append(result, tags...)
+		}
+	}
+	return append(append(result, tags...), genre)
+}
+
+// removeGenre returns tags without genre, compared case-insensitively
+func removeGenre(tags []string, genre string) []string {
+	result := []string{}
+	for _, tag := range tags {
+		if !strings.EqualFold(tag, genre) {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
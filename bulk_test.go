@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRollBackBulkResults(t *testing.T) {
+	resp := BulkResponse{
+		Mode:      bulkAtomic,
+		Succeeded: 2,
+		Failed:    1,
+		Results: []BulkResult{
+			{Index: 0, Op: bulkCreate, ID: 41, Status: http.StatusCreated, Media: &Media{ID: 41}},
+			{Index: 1, Op: bulkPatch, ID: 7, Status: http.StatusOK, Media: &Media{ID: 7}},
+			{Index: 2, Op: bulkDelete, ID: 8, Status: http.StatusPreconditionFailed, Error: &APIError{Code: "precondition_failed"}},
+		},
+	}
+
+	rollBackBulkResults(httptest.NewRequest("POST", "/api/v1/media/bulk", nil), &resp, 2)
+
+	if resp.Succeeded != 0 || resp.Failed != 1 || resp.RolledBack != 2 {
+		t.Errorf("succeeded, failed, rolled back = %d, %d, %d; want 0, 1, 2", resp.Succeeded, resp.Failed, resp.RolledBack)
+	}
+	for _, result := range resp.Results[:2] {
+		if result.Status != http.StatusFailedDependency || result.Media != nil || result.Error == nil {
+			t.Errorf("result %d = %+v, want a rolled back 424 without media", result.Index, result)
+		}
+	}
+	if resp.Results[0].ID != 0 {
+		t.Errorf("rolled back create kept ID %d", resp.Results[0].ID)
+	}
+	if resp.Results[1].ID != 7 {
+		t.Errorf("rolled back patch ID = %d, want 7", resp.Results[1].ID)
+	}
+	if resp.Results[2].Status != http.StatusPreconditionFailed {
+		t.Errorf("failed operation status = %d, want 412", resp.Results[2].Status)
+	}
+
+	for status, want := range map[int]string{
+		http.StatusOK:                  "succeeded",
+		http.StatusCreated:             "succeeded",
+		http.StatusNoContent:           "succeeded",
+		http.StatusPreconditionFailed:  "failed",
+		http.StatusInternalServerError: "failed",
+		http.StatusFailedDependency:    "rolled_back",
+	} {
+		if got := bulkOutcome(status); got != want {
+			t.Errorf("bulkOutcome(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
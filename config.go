@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix is prepended to the upper-cased JSON name of a setting to get its
+// environment variable, e.g. db_password is read from RECORD_DB_PASSWORD
+const envPrefix = "RECORD_"
+
+// defaultConfigFile is loaded when no -config flag is given, if it exists
+const defaultConfigFile = "config.json"
+
+// Config struct holds the application configuration
+type Config struct {
+	DBUser     string `json:"db_user"`
+	DBPassword string `json:"db_password"`
+	DBName     string `json:"db_name"`
+	DBHost     string `json:"db_host"`
+	DBPort     string `json:"db_port"`
+	ServerPort string `json:"server_port"`
+
+	// DBTLS is "false", "true", "skip-verify" or "preferred", as understood by the MySQL driver
+	DBTLS             string   `json:"db_tls"`
+	DBConnectTimeout  Duration `json:"db_connect_timeout"`
+	DBReadTimeout     Duration `json:"db_read_timeout"`
+	DBWriteTimeout    Duration `json:"db_write_timeout"`
+	DBMaxOpenConns    int      `json:"db_max_open_conns"`
+	DBMaxIdleConns    int      `json:"db_max_idle_conns"`
+	DBConnMaxLifetime Duration `json:"db_conn_max_lifetime"`
+	// DBStartupTimeout is how long to keep retrying the database at startup
+	DBStartupTimeout Duration `json:"db_startup_timeout"`
+
+	ServerReadTimeout     Duration `json:"server_read_timeout"`
+	ServerWriteTimeout    Duration `json:"server_write_timeout"`
+	ServerIdleTimeout     Duration `json:"server_idle_timeout"`
+	ServerShutdownTimeout Duration `json:"server_shutdown_timeout"`
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+
+	CORSAllowedOrigins []string `json:"cors_allowed_origins"`
+
+	// Token bucket rate limits per client IP and per user (X-User, or the IP when it is
+	// absent); a rate of zero disables the limit
+	RateLimitIPPerMinute   int `json:"rate_limit_ip_per_minute"`
+	RateLimitIPBurst       int `json:"rate_limit_ip_burst"`
+	RateLimitUserPerMinute int `json:"rate_limit_user_per_minute"`
+	RateLimitUserBurst     int `json:"rate_limit_user_burst"`
+	// MaxBodyBytes caps request bodies; import routes get MaxImportBodyBytes instead
+	MaxBodyBytes       int64 `json:"max_body_bytes"`
+	MaxImportBodyBytes int64 `json:"max_import_body_bytes"`
+
+	// SeedProfile, if set, is seeded by a job queued at startup; otherwise use the seed command
+	SeedProfile string `json:"seed_profile"`
+
+	// TrashRetention is how long deleted media stay restorable; zero keeps them forever
+	TrashRetention     Duration `json:"trash_retention"`
+	TrashPurgeInterval Duration `json:"trash_purge_interval"`
+
+	// GraphQLMaxDepth and GraphQLMaxComplexity bound the queries /graphql accepts
+	GraphQLMaxDepth      int `json:"graphql_max_depth"`
+	GraphQLMaxComplexity int `json:"graphql_max_complexity"`
+
+	// EventsPollInterval is how often /events checks the audit log for
+	// changes; EventsBufferSize is how many events are kept for resuming
+	EventsPollInterval Duration `json:"events_poll_interval"`
+	EventsBufferSize   int      `json:"events_buffer_size"`
+
+	// Webhook deliveries time out after WebhookTimeout and are retried after
+	// WebhookBackoff, doubling each time, until tried WebhookMaxAttempts times.
+	// Webhooks may only reach loopback and link-local addresses with
+	// WebhookAllowLocal, for local development.
+	WebhookMaxAttempts int      `json:"webhook_max_attempts"`
+	WebhookBackoff     Duration `json:"webhook_backoff"`
+	WebhookTimeout     Duration `json:"webhook_timeout"`
+	WebhookAllowLocal  bool     `json:"webhook_allow_local"`
+
+	// JobWorkers run background jobs, checking for new ones every
+	// JobPollInterval. A failed job is retried after JobRetryBackoff, doubling
+	// each time, until tried JobMaxAttempts times.
+	JobWorkers      int      `json:"job_workers"`
+	JobPollInterval Duration `json:"job_poll_interval"`
+	JobMaxAttempts  int      `json:"job_max_attempts"`
+	JobRetryBackoff Duration `json:"job_retry_backoff"`
+
+	// LegacyAPISunset is the YYYY-MM-DD date the unversioned root paths will
+	// be removed, announced in their Sunset header; empty leaves it out
+	LegacyAPISunset string `json:"legacy_api_sunset"`
+
+	MetadataProvider string `json:"metadata_provider"`
+	MusicBrainzURL   string `json:"musicbrainz_url"`
+	DiscogsURL       string `json:"discogs_url"`
+	DiscogsToken     string `json:"discogs_token"`
+}
+
+// Duration is a time.Duration written as a string such as "30s" in config files and environment variables
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// defaultConfig returns the settings used when neither the config file nor the environment sets them
+func defaultConfig() *Config {
+	return &Config{
+		DBName:     "recordcollection",
+		DBHost:     "localhost",
+		DBPort:     "3306",
+		ServerPort: "8080",
+
+		DBTLS:             "false",
+		DBConnectTimeout:  Duration{10 * time.Second},
+		DBReadTimeout:     Duration{30 * time.Second},
+		DBWriteTimeout:    Duration{30 * time.Second},
+		DBMaxOpenConns:    25,
+		DBMaxIdleConns:    25,
+		DBConnMaxLifetime: Duration{5 * time.Minute},
+		DBStartupTimeout:  Duration{time.Minute},
+
+		ServerReadTimeout:     Duration{15 * time.Second},
+		ServerWriteTimeout:    Duration{30 * time.Second},
+		ServerIdleTimeout:     Duration{2 * time.Minute},
+		ServerShutdownTimeout: Duration{30 * time.Second},
+
+		CORSAllowedOrigins: []string{"http://localhost:3000"},
+
+		RateLimitIPPerMinute:   600,
+		RateLimitIPBurst:       100,
+		RateLimitUserPerMinute: 300,
+		RateLimitUserBurst:     50,
+		MaxBodyBytes:           1 << 20,
+		MaxImportBodyBytes:     32 << 20,
+
+		TrashRetention:     Duration{30 * 24 * time.Hour},
+		TrashPurgeInterval: Duration{time.Hour},
+
+		GraphQLMaxDepth:      10,
+		GraphQLMaxComplexity: 1000,
+
+		EventsPollInterval: Duration{time.Second},
+		EventsBufferSize:   1000,
+
+		WebhookMaxAttempts: 8,
+		WebhookBackoff:     Duration{30 * time.Second},
+		WebhookTimeout:     Duration{10 * time.Second},
+
+		JobWorkers:      2,
+		JobPollInterval: Duration{time.Second},
+		JobMaxAttempts:  3,
+		JobRetryBackoff: Duration{30 * time.Second},
+
+		LegacyAPISunset: "2027-04-30",
+	}
+}
+
+// loadConfig builds the configuration in layers: the defaults, then the JSON
+// file at path (or config.json if path is empty and that file exists), then
+// any RECORD_* environment variables. The result is validated before returning.
+func loadConfig(path string) (*Config, error) {
+	config := defaultConfig()
+
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigFile
+	}
+	file, err := os.Open(path)
+	if err == nil {
+		defer file.Close()
+		err = json.NewDecoder(file).Decode(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	} else if explicit || !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	err = applyEnv(config, os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// applyEnv overrides config fields from environment variables named after their JSON tags
+func applyEnv(config *Config, lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := envPrefix + strings.ToUpper(t.Field(i).Tag.Get("json"))
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(value)
+		case int, int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a number", name, value)
+			}
+			field.SetInt(n)
+		case bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a boolean", name, value)
+			}
+			field.SetBool(b)
+		case Duration:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a duration", name, value)
+			}
+			field.Set(reflect.ValueOf(Duration{d}))
+		case []string:
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		default:
+			return fmt.Errorf("%s: unsupported setting type %s", name, field.Type())
+		}
+	}
+	return nil
+}
+
+// ConfigError lists every problem found while validating the configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// dbNamePattern limits database names to characters that are safe to use unquoted in SQL
+var dbNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// Validate checks that the configuration can be used to start the server
+func (c *Config) Validate() error {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.DBUser == "" {
+		addf("db_user is required")
+	}
+	if c.DBHost == "" {
+		addf("db_host is required")
+	}
+	if !dbNamePattern.MatchString(c.DBName) {
+		addf("db_name %q must contain only letters, digits and underscores", c.DBName)
+	}
+	if !validPort(c.DBPort) {
+		addf("db_port %q is not a valid port", c.DBPort)
+	}
+	if !validPort(c.ServerPort) {
+		addf("server_port %q is not a valid port", c.ServerPort)
+	}
+
+	switch c.DBTLS {
+	case "false", "true", "skip-verify", "preferred":
+	default:
+		addf("db_tls %q must be one of false, true, skip-verify or preferred", c.DBTLS)
+	}
+	for _, d := range []struct {
+		name  string
+		value Duration
+	}{
+		{"db_connect_timeout", c.DBConnectTimeout},
+		{"db_read_timeout", c.DBReadTimeout},
+		{"db_write_timeout", c.DBWriteTimeout},
+		{"db_conn_max_lifetime", c.DBConnMaxLifetime},
+		{"db_startup_timeout", c.DBStartupTimeout},
+		{"server_read_timeout", c.ServerReadTimeout},
+		{"server_write_timeout", c.ServerWriteTimeout},
+		{"server_idle_timeout", c.ServerIdleTimeout},
+		{"server_shutdown_timeout", c.ServerShutdownTimeout},
+		{"trash_retention", c.TrashRetention},
+		{"trash_purge_interval", c.TrashPurgeInterval},
+	} {
+		if d.value.Duration < 0 {
+			addf("%s must not be negative", d.name)
+		}
+	}
+	if c.TrashRetention.Duration > 0 && c.TrashPurgeInterval.Duration <= 0 {
+		addf("trash_purge_interval must be positive when trash_retention is set")
+	}
+	if c.DBMaxOpenConns < 0 {
+		addf("db_max_open_conns must not be negative")
+	}
+	if c.DBMaxIdleConns < 0 {
+		addf("db_max_idle_conns must not be negative")
+	}
+
+	for _, n := range []struct {
+		name  string
+		value int
+	}{
+		{"rate_limit_ip_per_minute", c.RateLimitIPPerMinute},
+		{"rate_limit_ip_burst", c.RateLimitIPBurst},
+		{"rate_limit_user_per_minute", c.RateLimitUserPerMinute},
+		{"rate_limit_user_burst", c.RateLimitUserBurst},
+	} {
+		if n.value < 0 {
+			addf("%s must not be negative", n.name)
+		}
+	}
+	if c.MaxBodyBytes <= 0 {
+		addf("max_body_bytes must be positive")
+	}
+	if c.MaxImportBodyBytes < c.MaxBodyBytes {
+		addf("max_import_body_bytes must be at least max_body_bytes")
+	}
+	if c.GraphQLMaxDepth <= 0 {
+		addf("graphql_max_depth must be positive")
+	}
+	if c.GraphQLMaxComplexity <= 0 {
+		addf("graphql_max_complexity must be positive")
+	}
+	if c.EventsPollInterval.Duration <= 0 {
+		addf("events_poll_interval must be positive")
+	}
+	if c.EventsBufferSize <= 0 {
+		addf("events_buffer_size must be positive")
+	}
+	if c.WebhookMaxAttempts <= 0 {
+		addf("webhook_max_attempts must be positive")
+	}
+	if c.WebhookBackoff.Duration <= 0 {
+		addf("webhook_backoff must be positive")
+	}
+	if c.WebhookTimeout.Duration <= 0 {
+		addf("webhook_timeout must be positive")
+	}
+	if c.JobWorkers <= 0 {
+		addf("job_workers must be positive")
+	}
+	if c.JobPollInterval.Duration <= 0 {
+		addf("job_poll_interval must be positive")
+	}
+	if c.JobMaxAttempts <= 0 {
+		addf("job_max_attempts must be positive")
+	}
+	if c.JobRetryBackoff.Duration <= 0 {
+		addf("job_retry_backoff must be positive")
+	}
+
+	if c.LegacyAPISunset != "" {
+		if _, err := time.Parse("2006-01-02", c.LegacyAPISunset); err != nil {
+			addf("legacy_api_sunset %q must be a YYYY-MM-DD date", c.LegacyAPISunset)
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		addf("tls_cert_file and tls_key_file must be set together")
+	}
+	for _, f := range []struct{ name, path string }{
+		{"tls_cert_file", c.TLSCertFile},
+		{"tls_key_file", c.TLSKeyFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			addf("%s: %v", f.name, err)
+		}
+	}
+
+	if len(c.CORSAllowedOrigins) == 0 {
+		addf("cors_allowed_origins must list at least one origin")
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			addf("cors_allowed_origins entry %q is not an origin such as https://example.com", origin)
+		}
+	}
+
+	if _, ok := seedProfiles[c.SeedProfile]; c.SeedProfile != "" && !ok {
+		addf("seed_profile %q must be one of %s", c.SeedProfile, strings.Join(seedProfileNames(), ", "))
+	}
+
+	switch strings.ToLower(c.MetadataProvider) {
+	case "", "musicbrainz", "discogs":
+	default:
+		addf("metadata_provider %q must be musicbrainz, discogs or empty", c.MetadataProvider)
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// validPort reports whether port is a TCP port number
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 )
@@ -14,29 +16,25 @@ import (
 // db is the global database connection pool
 var db *sql.DB
 
-// loadConfig reads the configuration from a JSON file
-func loadConfig() (*Config, error) {
-	file, err := os.Open("config.json")
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	config := &Config{}
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(config)
-	if err != nil {
-		return nil, err
-	}
-
-	return config, nil
+// dsn builds the MySQL data source name for dbName, which may be empty to connect to the server only
+func dsn(config *Config, dbName string) string {
+	c := mysql.NewConfig()
+	c.User = config.DBUser
+	c.Passwd = config.DBPassword
+	c.Net = "tcp"
+	c.Addr = net.JoinHostPort(config.DBHost, config.DBPort)
+	c.DBName = dbName
+	c.TLSConfig = config.DBTLS
+	c.Timeout = config.DBConnectTimeout.Duration
+	c.ReadTimeout = config.DBReadTimeout.Duration
+	c.WriteTimeout = config.DBWriteTimeout.Duration
+	return c.FormatDSN()
 }
 
 // connectToMySQL connects to the MySQL server
 func connectToMySQL(config *Config) error {
-	connStr := fmt.Sprintf("%s:%s@tcp(%s:%s)/", config.DBUser, config.DBPassword, config.DBHost, config.DBPort)
 	var err error
-	db, err = sql.Open("mysql", connStr)
+	db, err = sql.Open("mysql", dsn(config, ""))
 	return err
 }
 
@@ -46,16 +44,21 @@ func createDatabase(config *Config) error {
 	return err
 }
 
-// connectToDatabase connects to the newly created database
+// connectToDatabase connects to the newly created database and sizes its connection pool
 func connectToDatabase(config *Config) error {
-	connStr := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", config.DBUser, config.DBPassword, config.DBHost, config.DBPort, config.DBName)
 	var err error
-	db, err = sql.Open("mysql", connStr)
-	return err
+	db, err = sql.Open("mysql", dsn(config, config.DBName))
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(config.DBMaxOpenConns)
+	db.SetMaxIdleConns(config.DBMaxIdleConns)
+	db.SetConnMaxLifetime(config.DBConnMaxLifetime.Duration)
+	return nil
 }
 
 // createTables creates the necessary tables if they do not exist
-func createTables() {
+func createTables() error {
 	createTableQueries := []string{
 		`CREATE TABLE IF NOT EXISTS users (
 			id INT AUTO_INCREMENT PRIMARY KEY,
@@ -65,17 +68,46 @@ func createTables() {
 			email TEXT,
 			password TEXT
 		);`,
-		`CREATE TABLE IF NOT EXISTS artists (id INT AUTO_INCREMENT PRIMARY KEY, name TEXT);`,
+		`CREATE TABLE IF NOT EXISTS artists (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			name TEXT,
+			sort_name VARCHAR(255) NOT NULL DEFAULT '',
+			country VARCHAR(64) NOT NULL DEFAULT '',
+			active_from INT NULL,
+			active_to INT NULL,
+			version INT NOT NULL DEFAULT 1
+		);`,
 		`CREATE TABLE IF NOT EXISTS formats (id INT AUTO_INCREMENT PRIMARY KEY, name TEXT, description TEXT);`,
+		`CREATE TABLE IF NOT EXISTS labels (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			parent_id INT NULL,
+			CONSTRAINT fk_labels_parent FOREIGN KEY (parent_id) REFERENCES labels(id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS label_catalog_prefixes (
+			label_id INT NOT NULL,
+			prefix VARCHAR(32) NOT NULL,
+			PRIMARY KEY (label_id, prefix),
+			CONSTRAINT fk_label_catalog_prefixes_label FOREIGN KEY (label_id) REFERENCES labels(id) ON DELETE CASCADE
+		);`,
 		`CREATE TABLE IF NOT EXISTS media (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			title TEXT,
 			date_published DATE,
+			date_precision VARCHAR(8) NOT NULL DEFAULT 'day',
 			image_url TEXT,
 			genre_tags TEXT,
 			artist_id INT,
 			format_id INT,
+			barcode VARCHAR(32) NOT NULL DEFAULT '',
+			catalog_number VARCHAR(64) NOT NULL DEFAULT '',
+			label_id INT NULL,
+			version INT NOT NULL DEFAULT 1,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			deleted_at DATETIME NULL,
+			INDEX idx_media_deleted_at (deleted_at),
 			CONSTRAINT fk_media_artist FOREIGN KEY (artist_id) REFERENCES artists(id),
+			CONSTRAINT fk_media_label FOREIGN KEY (label_id) REFERENCES labels(id),
 			CONSTRAINT fk_media_format FOREIGN KEY (format_id) REFERENCES formats(id),
 			CONSTRAINT unique_media UNIQUE (title(255), artist_id, format_id)
 		);`,
@@ -88,57 +120,187 @@ func createTables() {
 			CONSTRAINT fk_user_media_media FOREIGN KEY (media_id) REFERENCES media(id),
 			CONSTRAINT fk_user_media_format FOREIGN KEY (format_id) REFERENCES formats(id)
 		);`,
+		`CREATE TABLE IF NOT EXISTS tracks (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			media_id INT NOT NULL,
+			position VARCHAR(16) NOT NULL,
+			title TEXT,
+			length VARCHAR(16) NOT NULL DEFAULT '',
+			CONSTRAINT fk_tracks_media FOREIGN KEY (media_id) REFERENCES media(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS enrichment_reviews (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			media_id INT NOT NULL,
+			provider VARCHAR(32) NOT NULL,
+			changes TEXT NOT NULL,
+			status VARCHAR(16) NOT NULL DEFAULT 'pending',
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			reviewed_at DATETIME NULL,
+			CONSTRAINT fk_enrichment_reviews_media FOREIGN KEY (media_id) REFERENCES media(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS artist_aliases (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			artist_id INT NOT NULL,
+			alias VARCHAR(255) NOT NULL,
+			normalized_alias VARCHAR(255) NOT NULL,
+			INDEX idx_artist_aliases_normalized (normalized_alias),
+			CONSTRAINT fk_artist_aliases_artist FOREIGN KEY (artist_id) REFERENCES artists(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS media_aliases (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			media_id INT NOT NULL,
+			artist_id INT NOT NULL,
+			normalized_title VARCHAR(255) NOT NULL,
+			INDEX idx_media_aliases_title (artist_id, normalized_title),
+			CONSTRAINT fk_media_aliases_media FOREIGN KEY (media_id) REFERENCES media(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS seed_files (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			checksum CHAR(64) NOT NULL,
+			applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT unique_seed_file UNIQUE (name, checksum)
+		);`,
 		`CREATE TABLE IF NOT EXISTS genre_mappings (
         id INT AUTO_INCREMENT PRIMARY KEY,
         genre VARCHAR(255) NOT NULL,
         normalized_genre VARCHAR(255) NOT NULL
     )`,
+		// Append-only; no foreign keys so history outlives the entities it describes
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			entity_type VARCHAR(32) NOT NULL,
+			entity_id INT NOT NULL,
+			action VARCHAR(16) NOT NULL,
+			actor VARCHAR(255) NOT NULL,
+			request_id VARCHAR(128) NOT NULL DEFAULT '',
+			changes MEDIUMTEXT NOT NULL,
+			before_state MEDIUMTEXT NULL,
+			after_state MEDIUMTEXT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_audit_log_entity (entity_type, entity_id, id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS webhooks (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			url TEXT NOT NULL,
+			secret VARCHAR(255) NOT NULL,
+			event_types TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			webhook_id INT NOT NULL,
+			event_id BIGINT NOT NULL,
+			event_type VARCHAR(64) NOT NULL,
+			payload MEDIUMTEXT NOT NULL,
+			status VARCHAR(16) NOT NULL DEFAULT 'pending',
+			attempts INT NOT NULL DEFAULT 0,
+			response_status INT NULL,
+			last_error VARCHAR(1024) NOT NULL DEFAULT '',
+			next_attempt_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			delivered_at DATETIME NULL,
+			CONSTRAINT unique_webhook_delivery UNIQUE (webhook_id, event_id),
+			INDEX idx_webhook_deliveries_due (status, next_attempt_at),
+			CONSTRAINT fk_webhook_deliveries_webhook FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS webhook_cursor (
+			id TINYINT PRIMARY KEY,
+			last_event_id BIGINT NOT NULL,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS jobs (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			type VARCHAR(32) NOT NULL,
+			payload LONGTEXT NOT NULL,
+			status VARCHAR(16) NOT NULL DEFAULT 'queued',
+			progress_done INT NOT NULL DEFAULT 0,
+			progress_total INT NOT NULL DEFAULT 0,
+			attempts INT NOT NULL DEFAULT 0,
+			max_attempts INT NOT NULL,
+			error VARCHAR(1024) NOT NULL DEFAULT '',
+			result MEDIUMTEXT NULL,
+			cancel_requested BOOLEAN NOT NULL DEFAULT FALSE,
+			created_by VARCHAR(255) NOT NULL,
+			request_id VARCHAR(128) NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			run_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			started_at DATETIME NULL,
+			heartbeat_at DATETIME NULL,
+			finished_at DATETIME NULL,
+			unique_type VARCHAR(32) NULL,
+			active_key VARCHAR(32) AS (` + jobActiveKey + `) STORED UNIQUE,
+			INDEX idx_jobs_type_status (type, status),
+			INDEX idx_jobs_due (status, run_at)
+		);`,
 	}
 	for _, query := range createTableQueries {
 		_, err := db.Exec(query)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
 
-	checkAndAddColumn("artists", "name", "TEXT")
-	checkAndAddColumn("formats", "name", "TEXT")
-	checkAndAddColumn("formats", "description", "TEXT")
-	checkAndAddColumn("media", "title", "TEXT")
-	checkAndAddColumn("media", "date_published", "DATE")
-	checkAndAddColumn("media", "image_url", "TEXT")
-	checkAndAddColumn("media", "genre_tags", "TEXT")
-	checkAndAddColumn("media", "artist_id", "INT")
-	checkAndAddColumn("media", "format_id", "INT")
-	checkAndAddColumn("users", "first_name", "TEXT")
-	checkAndAddColumn("users", "last_name", "TEXT")
-	checkAndAddColumn("users", "username", "TEXT")
-	checkAndAddColumn("users", "email", "TEXT")
-	checkAndAddColumn("users", "password", "TEXT")
+	columns := []struct{ table, name, columnType string }{
+		{"artists", "name", "TEXT"},
+		{"artists", "sort_name", "VARCHAR(255) NOT NULL DEFAULT ''"},
+		{"artists", "country", "VARCHAR(64) NOT NULL DEFAULT ''"},
+		{"artists", "active_from", "INT NULL"},
+		{"artists", "active_to", "INT NULL"},
+		{"artists", "version", "INT NOT NULL DEFAULT 1"},
+		{"enrichment_reviews", "media_version", "INT NULL"},
+		{"jobs", "unique_type", "VARCHAR(32) NULL"},
+		{"jobs", "active_key", "VARCHAR(32) AS (" + jobActiveKey + ") STORED UNIQUE"},
+		{"formats", "name", "TEXT"},
+		{"formats", "description", "TEXT"},
+		{"media", "title", "TEXT"},
+		{"media", "date_published", "DATE"},
+		{"media", "date_precision", "VARCHAR(8) NOT NULL DEFAULT 'day'"},
+		{"media", "image_url", "TEXT"},
+		{"media", "genre_tags", "TEXT"},
+		{"media", "artist_id", "INT"},
+		{"media", "format_id", "INT"},
+		{"media", "barcode", "VARCHAR(32) NOT NULL DEFAULT ''"},
+		{"media", "catalog_number", "VARCHAR(64) NOT NULL DEFAULT ''"},
+		{"media", "label_id", "INT NULL"},
+		{"media", "version", "INT NOT NULL DEFAULT 1"},
+		{"media", "updated_at", "DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"},
+		{"media", "deleted_at", "DATETIME NULL"},
+		{"users", "first_name", "TEXT"},
+		{"users", "last_name", "TEXT"},
+		{"users", "username", "TEXT"},
+		{"users", "email", "TEXT"},
+		{"users", "password", "TEXT"},
+	}
+	for _, c := range columns {
+		if err := checkAndAddColumn(c.table, c.name, c.columnType); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // checkAndAddColumn checks if a column exists and adds it if it doesn't
-func checkAndAddColumn(tableName, columnName, columnType string) {
-	query := fmt.Sprintf(`SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_NAME='%s' AND COLUMN_NAME='%s';`, tableName, columnName)
+func checkAndAddColumn(tableName, columnName, columnType string) error {
 	var count int
-	err := db.QueryRow(query).Scan(&count)
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, tableName, columnName).Scan(&count)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if count == 0 {
-		query = fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, tableName, columnName, columnType)
-		_, err = db.Exec(query)
+		_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, tableName, columnName, columnType))
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("failed to add %s.%s: %v", tableName, columnName, err)
 		}
 	}
+	return nil
 }
 
 // importFormatsByFile populates the formats table with necessary format IDs
-func importFormatsByFile(filename string) {
+func importFormatsByFile(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatal("Failed to open JSON file:", err)
+		return fmt.Errorf("failed to open %s: %v", filename, err)
 	}
 	defer file.Close()
 
@@ -146,27 +308,40 @@ func importFormatsByFile(filename string) {
 	decoder := json.NewDecoder(file)
 	err = decoder.Decode(&formats)
 	if err != nil {
-		log.Fatal("Failed to decode JSON file:", err)
+		return fmt.Errorf("failed to decode %s: %v", filename, err)
 	}
 
-	for _, format := range formats {
+	for i, format := range formats {
+		if err := format.Validate(); err != nil {
+			return fmt.Errorf("%s: format %d: %v", filename, i, err)
+		}
 		var formatID int
 		err := db.QueryRow(`SELECT id FROM formats WHERE name = ? AND description = ?`, format.Name, format.Description).Scan(&formatID)
 		if err == sql.ErrNoRows {
-			_, err = db.Exec(`INSERT INTO formats (name, description) VALUES (?, ?)`, format.Name, format.Description)
+			result, err := db.Exec(`INSERT INTO formats (name, description) VALUES (?, ?)`, format.Name, format.Description)
+			if err != nil {
+				return fmt.Errorf("failed to insert format: %v", err)
+			}
+			id, err := result.LastInsertId()
 			if err != nil {
-				log.Fatal("Failed to insert format:", err)
+				return fmt.Errorf("failed to retrieve last insert ID for format: %v", err)
+			}
+			format.ID = int(id)
+			if err := recordAudit(db, importerActor, auditFormat, format.ID, auditCreate, nil, format); err != nil {
+				return fmt.Errorf("failed to record format in audit log: %v", err)
 			}
 		} else if err != nil {
-			log.Fatal("Failed to query format:", err)
+			return fmt.Errorf("failed to query format: %v", err)
 		}
 	}
+	return nil
 }
 
-func importMediaByFile(filename string) {
+// importMediaByFile adds the media listed in a JSON file
+func importMediaByFile(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatal("Failed to open JSON file:", err)
+		return fmt.Errorf("failed to open %s: %v", filename, err)
 	}
 	defer file.Close()
 
@@ -174,76 +349,225 @@ func importMediaByFile(filename string) {
 	decoder := json.NewDecoder(file)
 	err = decoder.Decode(&media)
 	if err != nil {
-		log.Fatal("Failed to decode JSON file:", err)
+		return fmt.Errorf("failed to decode %s: %v", filename, err)
 	}
+	return importMedia(importerActor, media)
+}
 
-	for _, m := range media {
-		var artistID int
-		err := db.QueryRow(`SELECT id FROM artists WHERE name = ?`, m.ArtistName).Scan(&artistID)
+// importMedia adds media by artist and format name, creating missing artists
+// and labels, and records the changes as made by actor. Media that already
+// exist, or were merged into another, are skipped.
+func importMedia(actor auditActor, media []Media) error {
+	for i, m := range media {
+		// Invalid entries are logged and skipped rather than failing the whole import
+		if err := m.Validate(); err != nil {
+			log.Printf("Skipping media %d (%q): %v", i, m.Title, err)
+			importMediaTotal.inc("invalid")
+			continue
+		}
+
+		artistID, err := resolveArtistID(db, m.ArtistName)
 		if err == sql.ErrNoRows {
 			// Artist not found, insert new artist
-			result, err := db.Exec(`INSERT INTO artists (name) VALUES (?)`, m.ArtistName)
+			result, err := db.Exec(`INSERT INTO artists (name, sort_name) VALUES (?, ?)`, m.ArtistName, defaultSortName(m.ArtistName))
 			if err != nil {
-				log.Fatal("Failed to insert artist:", err)
+				return fmt.Errorf("failed to insert artist: %v", err)
 			}
 			artistID64, err := result.LastInsertId()
 			if err != nil {
-				log.Fatal("Failed to retrieve last insert ID for artist:", err)
+				return fmt.Errorf("failed to retrieve last insert ID for artist: %v", err)
 			}
 			artistID = int(artistID64)
+			artist, err := loadArtist(db, artistID)
+			if err == nil {
+				err = recordAudit(db, actor, auditArtist, artistID, auditCreate, nil, artist)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to record artist in audit log: %v", err)
+			}
 		} else if err != nil {
-			log.Fatal("Failed to query artist:", err)
+			return fmt.Errorf("failed to query artist: %v", err)
 		}
 
-		var formatID int
-		err = db.QueryRow(`SELECT id FROM formats WHERE name = ?`, m.FormatName).Scan(&formatID)
+		formatID, err := resolveFormatID(db, m.FormatID, m.FormatName)
 		if err == sql.ErrNoRows {
-			log.Fatal("Format not found:", m.FormatName)
+			return fmt.Errorf("format not found: %s", m.FormatName)
 		} else if err != nil {
-			log.Fatal("Failed to query format:", err)
+			return fmt.Errorf("failed to query format: %v", err)
+		}
+
+		labelID, err := resolveLabelID(db, actor, m.LabelName, m.CatalogNumber)
+		if err != nil {
+			return fmt.Errorf("failed to resolve label: %v", err)
+		}
+
+		// Skip media that was merged into another under a different title
+		var mergedID int
+		err = db.QueryRow(`SELECT media_id FROM media_aliases WHERE artist_id = ? AND normalized_title = ?`, artistID, normalizeName(m.Title)).Scan(&mergedID)
+		if err == nil {
+			importMediaTotal.inc("skipped")
+			continue
+		} else if err != sql.ErrNoRows {
+			return fmt.Errorf("failed to query media alias: %v", err)
 		}
 
 		// Normalize genre tags
 		for i, genre := range m.GenreTags {
-			m.GenreTags[i] = NormalizeGenre(db, genre)
+			m.GenreTags[i], err = NormalizeGenre(db, genre)
+			if err != nil {
+				return fmt.Errorf("failed to query genre mapping: %v", err)
+			}
 		}
 
-		_, err = db.Exec(`INSERT INTO media (title, date_published, image_url, genre_tags, artist_id, format_id) VALUES (?, ?, ?, ?, ?, ?)`,
-			m.Title, m.DatePublished, m.ImageURL, strings.Join(m.GenreTags, ","), artistID, formatID)
+		datePublished, datePrecision := releaseDateColumns(m.DatePublished)
+		result, err := db.Exec(`INSERT INTO media (title, date_published, date_precision, image_url, genre_tags, artist_id, format_id, barcode, catalog_number, label_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			m.Title, datePublished, datePrecision, m.ImageURL, strings.Join(m.GenreTags, ","), artistID, formatID, m.Barcode, m.CatalogNumber, labelID)
 		if err != nil {
 			if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+				importMediaTotal.inc("skipped")
 				continue
 			}
-			log.Fatal("Failed to insert media:", err)
+			return fmt.Errorf("failed to insert media: %v", err)
+		}
+		mediaID, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to retrieve last insert ID for media: %v", err)
+		}
+		created, err := loadMedia(db, int(mediaID))
+		if err == nil {
+			err = recordAudit(db, actor, auditMedia, created.ID, auditCreate, nil, created)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to record media in audit log: %v", err)
+		}
+		importMediaTotal.inc("inserted")
+	}
+	return nil
+}
+
+// resolveArtistID finds an artist by exact name, falling back to the aliases
+// kept from merged duplicates. It returns sql.ErrNoRows if neither matches.
+func resolveArtistID(q dbExecutor, name string) (int, error) {
+	var artistID int
+	err := q.QueryRow(`SELECT id FROM artists WHERE name = ?`, name).Scan(&artistID)
+	if err != sql.ErrNoRows {
+		return artistID, err
+	}
+	err = q.QueryRow(`SELECT artist_id FROM artist_aliases WHERE normalized_alias = ? LIMIT 1`, normalizeName(name)).Scan(&artistID)
+	return artistID, err
+}
+
+// resolveFormatID checks a format ID exists, or finds a format by name when id
+// is zero. It returns sql.ErrNoRows if there is no such format.
+func resolveFormatID(q dbExecutor, id int, name string) (int, error) {
+	var formatID int
+	if id != 0 {
+		err := q.QueryRow(`SELECT id FROM formats WHERE id = ?`, id).Scan(&formatID)
+		return formatID, err
+	}
+	err := q.QueryRow(`SELECT id FROM formats WHERE name = ? ORDER BY id LIMIT 1`, name).Scan(&formatID)
+	return formatID, err
+}
+
+// dbExecutor is satisfied by both *sql.DB and *sql.Tx
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// loadTracks returns the track list of a media in order
+func loadTracks(q dbExecutor, mediaID int) ([]Track, error) {
+	rows, err := q.Query(`SELECT position, title, length FROM tracks WHERE media_id = ? ORDER BY id`, mediaID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tracks []Track
+	for rows.Next() {
+		var t Track
+		if err := rows.Scan(&t.Position, &t.Title, &t.Length); err != nil {
+			return nil, err
 		}
+		tracks = append(tracks, t)
 	}
+	return tracks, rows.Err()
 }
 
-// initDB initializes the database connection and creates the schema
-func initDB() error {
-	config, err := loadConfig()
+// replaceTracks replaces the track list of a media within tx
+func replaceTracks(tx *sql.Tx, mediaID int, tracks []Track) error {
+	_, err := tx.Exec(`DELETE FROM tracks WHERE media_id = ?`, mediaID)
 	if err != nil {
-		return fmt.Errorf("failed to load config: %v", err)
+		return err
 	}
+	for _, t := range tracks {
+		_, err = tx.Exec(`INSERT INTO tracks (media_id, position, title, length) VALUES (?, ?, ?, ?)`, mediaID, t.Position, t.Title, t.Length)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	err = connectToMySQL(config)
+// waitForDatabase pings the database until it answers, backing off between
+// attempts, and gives up once timeout has passed
+func waitForDatabase(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("database not reachable after %d attempts: %v", attempt, err)
+		}
+		log.Printf("Database not ready (attempt %d): %v; retrying in %s", attempt, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
+
+// maxStartupBackoff caps the wait between database connection attempts at startup
+const maxStartupBackoff = 10 * time.Second
+
+// initDB initializes the database connection and creates the schema.
+// It waits up to db_startup_timeout for MySQL to accept connections.
+func initDB(config *Config) error {
+	setMigrationStatus(migrationsPending)
+
+	err := connectToMySQL(config)
 	if err != nil {
 		return fmt.Errorf("failed to connect to MySQL: %v", err)
 	}
 
+	err = waitForDatabase(config.DBStartupTimeout.Duration)
+	if err != nil {
+		return err
+	}
+
 	err = createDatabase(config)
 	if err != nil {
 		return fmt.Errorf("failed to create database: %v", err)
 	}
 
+	// The server-level pool is only needed to create the database
+	db.Close()
 	err = connectToDatabase(config)
 	if err != nil {
 		return fmt.Errorf("failed to connect to database: %v", err)
 	}
 
-	createTables()
-	importFormatsByFile("formats.json")
-	importMediaByFile("media.json")
+	setMigrationStatus(migrationsRunning)
+	err = createTables()
+	if err != nil {
+		setMigrationStatus(migrationsFailed)
+		return fmt.Errorf("failed to create tables: %v", err)
+	}
+	setMigrationStatus(migrationsComplete)
 
 	return nil
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultDiscogsURL is used when no discogs_url is configured
+const defaultDiscogsURL = "https://api.discogs.com"
+
+// discogsArtistSuffix matches the "(2)" Discogs appends to disambiguate artist names
+var discogsArtistSuffix = regexp.MustCompile(`\s+\(\d+\)$`)
+
+// DiscogsProvider looks up releases through the Discogs API
+type DiscogsProvider struct {
+	client *providerClient
+}
+
+// NewDiscogsProvider creates a provider for the Discogs API at baseURL.
+// Authenticated Discogs clients may make 60 requests per minute.
+func NewDiscogsProvider(baseURL, token string) *DiscogsProvider {
+	if baseURL == "" {
+		baseURL = defaultDiscogsURL
+	}
+	client := newProviderClient(baseURL, time.Second)
+	if token != "" {
+		client.headers["Authorization"] = "Discogs token=" + token
+	}
+	return &DiscogsProvider{client: client}
+}
+
+// discogsRelease is the subset of a Discogs release we use
+type discogsRelease struct {
+	ID       int    `json:"id"`
+	Title    string `json:"title"`
+	Released string `json:"released"`
+	Artists  []struct {
+		Name string `json:"name"`
+	} `json:"artists"`
+	Labels []struct {
+		CatalogNumber string `json:"catno"`
+	} `json:"labels"`
+	Formats []struct {
+		Name         string   `json:"name"`
+		Descriptions []string `json:"descriptions"`
+	} `json:"formats"`
+	Identifiers []struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"identifiers"`
+	Genres    []string `json:"genres"`
+	Styles    []string `json:"styles"`
+	Tracklist []struct {
+		Position string `json:"position"`
+		Title    string `json:"title"`
+		Duration string `json:"duration"`
+		Type     string `json:"type_"`
+	} `json:"tracklist"`
+	Images []struct {
+		Type string `json:"type"`
+		URI  string `json:"uri"`
+	} `json:"images"`
+}
+
+// Name returns the provider name
+func (p *DiscogsProvider) Name() string {
+	return "discogs"
+}
+
+// LookupBarcode finds a release by its UPC/EAN barcode
+func (p *DiscogsProvider) LookupBarcode(barcode string) (*Media, error) {
+	return p.search(url.Values{"barcode": {barcode}})
+}
+
+// LookupCatalogNumber finds a release by its label catalog number
+func (p *DiscogsProvider) LookupCatalogNumber(catalogNumber string) (*Media, error) {
+	return p.search(url.Values{"catno": {catalogNumber}})
+}
+
+// LookupRelease finds a release by artist name and title
+func (p *DiscogsProvider) LookupRelease(artist, title string) (*Media, error) {
+	return p.search(url.Values{"artist": {artist}, "release_title": {title}})
+}
+
+// search runs a database search and fetches the full details of the best match
+func (p *DiscogsProvider) search(params url.Values) (*Media, error) {
+	params.Set("type", "release")
+	params.Set("per_page", "1")
+
+	var result struct {
+		Results []struct {
+			ID int `json:"id"`
+		} `json:"results"`
+	}
+	err := p.client.getJSON("/database/search?"+params.Encode(), &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Results) == 0 {
+		return nil, ErrReleaseNotFound
+	}
+
+	var release discogsRelease
+	err = p.client.getJSON(fmt.Sprintf("/releases/%d", result.Results[0].ID), &release)
+	if err != nil {
+		return nil, err
+	}
+	return release.toMedia(), nil
+}
+
+// toMedia converts a Discogs release into a Media draft
+func (r *discogsRelease) toMedia() *Media {
+	m := &Media{
+		Title: r.Title,
+		// Discogs uses "00" for unknown month and day
+		DatePublished: strings.TrimSuffix(strings.TrimSuffix(r.Released, "-00"), "-00"),
+	}
+
+	var artists []string
+	for _, artist := range r.Artists {
+		artists = append(artists, discogsArtistSuffix.ReplaceAllString(artist.Name, ""))
+	}
+	m.ArtistName = strings.Join(artists, ", ")
+
+	if len(r.Labels) > 0 {
+		m.CatalogNumber = r.Labels[0].CatalogNumber
+	}
+	for _, id := range r.Identifiers {
+		if id.Type == "Barcode" {
+			m.Barcode = normalizeBarcode(id.Value)
+			break
+		}
+	}
+	for _, image := range r.Images {
+		if image.Type == "primary" || m.ImageURL == "" {
+			m.ImageURL = image.URI
+		}
+	}
+	m.GenreTags = append(append(m.GenreTags, r.Genres...), r.Styles...)
+
+	for _, t := range r.Tracklist {
+		// Skip headings and index tracks, which aren't playable tracks
+		if t.Type != "" && t.Type != "track" {
+			continue
+		}
+		m.Tracks = append(m.Tracks, Track{Position: t.Position, Title: t.Title, Length: t.Duration})
+	}
+
+	var releaseType string
+	if len(r.Formats) > 0 {
+		m.Media = r.Formats[0].Name
+		for _, d := range r.Formats[0].Descriptions {
+			switch d {
+			case "LP", "EP", "Single":
+				releaseType = d
+			}
+		}
+	}
+	m.FormatName = formatForReleaseType(m.Media, releaseType)
+	return m
+}
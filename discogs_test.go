@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStubDiscogs returns a Discogs provider backed by handler, without the request throttle
+func newStubDiscogs(t *testing.T, token string, handler http.HandlerFunc) *DiscogsProvider {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	p := NewDiscogsProvider(server.URL, token)
+	p.client.limit.interval = 0
+	return p
+}
+
+func TestDiscogsLookupBarcode(t *testing.T) {
+	var searches []url.Values
+	p := newStubDiscogs(t, "secret", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Discogs token=secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if got := r.Header.Get("User-Agent"); got != providerUserAgent {
+			t.Errorf("User-Agent = %q", got)
+		}
+		switch r.URL.Path {
+		case "/database/search":
+			searches = append(searches, r.URL.Query())
+			w.Write([]byte(`{"results": [{"id": 249504}]}`))
+		case "/releases/249504":
+			w.Write([]byte(`{
+                "id": 249504,
+                "title": "Never Gonna Give You Up",
+                "released": "1987-00-00",
+                "artists": [{"name": "Rick Astley (2)"}, {"name": "Stock, Aitken & Waterman"}],
+                "labels": [{"catno": "PB 41447"}],
+                "formats": [{"name": "Vinyl", "descriptions": ["7\"", "45 RPM", "Single"]}],
+                "identifiers": [{"type": "Matrix / Runout", "value": "PB-41447-A"}, {"type": "Barcode", "value": "5 012394 144777"}],
+                "genres": ["Electronic", "Pop"],
+                "styles": ["Synth-pop"],
+                "tracklist": [
+                    {"position": "", "title": "Side A", "duration": "", "type_": "heading"},
+                    {"position": "A", "title": "Never Gonna Give You Up", "duration": "3:32", "type_": "track"},
+                    {"position": "B", "title": "Never Gonna Give You Up (Instrumental)", "duration": "3:30", "type_": "track"}
+                ],
+                "images": [
+                    {"type": "secondary", "uri": "https://img.example.com/back.jpg"},
+                    {"type": "primary", "uri": "https://img.example.com/front.jpg"}
+                ]
+            }`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	m, err := p.LookupBarcode("5012394144777")
+	if err != nil {
+		t.Fatalf("LookupBarcode() error = %v", err)
+	}
+	want := url.Values{"barcode": {"5012394144777"}, "type": {"release"}, "per_page": {"1"}}
+	if len(searches) != 1 || !reflect.DeepEqual(searches[0], want) {
+		t.Errorf("searches = %v, want [%v]", searches, want)
+	}
+	media := &Media{
+		Title:         "Never Gonna Give You Up",
+		ArtistName:    "Rick Astley, Stock, Aitken & Waterman",
+		DatePublished: "1987",
+		Barcode:       normalizeBarcode("5 012394 144777"),
+		CatalogNumber: "PB 41447",
+		ImageURL:      "https://img.example.com/front.jpg",
+		GenreTags:     []string{"Electronic", "Pop", "Synth-pop"},
+		Media:         "Vinyl",
+		FormatName:    "Single",
+		Tracks: []Track{
+			{Position: "A", Title: "Never Gonna Give You Up", Length: "3:32"},
+			{Position: "B", Title: "Never Gonna Give You Up (Instrumental)", Length: "3:30"},
+		},
+	}
+	if !reflect.DeepEqual(m, media) {
+		t.Errorf("LookupBarcode() = %+v, want %+v", m, media)
+	}
+}
+
+func TestDiscogsLookupSearchParams(t *testing.T) {
+	var search url.Values
+	p := newStubDiscogs(t, "", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "" {
+			t.Errorf("Authorization = %q, want none", got)
+		}
+		search = r.URL.Query()
+		w.Write([]byte(`{"results": []}`))
+	})
+
+	if _, err := p.LookupCatalogNumber("PB 41447"); err != ErrReleaseNotFound {
+		t.Errorf("LookupCatalogNumber() error = %v, want ErrReleaseNotFound", err)
+	}
+	if got := search.Get("catno"); got != "PB 41447" {
+		t.Errorf("catno = %q", got)
+	}
+	if _, err := p.LookupRelease("Rick Astley", "Whenever You Need Somebody"); err != ErrReleaseNotFound {
+		t.Errorf("LookupRelease() error = %v, want ErrReleaseNotFound", err)
+	}
+	if search.Get("artist") != "Rick Astley" || search.Get("release_title") != "Whenever You Need Somebody" {
+		t.Errorf("search = %v", search)
+	}
+}
+
+func TestDiscogsReleaseFormats(t *testing.T) {
+	tests := []struct {
+		released string
+		format   string
+		desc     []string
+		wantDate string
+		want     string
+	}{
+		{"1987-10-00", "Vinyl", []string{"12\"", "LP", "Album"}, "1987-10", "LP"},
+		{"1987-10-12", "Vinyl", []string{"12\"", "EP"}, "1987-10-12", "EP"},
+		{"", "CD", []string{"Album"}, "", "CD"},
+	}
+	for _, tt := range tests {
+		var r discogsRelease
+		r.Released = tt.released
+		r.Formats = append(r.Formats, struct {
+			Name         string   `json:"name"`
+			Descriptions []string `json:"descriptions"`
+		}{tt.format, tt.desc})
+		m := r.toMedia()
+		if m.DatePublished != tt.wantDate || m.FormatName != tt.want {
+			t.Errorf("toMedia(%q, %q, %q) = %q, %q; want %q, %q",
+				tt.released, tt.format, strings.Join(tt.desc, ","), m.DatePublished, m.FormatName, tt.wantDate, tt.want)
+		}
+	}
+}
+
+func TestDiscogsLookupErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		search      int
+		release     int
+		notFound    bool
+		wantMessage string
+	}{
+		{"release missing", http.StatusOK, http.StatusNotFound, true, ""},
+		{"rate limited", http.StatusTooManyRequests, http.StatusOK, false, "429 Too Many Requests"},
+		{"unauthorized", http.StatusUnauthorized, http.StatusOK, false, "401 Unauthorized"},
+		{"server error", http.StatusOK, http.StatusBadGateway, false, "502 Bad Gateway"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newStubDiscogs(t, "", func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/database/search" {
+					w.WriteHeader(tt.search)
+					w.Write([]byte(`{"results": [{"id": 1}]}`))
+					return
+				}
+				w.WriteHeader(tt.release)
+			})
+			_, err := p.LookupBarcode("5012394144777")
+			if err == nil {
+				t.Fatal("LookupBarcode() error = nil")
+			}
+			if (err == ErrReleaseNotFound) != tt.notFound {
+				t.Errorf("LookupBarcode() error = %v", err)
+			}
+			if tt.wantMessage != "" && !strings.Contains(err.Error(), tt.wantMessage) {
+				t.Errorf("LookupBarcode() error = %v, want %q", err, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestDiscogsLookupMalformedResponse(t *testing.T) {
+	p := newStubDiscogs(t, "", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html>Service temporarily unavailable</html>`))
+	})
+	if _, err := p.LookupBarcode("5012394144777"); err == nil || err == ErrReleaseNotFound {
+		t.Errorf("LookupBarcode() error = %v, want a decode error", err)
+	}
+}
+
+func TestDiscogsThrottlesRequests(t *testing.T) {
+	var times []time.Time
+	p := newStubDiscogs(t, "", func(w http.ResponseWriter, r *http.Request) {
+		times = append(times, time.Now())
+		w.Write([]byte(`{"results": []}`))
+	})
+	p.client.limit.interval = 50 * time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		p.LookupBarcode("5012394144777")
+	}
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < 45*time.Millisecond {
+			t.Errorf("request %d sent %v after the previous one", i, gap)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// defaultDuplicateThreshold is the minimum similarity reported when no threshold is given
+const defaultDuplicateThreshold = 0.85
+
+// diacriticFolds maps accented Latin letters to their unaccented form
+var diacriticFolds = map[rune]string{}
+
+func init() {
+	for base, accented := range map[string]string{
+		"a": "àáâãäåāăą", "c": "çćĉċč", "d": "ďđ", "e": "èéêëēĕėęě",
+		"g": "ĝğġģ", "h": "ĥħ", "i": "ìíîïĩīĭįı", "j": "ĵ", "k": "ķ",
+		"l": "ĺļľŀł", "n": "ñńņňŉ", "o": "òóôõöøōŏő", "r": "ŕŗř",
+		"s": "śŝşš", "t": "ţťŧ", "u": "ùúûüũūŭůűų", "w": "ŵ", "y": "ýÿŷ",
+		"z": "źżž", "ae": "æ", "oe": "œ", "ss": "ß", "th": "þ",
+	} {
+		for _, r := range accented {
+			diacriticFolds[r] = base
+		}
+	}
+}
+
+// normalizeName reduces a name to a form suitable for duplicate matching: it is
+// lowercased, stripped of diacritics and punctuation, and loses a leading "the"
+func normalizeName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if folded, ok := diacriticFolds[r]; ok {
+			b.WriteString(folded)
+		} else if r == '&' {
+			b.WriteString(" and ")
+		} else if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		} else if unicode.IsSpace(r) || r == '-' || r == '/' {
+			b.WriteRune(' ')
+		}
+	}
+	words := strings.Fields(b.String())
+	if len(words) > 1 && words[0] == "the" {
+		words = words[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// similarity scores two names between 0 and 1 by the edit distance of their normalized forms
+func similarity(a, b string) float64 {
+	return normalizedSimilarity([]rune(normalizeName(a)), []rune(normalizeName(b)))
+}
+
+// normalizedSimilarity scores two names that are already normalized
+func normalizedSimilarity(x, y []rune) float64 {
+	longest := len(x)
+	if len(y) > longest {
+		longest = len(y)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(x, y))/float64(longest)
+}
+
+// levenshtein returns the number of single-rune edits needed to turn a into b
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// min3 returns the smallest of three ints
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// DuplicateCandidate struct holds a pair of records that look like the same thing
+type DuplicateCandidate struct {
+	ID        int     `json:"id"`
+	Name      string  `json:"name"`
+	OtherID   int     `json:"other_id"`
+	OtherName string  `json:"other_name"`
+	Score     float64 `json:"score"`
+}
+
+// MergeRequest struct holds the record to keep, the duplicates to fold into
+// it and the version of each as last seen, keyed by ID
+type MergeRequest struct {
+	SurvivorID   int         `json:"survivor_id"`
+	DuplicateIDs []int       `json:"duplicate_ids"`
+	Versions     map[int]int `json:"versions"`
+}
+
+// namedRecord is an id and display name loaded for duplicate comparison
+type namedRecord struct {
+	ID   int
+	Name string
+	// Group restricts comparison to records with the same group, e.g. media by the same artist
+	Group string
+}
+
+// findDuplicates returns the pairs of records within a group whose names
+// score at least threshold. Each name is normalized once, and records are only
+// compared with those of the same group and a similar length: names that
+// differ in length by more than the edits a threshold allows can't reach it.
+func findDuplicates(records []namedRecord, threshold float64) []DuplicateCandidate {
+	type normalized struct {
+		index int
+		name  []rune
+	}
+	groups := map[string][]normalized{}
+	for i, rec := range records {
+		groups[rec.Group] = append(groups[rec.Group], normalized{i, []rune(normalizeName(rec.Name))})
+	}
+
+	type match struct {
+		i, j  int
+		score float64
+	}
+	var matches []match
+	for _, group := range groups {
+		sort.SliceStable(group, func(a, b int) bool { return len(group[a].name) < len(group[b].name) })
+		for a := range group {
+			for b := a + 1; b < len(group); b++ {
+				// Names are sorted by length, so the rest are all too long. The
+				// margin keeps rounding from skipping a pair right at the threshold.
+				if float64(len(group[a].name)) < threshold*float64(len(group[b].name))-1e-9 {
+					break
+				}
+				if score := normalizedSimilarity(group[a].name, group[b].name); score >= threshold {
+					i, j := group[a].index, group[b].index
+					if i > j {
+						i, j = j, i
+					}
+					matches = append(matches, match{i, j, score})
+				}
+			}
+		}
+	}
+
+	// Highest scores first, then in the order of the records
+	sort.Slice(matches, func(a, b int) bool {
+		if matches[a].score != matches[b].score {
+			return matches[a].score > matches[b].score
+		}
+		if matches[a].i != matches[b].i {
+			return matches[a].i < matches[b].i
+		}
+		return matches[a].j < matches[b].j
+	})
+	duplicates := make([]DuplicateCandidate, len(matches))
+	for k, m := range matches {
+		duplicates[k] = DuplicateCandidate{
+			ID: records[m.i].ID, Name: records[m.i].Name,
+			OtherID: records[m.j].ID, OtherName: records[m.j].Name,
+			Score: m.score,
+		}
+	}
+	return duplicates
+}
+
+// loadNamedRecords runs query, which must select an id, a name and a group
+func loadNamedRecords(query string) ([]namedRecord, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []namedRecord
+	for rows.Next() {
+		var rec namedRecord
+		if err := rows.Scan(&rec.ID, &rec.Name, &rec.Group); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// duplicateThreshold reads the threshold query parameter
+func duplicateThreshold(r *http.Request) (float64, error) {
+	param := r.URL.Query().Get("threshold")
+	if param == "" {
+		return defaultDuplicateThreshold, nil
+	}
+	return strconv.ParseFloat(param, 64)
+}
+
+// getArtistDuplicates handles listing pairs of artists that are probably the same artist
+func getArtistDuplicates(w http.ResponseWriter, r *http.Request) {
+	threshold, err := duplicateThreshold(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid threshold")
+		return
+	}
+
+	records, err := loadNamedRecords(`SELECT id, name, '' FROM artists`)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve artists", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(findDuplicates(records, threshold))
+}
+
+// getMediaDuplicates handles listing pairs of media by the same artist in the same format whose titles match
+func getMediaDuplicates(w http.ResponseWriter, r *http.Request) {
+	threshold, err := duplicateThreshold(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid threshold")
+		return
+	}
+
+	records, err := loadNamedRecords(`SELECT id, title, CONCAT(artist_id, '/', format_id) FROM media WHERE deleted_at IS NULL`)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve media", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(findDuplicates(records, threshold))
+}
+
+// decodeMergeRequest reads and checks a merge request body
+func decodeMergeRequest(w http.ResponseWriter, r *http.Request) (MergeRequest, bool) {
+	var req MergeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return req, false
+	}
+	if req.SurvivorID == 0 || len(req.DuplicateIDs) == 0 {
+		writeError(w, r, http.StatusBadRequest, "survivor_id and duplicate_ids are required")
+		return req, false
+	}
+	for _, id := range req.DuplicateIDs {
+		if id == req.SurvivorID {
+			writeError(w, r, http.StatusBadRequest, "survivor_id cannot also be a duplicate")
+			return req, false
+		}
+	}
+	// A merge deletes the duplicates, so it must not be based on stale copies
+	for _, id := range req.ids() {
+		if _, ok := req.Versions[id]; !ok {
+			writeError(w, r, http.StatusPreconditionRequired, "versions must give the current version of the survivor and every duplicate")
+			return req, false
+		}
+	}
+	return req, true
+}
+
+// ids returns the survivor ID followed by the duplicate IDs
+func (req MergeRequest) ids() []int {
+	return append([]int{req.SurvivorID}, req.DuplicateIDs...)
+}
+
+// checkMergeVersions locks each record of a merge with query, which selects
+// the version of one record by ID, and checks it is still at the version the
+// client gave. It sends 404 or 412 and returns false otherwise.
+func checkMergeVersions(w http.ResponseWriter, r *http.Request, tx *sql.Tx, query, notFound string, req MergeRequest) bool {
+	for _, id := range req.ids() {
+		var version int
+		err := tx.QueryRow(query, id).Scan(&version)
+		if err == sql.ErrNoRows {
+			writeError(w, r, http.StatusNotFound, notFound+": "+strconv.Itoa(id))
+			return false
+		} else if err != nil {
+			writeInternalError(w, r, "Failed to merge", err)
+			return false
+		}
+		if version != req.Versions[id] {
+			writeError(w, r, http.StatusPreconditionFailed, modifiedMessage)
+			return false
+		}
+	}
+	return true
+}
+
+// mergeArtists handles folding duplicate artists into a surviving artist,
+// provided none has changed since the versions in the request
+func mergeArtists(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeMergeRequest(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to merge artists", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkMergeVersions(w, r, tx, `SELECT version FROM artists WHERE id = ? FOR UPDATE`, "Artist not found", req) {
+		return
+	}
+
+	for _, id := range req.DuplicateIDs {
+		if err = mergeArtistTx(tx, requestActor(r), req.SurvivorID, id); err != nil {
+			writeInternalError(w, r, "Failed to merge artists", err)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		writeInternalError(w, r, "Failed to merge artists", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mergeArtistTx moves everything that references duplicateID onto survivorID, keeps
+// the duplicate's name and aliases as aliases of the survivor, and deletes the duplicate.
+// Every affected artist and media is recorded in the audit log.
+func mergeArtistTx(tx *sql.Tx, actor auditActor, survivorID, duplicateID int) error {
+	duplicate, err := loadArtist(tx, duplicateID)
+	if err != nil {
+		return err
+	}
+	survivor, err := loadArtist(tx, survivorID)
+	if err != nil {
+		return err
+	}
+
+	// Media that the survivor already has under the same title and format would
+	// break unique_media, so those are merged into the survivor's copy instead
+	rows, err := tx.Query(`
+        SELECT d.id, s.id
+        FROM media d
+        JOIN media s ON s.artist_id = ? AND s.format_id = d.format_id AND s.title = d.title
+        WHERE d.artist_id = ?
+    `, survivorID, duplicateID)
+	if err != nil {
+		return err
+	}
+	collisions := map[int]int{}
+	for rows.Next() {
+		var dupMediaID, survivorMediaID int
+		if err := rows.Scan(&dupMediaID, &survivorMediaID); err != nil {
+			rows.Close()
+			return err
+		}
+		collisions[dupMediaID] = survivorMediaID
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for dupMediaID, survivorMediaID := range collisions {
+		if err := mergeMediaTx(tx, actor, survivorMediaID, dupMediaID); err != nil {
+			return err
+		}
+	}
+
+	movedMedia, err := loadArtistMedia(tx, duplicateID)
+	if err != nil {
+		return err
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`UPDATE media SET artist_id = ?, version = version + 1 WHERE artist_id = ?`, []interface{}{survivorID, duplicateID}},
+		{`UPDATE media_aliases SET artist_id = ? WHERE artist_id = ?`, []interface{}{survivorID, duplicateID}},
+		{`UPDATE artist_aliases SET artist_id = ? WHERE artist_id = ?`, []interface{}{survivorID, duplicateID}},
+		{`INSERT INTO artist_aliases (artist_id, alias, normalized_alias) VALUES (?, ?, ?)`, []interface{}{survivorID, duplicate.Name, normalizeName(duplicate.Name)}},
+		{`DELETE FROM artists WHERE id = ?`, []interface{}{duplicateID}},
+		{`UPDATE artists SET version = version + 1 WHERE id = ?`, []interface{}{survivorID}},
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+
+	for _, before := range movedMedia {
+		after, err := loadMedia(tx, before.ID)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(tx, actor, auditMedia, before.ID, auditUpdate, before, after); err != nil {
+			return err
+		}
+	}
+	if err := recordAudit(tx, actor, auditArtist, duplicateID, auditDelete, duplicate, nil); err != nil {
+		return err
+	}
+	after, err := loadArtist(tx, survivorID)
+	if err != nil {
+		return err
+	}
+	return recordAudit(tx, actor, auditArtist, survivorID, auditUpdate, survivor, after)
+}
+
+// loadArtistMedia returns the media of an artist with their tracks
+func loadArtistMedia(q dbExecutor, artistID int) ([]Media, error) {
+	rows, err := q.Query(`SELECT id FROM media WHERE artist_id = ? ORDER BY id`, artistID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	media := make([]Media, 0, len(ids))
+	for _, id := range ids {
+		m, err := loadMedia(q, id)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, m)
+	}
+	return media, nil
+}
+
+// mergeMedia handles folding duplicate media into a surviving media,
+// provided none has changed since the versions in the request
+func mergeMedia(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeMergeRequest(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to merge media", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkMergeVersions(w, r, tx, `SELECT version FROM media WHERE id = ? AND deleted_at IS NULL FOR UPDATE`, "Media not found", req) {
+		return
+	}
+
+	for _, id := range req.DuplicateIDs {
+		if err = mergeMediaTx(tx, requestActor(r), req.SurvivorID, id); err != nil {
+			writeInternalError(w, r, "Failed to merge media", err)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		writeInternalError(w, r, "Failed to merge media", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mergeMediaTx moves collection entries and tracks from duplicateID onto survivorID,
+// keeps the duplicate's title as an alias so imports skip it, and deletes the duplicate.
+// Both media and every affected collection are recorded in the audit log.
+func mergeMediaTx(tx *sql.Tx, actor auditActor, survivorID, duplicateID int) error {
+	duplicate, err := loadMedia(tx, duplicateID)
+	if err != nil {
+		return err
+	}
+	survivor, err := loadMedia(tx, survivorID)
+	if err != nil {
+		return err
+	}
+	owners, err := collectionOwners(tx, duplicateID)
+	if err != nil {
+		return err
+	}
+	collections := make([]collectionSnapshot, len(owners))
+	for i, userID := range owners {
+		if collections[i], err = loadCollection(tx, userID); err != nil {
+			return err
+		}
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		// Owners of both copies keep a single entry
+		{`INSERT IGNORE INTO user_media (user_id, media_id, format_id) SELECT user_id, ?, format_id FROM user_media WHERE media_id = ?`, []interface{}{survivorID, duplicateID}},
+		{`DELETE FROM user_media WHERE media_id = ?`, []interface{}{duplicateID}},
+		// The survivor's track list wins if it has one
+		{`UPDATE tracks SET media_id = ? WHERE media_id = ? AND NOT EXISTS (SELECT 1 FROM (SELECT media_id FROM tracks WHERE media_id = ?) s)`, []interface{}{survivorID, duplicateID, survivorID}},
+		{`UPDATE media_aliases SET media_id = ? WHERE media_id = ?`, []interface{}{survivorID, duplicateID}},
+		{`INSERT INTO media_aliases (media_id, artist_id, normalized_title) VALUES (?, ?, ?)`, []interface{}{survivorID, duplicate.ArtistID, normalizeName(duplicate.Title)}},
+		{`DELETE FROM media WHERE id = ?`, []interface{}{duplicateID}},
+		{`UPDATE media SET version = version + 1 WHERE id = ?`, []interface{}{survivorID}},
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+
+	if err := recordAudit(tx, actor, auditMedia, duplicateID, auditDelete, duplicate, nil); err != nil {
+		return err
+	}
+	after, err := loadMedia(tx, survivorID)
+	if err != nil {
+		return err
+	}
+	if err := recordAudit(tx, actor, auditMedia, survivorID, auditUpdate, survivor, after); err != nil {
+		return err
+	}
+	for _, before := range collections {
+		after, err := loadCollection(tx, before.UserID)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(tx, actor, auditCollection, before.UserID, auditUpdate, before, after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
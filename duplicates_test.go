@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"The Beatles", "beatles"},
+		{"Sigur Rós", "sigur ros"},
+		{"Simon & Garfunkel", "simon and garfunkel"},
+		{"AC/DC", "ac dc"},
+		{"  Guns N' Roses ", "guns n roses"},
+		{"The", "the"},
+	}
+	for _, tt := range tests {
+		if got := normalizeName(tt.name); got != tt.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	records := []namedRecord{
+		{1, "The Beatles", ""},
+		{2, "Beatles", ""},
+		{3, "Beetles", ""},
+		{4, "Miles Davis", ""},
+		{5, "Miles Davis Quintet", ""},
+		{6, "Kind of Blue", "4"},
+		{7, "Kind Of Blue", "5"},
+	}
+	want := []DuplicateCandidate{
+		{1, "The Beatles", 2, "Beatles", 1},
+		{1, "The Beatles", 3, "Beetles", similarity("Beatles", "Beetles")},
+		{2, "Beatles", 3, "Beetles", similarity("Beatles", "Beetles")},
+	}
+	if got := findDuplicates(records, 0.85); !reflect.DeepEqual(got, want) {
+		t.Errorf("findDuplicates = %+v\nwant %+v", got, want)
+	}
+}
+
+// findDuplicatesPairwise is the plain comparison of every pair that
+// findDuplicates must agree with
+func findDuplicatesPairwise(records []namedRecord, threshold float64) map[[2]int]float64 {
+	found := map[[2]int]float64{}
+	for i := range records {
+		for j := i + 1; j < len(records); j++ {
+			if records[i].Group != records[j].Group {
+				continue
+			}
+			if score := similarity(records[i].Name, records[j].Name); score >= threshold {
+				found[[2]int{records[i].ID, records[j].ID}] = score
+			}
+		}
+	}
+	return found
+}
+
+func TestFindDuplicatesMatchesPairwise(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	words := []string{"the", "blue", "blues", "train", "kind", "of", "love", "supreme", "a", "soul", "sole", "ii", "2"}
+	var records []namedRecord
+	for id := 1; id <= 400; id++ {
+		name := ""
+		for n := random.Intn(4); n >= 0; n-- {
+			name += words[random.Intn(len(words))] + " "
+		}
+		records = append(records, namedRecord{id, name, fmt.Sprint(random.Intn(3))})
+	}
+
+	for _, threshold := range []float64{0, 0.5, 0.8, 0.85, 0.9, 1} {
+		want := findDuplicatesPairwise(records, threshold)
+		got := findDuplicates(records, threshold)
+		if len(got) != len(want) {
+			t.Errorf("threshold %v: %d pairs, want %d", threshold, len(got), len(want))
+		}
+		for k, d := range got {
+			if score, ok := want[[2]int{d.ID, d.OtherID}]; !ok || score != d.Score {
+				t.Errorf("threshold %v: unexpected pair %+v", threshold, d)
+			}
+			if k > 0 && got[k-1].Score < d.Score {
+				t.Errorf("threshold %v: pairs not sorted by score at %d", threshold, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// EnrichmentChanges holds the values a provider proposes for a media's missing fields
+type EnrichmentChanges struct {
+	DatePublished string   `json:"date_published,omitempty"`
+	ImageURL      string   `json:"image_url,omitempty"`
+	GenreTags     []string `json:"genre_tags,omitempty"`
+	Tracks        []Track  `json:"tracks,omitempty"`
+}
+
+// EnrichmentReview struct holds a proposed change waiting for review
+type EnrichmentReview struct {
+	ID         int               `json:"id"`
+	MediaID    int               `json:"media_id"`
+	Title      string            `json:"title"`
+	Provider   string            `json:"provider"`
+	Changes    EnrichmentChanges `json:"changes"`
+	Status     string            `json:"status"`
+	CreatedAt  time.Time         `json:"created_at"`
+	ReviewedAt *time.Time        `json:"reviewed_at,omitempty"`
+}
+
+// enrichmentCandidate is a media with at least one field a provider could fill in
+type enrichmentCandidate struct {
+	MediaID       int
+	Title         string
+	ArtistName    string
+	DatePublished string
+	ImageURL      string
+	GenreTags     string
+	Barcode       string
+	CatalogNumber string
+	TrackCount    int
+	Version       int
+}
+
+// findEnrichmentCandidates returns media with missing metadata and no pending review
+func findEnrichmentCandidates() ([]enrichmentCandidate, error) {
+	rows, err := db.Query(`
+        SELECT
+            m.id, m.title, a.name, ` + releaseDateColumn + `,
+            IFNULL(m.image_url, ''), IFNULL(m.genre_tags, ''), m.barcode, m.catalog_number,
+            (SELECT COUNT(*) FROM tracks t WHERE t.media_id = m.id) AS track_count, m.version
+        FROM media m
+        JOIN artists a ON m.artist_id = a.id
+        WHERE m.deleted_at IS NULL
+            AND m.id NOT IN (SELECT media_id FROM enrichment_reviews WHERE status = 'pending')
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []enrichmentCandidate
+	for rows.Next() {
+		var c enrichmentCandidate
+		err := rows.Scan(&c.MediaID, &c.Title, &c.ArtistName, &c.DatePublished, &c.ImageURL,
+			&c.GenreTags, &c.Barcode, &c.CatalogNumber, &c.TrackCount, &c.Version)
+		if err != nil {
+			return nil, err
+		}
+		if len(c.DatePublished) < len("2006-01-02") || c.ImageURL == "" || c.GenreTags == "" || c.TrackCount == 0 {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates, rows.Err()
+}
+
+// proposeChanges compares a candidate with the provider's release and keeps only the values we are missing
+func proposeChanges(c enrichmentCandidate, release *Media) EnrichmentChanges {
+	var changes EnrichmentChanges
+	// Take the release date if ours is missing, or if it is more precise than ours and agrees with it
+	if validDate(release.DatePublished) && len(release.DatePublished) > len(c.DatePublished) &&
+		strings.HasPrefix(release.DatePublished, c.DatePublished) {
+		changes.DatePublished = release.DatePublished
+	}
+	if c.ImageURL == "" {
+		changes.ImageURL = release.ImageURL
+	}
+	if c.GenreTags == "" {
+		changes.GenreTags = release.GenreTags
+	}
+	if c.TrackCount == 0 {
+		changes.Tracks = release.Tracks
+	}
+	return changes
+}
+
+// isEmpty reports whether there is nothing to review
+func (c EnrichmentChanges) isEmpty() bool {
+	return c.DatePublished == "" && c.ImageURL == "" && len(c.GenreTags) == 0 && len(c.Tracks) == 0
+}
+
+// lookupEnrichment asks the provider for a candidate's release, by barcode,
+// catalog number or else artist and title, and returns the changes it
+// proposes. It returns ErrReleaseNotFound if the provider has no match.
+func lookupEnrichment(provider MetadataProvider, c enrichmentCandidate) (EnrichmentChanges, error) {
+	var release *Media
+	var err error
+	switch {
+	case c.Barcode != "":
+		release, err = provider.LookupBarcode(c.Barcode)
+	case c.CatalogNumber != "":
+		release, err = provider.LookupCatalogNumber(c.CatalogNumber)
+	default:
+		release, err = provider.LookupRelease(c.ArtistName, c.Title)
+	}
+	if err != nil {
+		return EnrichmentChanges{}, err
+	}
+	return proposeChanges(c, release), nil
+}
+
+// enrichCatalog looks up every media with missing metadata and queues the
+// proposed changes for review, reporting the candidates looked up to progress.
+// It returns the number of reviews queued. Requests are rate limited by the
+// provider.
+func enrichCatalog(ctx context.Context, provider MetadataProvider, progress func(done, total int)) (int, error) {
+	candidates, err := findEnrichmentCandidates()
+	if err != nil {
+		return 0, err
+	}
+
+	queued := 0
+	for i, c := range candidates {
+		if err := ctx.Err(); err != nil {
+			return queued, err
+		}
+		progress(i, len(candidates))
+		changes, err := lookupEnrichment(provider, c)
+		if err == ErrReleaseNotFound {
+			enrichmentLookupsTotal.inc(provider.Name(), "not_found")
+			continue
+		} else if err != nil {
+			enrichmentLookupsTotal.inc(provider.Name(), "error")
+			log.Printf("Enrichment lookup failed for media %d: %v", c.MediaID, err)
+			continue
+		}
+		enrichmentLookupsTotal.inc(provider.Name(), "found")
+
+		if changes.isEmpty() {
+			continue
+		}
+		changesJSON, err := json.Marshal(changes)
+		if err != nil {
+			return queued, err
+		}
+		_, err = db.Exec(`INSERT INTO enrichment_reviews (media_id, media_version, provider, changes) VALUES (?, ?, ?, ?)`,
+			c.MediaID, c.Version, provider.Name(), string(changesJSON))
+		if err != nil {
+			return queued, err
+		}
+		enrichmentReviewsQueuedTotal.inc(provider.Name())
+		queued++
+	}
+	progress(len(candidates), len(candidates))
+	return queued, nil
+}
+
+// runEnrichment handles queueing an enrichment job, which can be followed at
+// the returned Location
+func runEnrichment(w http.ResponseWriter, r *http.Request) {
+	if metadataProvider == nil {
+		writeError(w, r, http.StatusServiceUnavailable, "No metadata provider configured")
+		return
+	}
+
+	job, err := enqueueJob("enrichment", nil, requestActor(r))
+	if err == errJobActive {
+		writeError(w, r, http.StatusConflict, "Enrichment is already running")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to queue enrichment", err)
+		return
+	}
+	writeJobAccepted(w, r, job)
+}
+
+// getEnrichmentReviews handles listing enrichment reviews, pending ones by default
+func getEnrichmentReviews(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	}
+
+	rows, err := db.Query(`
+        SELECT er.id, er.media_id, m.title, er.provider, er.changes, er.status, er.created_at, er.reviewed_at
+        FROM enrichment_reviews er
+        JOIN media m ON er.media_id = m.id
+        WHERE er.status = ?
+        ORDER BY er.id
+    `, status)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve reviews", err)
+		return
+	}
+	defer rows.Close()
+
+	reviews := []EnrichmentReview{}
+	for rows.Next() {
+		review, err := scanEnrichmentReview(rows)
+		if err != nil {
+			writeInternalError(w, r, "Failed to scan review", err)
+			return
+		}
+		reviews = append(reviews, review)
+	}
+	if err := rows.Err(); err != nil {
+		writeInternalError(w, r, "Error iterating over reviews", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// scanEnrichmentReview reads a single enrichment review row
+func scanEnrichmentReview(row rowScanner) (EnrichmentReview, error) {
+	var review EnrichmentReview
+	var changes string
+	var createdAt, reviewedAt sql.NullString
+	err := row.Scan(&review.ID, &review.MediaID, &review.Title, &review.Provider, &changes,
+		&review.Status, &createdAt, &reviewedAt)
+	if err != nil {
+		return review, err
+	}
+	review.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt.String)
+	if reviewedAt.Valid {
+		t, _ := time.Parse("2006-01-02 15:04:05", reviewedAt.String)
+		review.ReviewedAt = &t
+	}
+	return review, json.Unmarshal([]byte(changes), &review.Changes)
+}
+
+// errReviewStale is returned when approving a review whose media has changed
+// since the provider's data was looked up
+var errReviewStale = &requestError{http.StatusConflict, "Media has changed since the review was proposed; reject it and run enrichment again"}
+
+// approveEnrichmentReview handles applying a pending review's changes to its
+// media. The review is only applied if the media is still at the version it
+// was proposed for and isn't in the trash, and the result is valid.
+func approveEnrichmentReview(w http.ResponseWriter, r *http.Request) {
+	review, ok := pendingReview(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to apply review", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Claim the review first, so a concurrent approval or rejection waits for
+	// this one and then finds it no longer pending
+	if !claimReview(w, r, tx, review.ID, "approved") {
+		return
+	}
+
+	var mediaVersion sql.NullInt64
+	var version int
+	var trashed bool
+	err = tx.QueryRow(`SELECT media_version FROM enrichment_reviews WHERE id = ?`, review.ID).Scan(&mediaVersion)
+	if err == nil {
+		err = tx.QueryRow(`SELECT version, deleted_at IS NOT NULL FROM media WHERE id = ? FOR UPDATE`, review.MediaID).Scan(&version, &trashed)
+	}
+	if err == nil && trashed {
+		err = &requestError{http.StatusConflict, "Media is in the trash"}
+	} else if err == nil && (!mediaVersion.Valid || int(mediaVersion.Int64) != version) {
+		err = errReviewStale
+	}
+	if err != nil {
+		writeRequestError(w, r, "Failed to apply review", err)
+		return
+	}
+
+	before, err := loadMedia(tx, review.MediaID)
+	if err != nil {
+		writeInternalError(w, r, "Failed to apply review", err)
+		return
+	}
+
+	changes := review.Changes
+	for i := 0; err == nil && i < len(changes.GenreTags); i++ {
+		changes.GenreTags[i], err = NormalizeGenre(tx, changes.GenreTags[i])
+	}
+	if err != nil {
+		writeInternalError(w, r, "Failed to apply review", err)
+		return
+	}
+
+	// Check the provider's data as if it had been entered by hand
+	proposed := before
+	if changes.DatePublished != "" {
+		proposed.DatePublished = changes.DatePublished
+	}
+	if changes.ImageURL != "" {
+		proposed.ImageURL = changes.ImageURL
+	}
+	if len(changes.GenreTags) > 0 {
+		proposed.GenreTags = changes.GenreTags
+	}
+	if len(changes.Tracks) > 0 {
+		proposed.Tracks = changes.Tracks
+	}
+	if err := proposed.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	if changes.DatePublished != "" {
+		datePublished, datePrecision := releaseDateColumns(proposed.DatePublished)
+		_, err = tx.Exec(`UPDATE media SET date_published = ?, date_precision = ? WHERE id = ?`, datePublished, datePrecision, review.MediaID)
+	}
+	if err == nil && changes.ImageURL != "" {
+		_, err = tx.Exec(`UPDATE media SET image_url = ? WHERE id = ?`, proposed.ImageURL, review.MediaID)
+	}
+	if err == nil && len(changes.GenreTags) > 0 {
+		_, err = tx.Exec(`UPDATE media SET genre_tags = ? WHERE id = ?`, strings.Join(proposed.GenreTags, ","), review.MediaID)
+	}
+	if err == nil && len(changes.Tracks) > 0 {
+		err = replaceTracks(tx, review.MediaID, proposed.Tracks)
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE media SET version = version + 1 WHERE id = ?`, review.MediaID)
+	}
+	if err == nil {
+		var after Media
+		after, err = loadMedia(tx, review.MediaID)
+		if err == nil {
+			err = recordAudit(tx, requestActor(r), auditMedia, review.MediaID, auditUpdate, before, after)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeInternalError(w, r, "Failed to apply review", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rejectEnrichmentReview handles discarding a pending review
+func rejectEnrichmentReview(w http.ResponseWriter, r *http.Request) {
+	review, ok := pendingReview(w, r)
+	if !ok {
+		return
+	}
+
+	if claimReview(w, r, db, review.ID, "rejected") {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// claimReview moves a review from pending to status, writing an error
+// response if it has been approved or rejected since it was loaded
+func claimReview(w http.ResponseWriter, r *http.Request, q dbExecutor, id int, status string) bool {
+	result, err := q.Exec(`UPDATE enrichment_reviews SET status = ?, reviewed_at = NOW() WHERE id = ? AND status = 'pending'`, status, id)
+	var n int64
+	if err == nil {
+		n, err = result.RowsAffected()
+	}
+	if err != nil {
+		writeInternalError(w, r, "Failed to update review", err)
+		return false
+	}
+	if n == 0 {
+		var current string
+		if err := q.QueryRow(`SELECT status FROM enrichment_reviews WHERE id = ?`, id).Scan(&current); err != nil {
+			writeInternalError(w, r, "Failed to retrieve review", err)
+			return false
+		}
+		writeError(w, r, http.StatusConflict, "Review has already been "+current)
+		return false
+	}
+	return true
+}
+
+// pendingReview loads the pending review named in the URL, writing an error response if there is none
+func pendingReview(w http.ResponseWriter, r *http.Request) (EnrichmentReview, bool) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid review ID")
+		return EnrichmentReview{}, false
+	}
+
+	review, err := scanEnrichmentReview(db.QueryRow(`
+        SELECT er.id, er.media_id, m.title, er.provider, er.changes, er.status, er.created_at, er.reviewed_at
+        FROM enrichment_reviews er
+        JOIN media m ON er.media_id = m.id
+        WHERE er.id = ?
+    `, id))
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Review not found")
+		return review, false
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to retrieve review", err)
+		return review, false
+	}
+	if review.Status != "pending" {
+		writeError(w, r, http.StatusConflict, "Review has already been "+review.Status)
+		return review, false
+	}
+	return review, true
+}
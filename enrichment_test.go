@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// fakeProvider is a MetadataProvider that answers from a map of releases
+// keyed by barcode, catalog number or "artist - title"
+type fakeProvider struct {
+	releases map[string]*Media
+	err      error
+	lookups  []string
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) lookup(key string) (*Media, error) {
+	p.lookups = append(p.lookups, key)
+	if p.err != nil {
+		return nil, p.err
+	}
+	release, ok := p.releases[key]
+	if !ok {
+		return nil, ErrReleaseNotFound
+	}
+	return release, nil
+}
+
+func (p *fakeProvider) LookupBarcode(barcode string) (*Media, error) {
+	return p.lookup("barcode:" + barcode)
+}
+
+func (p *fakeProvider) LookupCatalogNumber(catalogNumber string) (*Media, error) {
+	return p.lookup("catno:" + catalogNumber)
+}
+
+func (p *fakeProvider) LookupRelease(artist, title string) (*Media, error) {
+	return p.lookup(artist + " - " + title)
+}
+
+func TestLookupEnrichmentMatch(t *testing.T) {
+	release := &Media{
+		Title:         "Blue Train",
+		DatePublished: "1958-01-15",
+		ImageURL:      "https://example.com/blue-train.jpg",
+		GenreTags:     []string{"Jazz", "Hard Bop"},
+		Tracks:        []Track{{Position: "A1", Title: "Blue Train", Length: "10:43"}},
+	}
+	provider := &fakeProvider{releases: map[string]*Media{
+		"barcode:0724349532725":      release,
+		"catno:BLP 1577":             release,
+		"John Coltrane - Blue Train": release,
+	}}
+
+	tests := []struct {
+		name      string
+		candidate enrichmentCandidate
+		lookup    string
+		want      EnrichmentChanges
+	}{
+		{
+			name:      "barcode fills missing fields",
+			candidate: enrichmentCandidate{Barcode: "0724349532725", CatalogNumber: "BLP 1577", DatePublished: "1958"},
+			lookup:    "barcode:0724349532725",
+			want: EnrichmentChanges{
+				DatePublished: "1958-01-15",
+				ImageURL:      release.ImageURL,
+				GenreTags:     release.GenreTags,
+				Tracks:        release.Tracks,
+			},
+		},
+		{
+			name:      "catalog number keeps existing fields",
+			candidate: enrichmentCandidate{CatalogNumber: "BLP 1577", DatePublished: "1958-01-15", ImageURL: "cover.jpg", TrackCount: 5},
+			lookup:    "catno:BLP 1577",
+			want:      EnrichmentChanges{GenreTags: release.GenreTags},
+		},
+		{
+			name:      "artist and title ignore a conflicting date",
+			candidate: enrichmentCandidate{ArtistName: "John Coltrane", Title: "Blue Train", DatePublished: "1957", GenreTags: "Jazz"},
+			lookup:    "John Coltrane - Blue Train",
+			want:      EnrichmentChanges{ImageURL: release.ImageURL, Tracks: release.Tracks},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider.lookups = nil
+			changes, err := lookupEnrichment(provider, tt.candidate)
+			if err != nil {
+				t.Fatalf("lookupEnrichment() error = %v", err)
+			}
+			if !reflect.DeepEqual(provider.lookups, []string{tt.lookup}) {
+				t.Errorf("lookups = %q, want %q", provider.lookups, tt.lookup)
+			}
+			if !reflect.DeepEqual(changes, tt.want) {
+				t.Errorf("changes = %+v, want %+v", changes, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupEnrichmentNothingToChange(t *testing.T) {
+	provider := &fakeProvider{releases: map[string]*Media{
+		"barcode:0724349532725": {DatePublished: "1958", ImageURL: "other.jpg", GenreTags: []string{"Jazz"}},
+	}}
+	candidate := enrichmentCandidate{Barcode: "0724349532725", DatePublished: "1958-01-15", ImageURL: "cover.jpg", GenreTags: "Jazz", TrackCount: 5}
+
+	changes, err := lookupEnrichment(provider, candidate)
+	if err != nil {
+		t.Fatalf("lookupEnrichment() error = %v", err)
+	}
+	if !changes.isEmpty() {
+		t.Errorf("changes = %+v, want none", changes)
+	}
+}
+
+func TestLookupEnrichmentNoMatch(t *testing.T) {
+	provider := &fakeProvider{releases: map[string]*Media{}}
+
+	_, err := lookupEnrichment(provider, enrichmentCandidate{ArtistName: "Nobody", Title: "Nothing"})
+	if err != ErrReleaseNotFound {
+		t.Errorf("lookupEnrichment() error = %v, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestLookupEnrichmentProviderError(t *testing.T) {
+	providerErr := errors.New("host returned 503 Service Unavailable")
+	provider := &fakeProvider{err: providerErr}
+
+	changes, err := lookupEnrichment(provider, enrichmentCandidate{Barcode: "0724349532725"})
+	if err != providerErr {
+		t.Errorf("lookupEnrichment() error = %v, want %v", err, providerErr)
+	}
+	if !changes.isEmpty() {
+		t.Errorf("changes = %+v, want none", changes)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// APIError struct is the JSON body of every error response
+type APIError struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestID string       `json:"request_id"`
+	Fields    []FieldError `json:"fields,omitempty"`
+}
+
+// errorCode turns a status into a machine-readable code, e.g. 404 becomes "not_found"
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// writeError sends an error response with a message that is safe to show to clients
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeJSONError(w, status, APIError{
+		Code:      errorCode(status),
+		Message:   message,
+		RequestID: requestID(r),
+	})
+}
+
+// writeInternalError logs err against the request and sends a 500 response
+// carrying only the generic message
+func writeInternalError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	logError(r, message, err)
+	writeError(w, r, http.StatusInternalServerError, message)
+}
+
+// writeValidationError sends a 422 response listing each invalid field, or a
+// plain 400 if err is not a *ValidationError
+func writeValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSONError(w, http.StatusUnprocessableEntity, APIError{
+		Code:      "validation_failed",
+		Message:   "Request body failed validation",
+		RequestID: requestID(r),
+		Fields:    invalid.Fields,
+	})
+}
+
+// requestError is an error whose status and message are safe to send to clients
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// errorResponse converts err into a status and error body. Validation and
+// request errors are described to the client; anything else is logged and
+// reported as a 500 with only internalMessage.
+func errorResponse(r *http.Request, internalMessage string, err error) (int, APIError) {
+	var invalid *ValidationError
+	var reqErr *requestError
+	switch {
+	case errors.As(err, &invalid):
+		return http.StatusUnprocessableEntity, APIError{
+			Code:      "validation_failed",
+			Message:   "Request body failed validation",
+			RequestID: requestID(r),
+			Fields:    invalid.Fields,
+		}
+	case errors.As(err, &reqErr):
+		return reqErr.status, APIError{Code: errorCode(reqErr.status), Message: reqErr.message, RequestID: requestID(r)}
+	}
+	logError(r, internalMessage, err)
+	status := http.StatusInternalServerError
+	return status, APIError{Code: errorCode(status), Message: internalMessage, RequestID: requestID(r)}
+}
+
+// writeRequestError sends the response errorResponse builds for err
+func writeRequestError(w http.ResponseWriter, r *http.Request, internalMessage string, err error) {
+	status, body := errorResponse(r, internalMessage, err)
+	writeJSONError(w, status, body)
+}
+
+// writeJSONError writes body as the response with the given status
+func writeJSONError(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// notFound handles requests that match no route
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, "No route for "+r.URL.Path)
+}
+
+// methodNotAllowed handles requests whose path matches a route but whose method does not
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// modifiedMessage explains a 412 response to a write based on an old version
+const modifiedMessage = "Resource has been modified; fetch it again and retry"
+
+// versionETag returns the entity tag of a resource version
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// etagListContains reports whether an If-Match or If-None-Match header lists
+// etag or is "*". Weak tags (W/"...") only match when weak comparison is allowed.
+func etagListContains(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch enforces the If-Match header of a write against the current
+// version. It sends 428 if the header is missing or 412 if it doesn't match.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, version int) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		writeError(w, r, http.StatusPreconditionRequired, "If-Match header is required; send the ETag from the last GET")
+		return false
+	}
+	if !etagListContains(header, versionETag(version), false) {
+		writeError(w, r, http.StatusPreconditionFailed, modifiedMessage)
+		return false
+	}
+	return true
+}
+
+// notModified sends 304 if the If-None-Match header of a read matches etag
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !etagListContains(header, etag, true) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
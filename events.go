@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Change events are read from the audit log once their transaction has
+// committed, so rolled back changes never reach subscribers and changes made
+// by other processes, such as the seed command, do.
+
+// eventKeepAlive is how often an idle stream gets a comment to keep proxies from closing it
+const eventKeepAlive = 15 * time.Second
+
+// eventGapTimeout is how long the feed waits for a skipped audit ID to
+// appear. IDs are allocated before commit, so a later one can commit first;
+// a rolled back one never appears.
+const eventGapTimeout = 30 * time.Second
+
+// eventStreamLimit ends each stream before the server's write timeout would
+// cut it off; clients reconnect and resume with Last-Event-ID. run sets it
+// from the config, zero means no limit.
+var eventStreamLimit time.Duration
+
+// eventEntityTypes are the audited entities whose changes are streamed
+var eventEntityTypes = map[string]bool{auditMedia: true, auditArtist: true, auditCollection: true}
+
+// eventActions maps audit actions to the verbs of change events
+var eventActions = map[string]string{
+	auditCreate:  "create",
+	auditUpdate:  "update",
+	auditRevert:  "update",
+	auditRestore: "create",
+	auditDelete:  "delete",
+	auditPurge:   "delete",
+}
+
+// ChangeEvent struct holds a change to the catalog or a collection
+type ChangeEvent struct {
+	ID         int64           `json:"id"`
+	Type       string          `json:"type"` // entity_type.action, e.g. media.create
+	EntityType string          `json:"entity_type"`
+	EntityID   int             `json:"entity_id"`
+	Action     string          `json:"action"`
+	User       string          `json:"user"`
+	CreatedAt  string          `json:"created_at"`
+	Data       json.RawMessage `json:"data,omitempty"` // The entity after the change, or before a delete
+}
+
+// eventHub keeps the latest events in a ring buffer for resuming and fans
+// new ones out to subscribers
+type eventHub struct {
+	mu          sync.Mutex
+	ring        []ChangeEvent
+	start       int
+	count       int
+	subscribers map[chan ChangeEvent]bool
+	closed      bool
+}
+
+// changeEvents is the hub fed by startEventFeed; run sizes it from the config
+var changeEvents = newEventHub(1000)
+
+// newEventHub returns a hub remembering the last size events
+func newEventHub(size int) *eventHub {
+	return &eventHub{ring: make([]ChangeEvent, size), subscribers: map[chan ChangeEvent]bool{}}
+}
+
+// publish buffers an event and sends it to every subscriber. A subscriber
+// that has fallen too far behind is dropped; it can reconnect and resume.
+func (h *eventHub) publish(e ChangeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count < len(h.ring) {
+		h.ring[(h.start+h.count)%len(h.ring)] = e
+		h.count++
+	} else {
+		h.ring[h.start] = e
+		h.start = (h.start + 1) % len(h.ring)
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the buffered events after lastID, if resuming, and a
+// channel of new events. The channel is closed if the subscriber falls
+// behind or the hub is closed.
+func (h *eventHub) subscribe(lastID int64, resume bool) ([]ChangeEvent, chan ChangeEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var backlog []ChangeEvent
+	if resume {
+		// Events are buffered in commit order, which can differ from ID order,
+		// so resume from the position of the last event seen if it is still
+		// buffered, and otherwise send every buffered event with a later ID
+		buffered := make([]ChangeEvent, h.count)
+		for i := range buffered {
+			buffered[i] = h.ring[(h.start+i)%len(h.ring)]
+		}
+		found := false
+		for i, e := range buffered {
+			if e.ID == lastID {
+				backlog, found = buffered[i+1:], true
+				break
+			}
+		}
+		if !found {
+			for _, e := range buffered {
+				if e.ID > lastID {
+					backlog = append(backlog, e)
+				}
+			}
+		}
+	}
+
+	ch := make(chan ChangeEvent, 64)
+	if h.closed {
+		close(ch)
+		return backlog, ch, func() {}
+	}
+	h.subscribers[ch] = true
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.subscribers[ch] {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, unsubscribe
+}
+
+// close ends every stream so the server can shut down
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// eventFilter selects the events a stream asked for
+type eventFilter struct {
+	types map[string]bool
+	users map[string]bool
+}
+
+// parseEventFilter reads the comma-separated type and user query parameters.
+// A type is an entity type such as media, or an event type such as media.create.
+func parseEventFilter(r *http.Request) eventFilter {
+	split := func(param string) map[string]bool {
+		var values map[string]bool
+		for _, value := range strings.Split(r.URL.Query().Get(param), ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				if values == nil {
+					values = map[string]bool{}
+				}
+				values[value] = true
+			}
+		}
+		return values
+	}
+	return eventFilter{types: split("type"), users: split("user")}
+}
+
+func (f eventFilter) matches(e ChangeEvent) bool {
+	if f.types != nil && !f.types[e.EntityType] && !f.types[e.Type] {
+		return false
+	}
+	return f.users == nil || f.users[e.User]
+}
+
+// getEvents handles a Server-Sent Events stream of changes, optionally
+// filtered by type and user. A Last-Event-ID header resumes after that event
+// if it is still buffered.
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	filter := parseEventFilter(r)
+	var lastID int64
+	header := r.Header.Get("Last-Event-ID")
+	if header != "" {
+		id, err := strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid Last-Event-ID")
+			return
+		}
+		lastID = id
+	}
+	backlog, events, unsubscribe := changeEvents.subscribe(lastID, header != "")
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", time.Second.Milliseconds())
+	for _, e := range backlog {
+		if filter.matches(e) {
+			writeEvent(w, e)
+		}
+	}
+	flusher.Flush()
+
+	var deadline <-chan time.Time
+	if eventStreamLimit > 0 {
+		timer := time.NewTimer(eventStreamLimit)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if !filter.matches(e) {
+				continue
+			}
+			writeEvent(w, e)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-deadline:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes one event in the text/event-stream format
+func writeEvent(w http.ResponseWriter, e ChangeEvent) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+}
+
+// eventFeed tails the audit log into changeEvents and the webhook deliveries
+type eventFeed struct {
+	lastID int64
+	gaps   map[int64]time.Time // Skipped IDs and when they were first missed
+}
+
+// poll publishes audit entries committed since the last poll. Their webhook
+// deliveries are queued first, together with the saved cursor, and the feed
+// only moves past them once that commits, so a failed poll reads the same
+// entries again next time.
+func (f *eventFeed) poll() error {
+	where := `WHERE id > ?`
+	args := []interface{}{f.lastID}
+	if len(f.gaps) > 0 {
+		ids := make([]int, 0, len(f.gaps))
+		for id := range f.gaps {
+			ids = append(ids, int(id))
+		}
+		in, gapArgs := inClause(ids)
+		where += ` OR id ` + in
+		args = append(args, gapArgs...)
+	}
+	rows, err := db.Query(`
+        SELECT id, entity_type, entity_id, action, actor,
+            DATE_FORMAT(created_at, '%Y-%m-%dT%H:%i:%s'),
+            IFNULL(after_state, IFNULL(before_state, ''))
+        FROM audit_log `+where+` ORDER BY id LIMIT 500`, args...)
+	if err != nil {
+		return err
+	}
+
+	var read []int64
+	var events []ChangeEvent
+	for rows.Next() {
+		var e ChangeEvent
+		var data string
+		if err := rows.Scan(&e.ID, &e.EntityType, &e.EntityID, &e.Action, &e.User, &e.CreatedAt, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		read = append(read, e.ID)
+
+		verb, ok := eventActions[e.Action]
+		if !ok || !eventEntityTypes[e.EntityType] {
+			continue
+		}
+		e.Action = verb
+		e.Type = e.EntityType + "." + verb
+		if data != "" {
+			e.Data = json.RawMessage(data)
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	lastID, gaps, cursor := f.advance(read, time.Now())
+
+	// The cursor is saved with the deliveries, so a restart reads the entries
+	// that were missing again. Deliveries are unique per webhook and event, so
+	// queueing the same events again doesn't send them twice.
+	if len(read) > 0 {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := queueWebhookDeliveries(tx, events); err != nil {
+			return fmt.Errorf("failed to queue webhook deliveries: %v", err)
+		}
+		if err := saveWebhookCursor(tx, cursor); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	f.lastID, f.gaps = lastID, gaps
+	for _, e := range events {
+		changeEvents.publish(e)
+	}
+	f.expireGaps(time.Now())
+	return nil
+}
+
+// advance returns the last ID and the gaps the feed has once it has read the
+// entries with the given IDs, and the cursor to save: the last ID before the
+// first gap, below which every entry has been read
+func (f *eventFeed) advance(read []int64, now time.Time) (int64, map[int64]time.Time, int64) {
+	lastID, gaps := f.lastID, make(map[int64]time.Time, len(f.gaps))
+	for id, missed := range f.gaps {
+		gaps[id] = missed
+	}
+	for _, id := range read {
+		if _, ok := gaps[id]; ok {
+			delete(gaps, id)
+			continue
+		}
+		for missing := lastID + 1; missing < id && len(gaps) < 1000; missing++ {
+			gaps[missing] = now
+		}
+		if id > lastID {
+			lastID = id
+		}
+	}
+
+	cursor := lastID
+	for id := range gaps {
+		if id <= cursor {
+			cursor = id - 1
+		}
+	}
+	return lastID, gaps, cursor
+}
+
+// expireGaps stops waiting for IDs missing for longer than eventGapTimeout
+func (f *eventFeed) expireGaps(now time.Time) {
+	for id, missed := range f.gaps {
+		if now.Sub(missed) > eventGapTimeout {
+			delete(f.gaps, id)
+		}
+	}
+}
+
+// startEventFeed publishes new audit entries as change events every interval
+// until the returned stop function is called. It resumes from the saved
+// webhook cursor, so changes committed while no server was running still get
+// their deliveries; the first time it runs it starts from the latest entry.
+func startEventFeed(interval time.Duration) (stop func(), err error) {
+	feed := &eventFeed{gaps: map[int64]time.Time{}}
+	var resumed bool
+	feed.lastID, resumed, err = loadWebhookCursor(db)
+	if err == nil && !resumed {
+		err = db.QueryRow(`SELECT IFNULL(MAX(id), 0) FROM audit_log`).Scan(&feed.lastID)
+		if err == nil {
+			err = saveWebhookCursor(db, feed.lastID)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := feed.poll(); err != nil {
+				log.Printf("Event feed failed: %v", err)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// eventIDs returns the IDs of events in order
+func eventIDs(events []ChangeEvent) []int64 {
+	ids := []int64{}
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestEventHubRing(t *testing.T) {
+	hub := newEventHub(3)
+	for id := int64(1); id <= 5; id++ {
+		hub.publish(ChangeEvent{ID: id})
+	}
+
+	// Only the last three are kept, oldest first
+	backlog, _, unsubscribe := hub.subscribe(0, true)
+	defer unsubscribe()
+	if got := eventIDs(backlog); !reflect.DeepEqual(got, []int64{3, 4, 5}) {
+		t.Errorf("buffered events = %v, want [3 4 5]", got)
+	}
+	backlog, _, unsubscribe = hub.subscribe(0, false)
+	defer unsubscribe()
+	if len(backlog) != 0 {
+		t.Errorf("backlog without resuming = %v, want none", eventIDs(backlog))
+	}
+}
+
+func TestEventHubResume(t *testing.T) {
+	hub := newEventHub(10)
+	// Events are published in commit order, so 7 comes before 6
+	for _, id := range []int64{4, 5, 7, 6, 8} {
+		hub.publish(ChangeEvent{ID: id})
+	}
+
+	tests := []struct {
+		name   string
+		lastID int64
+		want   []int64
+	}{
+		{"found resumes after its position", 7, []int64{6, 8}},
+		{"found at the end", 8, []int64{}},
+		{"not found sends later IDs", 3, []int64{4, 5, 7, 6, 8}},
+		{"not found after the last ID", 9, []int64{}},
+	}
+	for _, tt := range tests {
+		backlog, _, unsubscribe := hub.subscribe(tt.lastID, true)
+		unsubscribe()
+		if got := eventIDs(backlog); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: resuming after %d = %v, want %v", tt.name, tt.lastID, got, tt.want)
+		}
+	}
+
+	// An ID evicted from the ring isn't found, so everything later is sent
+	for id := int64(9); id <= 15; id++ {
+		hub.publish(ChangeEvent{ID: id})
+	}
+	backlog, _, unsubscribe := hub.subscribe(5, true)
+	unsubscribe()
+	if got := eventIDs(backlog); !reflect.DeepEqual(got, []int64{7, 6, 8, 9, 10, 11, 12, 13, 14, 15}) {
+		t.Errorf("resuming after an evicted event = %v", got)
+	}
+}
+
+func TestEventHubSubscribers(t *testing.T) {
+	hub := newEventHub(10)
+	_, fast, unsubscribeFast := hub.subscribe(0, false)
+	defer unsubscribeFast()
+	_, slow, unsubscribeSlow := hub.subscribe(0, false)
+	defer unsubscribeSlow()
+
+	// The fast subscriber keeps reading; the slow one never does and is
+	// dropped once its channel is full
+	for id := int64(1); id <= int64(cap(slow))+1; id++ {
+		hub.publish(ChangeEvent{ID: id})
+		if e := <-fast; e.ID != id {
+			t.Fatalf("fast subscriber got %d, want %d", e.ID, id)
+		}
+	}
+	received := 0
+	for range slow {
+		received++
+	}
+	if received != cap(slow) {
+		t.Errorf("slow subscriber got %d events before being dropped, want %d", received, cap(slow))
+	}
+	if _, ok := hub.subscribers[fast]; !ok || len(hub.subscribers) != 1 {
+		t.Errorf("subscribers = %d, want only the fast one", len(hub.subscribers))
+	}
+
+	// Unsubscribing after being dropped doesn't close the channel twice
+	unsubscribeSlow()
+
+	hub.close()
+	if _, ok := <-fast; ok {
+		t.Error("fast subscriber still open after close")
+	}
+	if _, late, _ := hub.subscribe(0, false); late == nil {
+		t.Error("subscribe after close returned no channel")
+	} else if _, ok := <-late; ok {
+		t.Error("subscribe after close returned an open channel")
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	events := []ChangeEvent{
+		{ID: 1, EntityType: auditMedia, Type: "media.create", User: "alice"},
+		{ID: 2, EntityType: auditMedia, Type: "media.delete", User: "bob"},
+		{ID: 3, EntityType: auditArtist, Type: "artist.update", User: "alice"},
+		{ID: 4, EntityType: auditCollection, Type: "collection.create", User: "importer"},
+	}
+
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		{"", []int64{1, 2, 3, 4}},
+		{"?type=media", []int64{1, 2}},
+		{"?type=media.create,collection", []int64{1, 4}},
+		{"?type=+artist+,,", []int64{3}},
+		{"?user=alice", []int64{1, 3}},
+		{"?user=alice,importer&type=media,collection", []int64{1, 4}},
+		{"?type=label", []int64{}},
+		{"?type=&user=", []int64{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		filter := parseEventFilter(httptest.NewRequest("GET", "/api/v1/events"+tt.query, nil))
+		got := []int64{}
+		for _, e := range events {
+			if filter.matches(e) {
+				got = append(got, e.ID)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("filter %q matched %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestEventFeedGaps(t *testing.T) {
+	start := time.Now()
+	feed := &eventFeed{lastID: 10, gaps: map[int64]time.Time{}}
+
+	// 12 and 13 haven't committed yet
+	lastID, gaps, cursor := feed.advance([]int64{11, 14}, start)
+	if lastID != 14 || cursor != 11 || len(gaps) != 2 || gaps[12] != start || gaps[13] != start {
+		t.Fatalf("advance = %d, %v, %d; want 14, gaps 12 and 13, cursor 11", lastID, gaps, cursor)
+	}
+	if feed.lastID != 10 || len(feed.gaps) != 0 {
+		t.Errorf("advance changed the feed to %d, %v", feed.lastID, feed.gaps)
+	}
+	feed.lastID, feed.gaps = lastID, gaps
+
+	// 13 commits; the cursor can't pass 12 until it commits or is given up on
+	lastID, gaps, cursor = feed.advance([]int64{13, 15}, start.Add(time.Second))
+	if lastID != 15 || cursor != 11 || len(gaps) != 1 || gaps[12] != start {
+		t.Fatalf("advance = %d, %v, %d; want 15, gap 12, cursor 11", lastID, gaps, cursor)
+	}
+	feed.lastID, feed.gaps = lastID, gaps
+
+	feed.expireGaps(start.Add(eventGapTimeout))
+	if len(feed.gaps) != 1 {
+		t.Errorf("gap expired early: %v", feed.gaps)
+	}
+	feed.expireGaps(start.Add(eventGapTimeout + time.Second))
+	if len(feed.gaps) != 0 {
+		t.Errorf("gaps after the timeout = %v, want none", feed.gaps)
+	}
+	if _, _, cursor = feed.advance(nil, start); cursor != 15 {
+		t.Errorf("cursor without gaps = %d, want 15", cursor)
+	}
+
+	// A long run of missing IDs is tracked only up to a limit
+	feed = &eventFeed{gaps: map[int64]time.Time{}}
+	if _, gaps, _ := feed.advance([]int64{5000}, start); len(gaps) != 1000 {
+		t.Errorf("gaps tracked = %d, want 1000", len(gaps))
+	}
+}
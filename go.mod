@@ -5,9 +5,7 @@ go 1.18
 require (
 	github.com/go-sql-driver/mysql v1.8.1
 	github.com/gorilla/mux v1.8.0
+	github.com/rs/cors v1.11.1
 )
 
-require (
-	filippo.io/edwards25519 v1.1.0 // indirect
-	github.com/rs/cors v1.11.1 // indirect
-)
\ No newline at end of file
+require filippo.io/edwards25519 v1.1.0 // indirect
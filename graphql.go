@@ -0,0 +1,1104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The GraphQL endpoint implements the query subset of the language: operations
+// with variables, aliases, arguments, nested selections, named and inline
+// fragments and __typename. Mutations, subscriptions, directives and schema
+// introspection are not supported.
+
+// graphQLLimits bound the queries /graphql accepts; run sets them from the config
+var graphQLLimits = struct {
+	MaxDepth      int
+	MaxComplexity int
+}{MaxDepth: 10, MaxComplexity: 1000}
+
+// graphQLListSize is the number of items assumed for a list without a limit
+// argument when estimating the complexity of a query
+const graphQLListSize = 10
+
+// GraphQLRequest struct holds a query and its variables
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// GraphQLResponse struct holds the result of a query; data is omitted when
+// the query was rejected before running
+type GraphQLResponse struct {
+	Data   interface{}    `json:"data,omitempty"`
+	Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+// GraphQLError struct holds a message that is safe to show to clients
+type GraphQLError struct {
+	Message string `json:"message"`
+}
+
+// graphQLError is an error in the query itself rather than in running it
+type graphQLError struct {
+	message string
+}
+
+func (e *graphQLError) Error() string {
+	return e.message
+}
+
+func gqlErrorf(format string, args ...interface{}) error {
+	return &graphQLError{fmt.Sprintf(format, args...)}
+}
+
+// postGraphQL handles a GraphQL query over the catalog and collections
+func postGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req GraphQLRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if bodyTooLarge(err) {
+		writeBodyError(w, r, err)
+		return
+	} else if err != nil {
+		writeGraphQL(w, http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{"Invalid request body: " + err.Error()}}})
+		return
+	}
+
+	data, err := runGraphQL(req)
+	if gqlErr, ok := err.(*graphQLError); ok {
+		writeGraphQL(w, http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{gqlErr.message}}})
+		return
+	} else if err != nil {
+		logError(r, "GraphQL query failed", err)
+		writeGraphQL(w, http.StatusOK, GraphQLResponse{Errors: []GraphQLError{{"Failed to run query"}}})
+		return
+	}
+	writeGraphQL(w, http.StatusOK, GraphQLResponse{Data: data})
+}
+
+// writeGraphQL sends a GraphQL response
+func writeGraphQL(w http.ResponseWriter, status int, resp GraphQLResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runGraphQL parses, checks and runs a query against gqlSchema. Problems with
+// the query are returned as *graphQLError.
+func runGraphQL(req GraphQLRequest) (*gqlObject, error) {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return nil, err
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return nil, err
+	}
+	if op.kind != "query" {
+		return nil, gqlErrorf("%s operations are not supported", op.kind)
+	}
+	variables, err := op.coerceVariables(req.Variables)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := &gqlContext{doc: doc, variables: variables}
+	fields, err := ctx.collectFields("Query", op.selections, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+	complexity, err := ctx.check("Query", fields, 1)
+	if err != nil {
+		return nil, err
+	}
+	if complexity > graphQLLimits.MaxComplexity {
+		return nil, gqlErrorf("query complexity %d exceeds the limit of %d", complexity, graphQLLimits.MaxComplexity)
+	}
+
+	results, err := ctx.execute("Query", []interface{}{nil}, fields)
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+// gqlObject is a result object whose keys keep the order of the query
+type gqlObject struct {
+	keys   []string
+	values []interface{}
+}
+
+func (o *gqlObject) set(key string, value interface{}) {
+	o.keys = append(o.keys, key)
+	o.values = append(o.values, value)
+}
+
+// MarshalJSON writes the object with its keys in query order
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(o.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Schema
+
+// gqlResolver returns the value of a field for each of a batch of parents:
+// a scalar, an object, nil, or a []interface{} of objects for list fields.
+// Resolving a whole level at once lets each field cost one query rather than
+// one per parent.
+type gqlResolver func(parents []interface{}, args map[string]interface{}) ([]interface{}, error)
+
+// gqlType is an object type of the schema
+type gqlType map[string]*gqlField
+
+// gqlField is a field of an object type. Type is a scalar (Int, Float,
+// String, Boolean) or the name of an object type.
+type gqlField struct {
+	Type    string
+	List    bool
+	Args    map[string]gqlArg
+	Resolve gqlResolver
+}
+
+// gqlArg is an argument of a field
+type gqlArg struct {
+	Type     string
+	Required bool
+	Default  interface{}
+}
+
+// gqlScalars are the scalar types of the schema
+var gqlScalars = map[string]bool{"Int": true, "Float": true, "String": true, "Boolean": true}
+
+// Parsing
+
+// gqlDocument is a parsed query document
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+// gqlOperation is an operation of a document
+type gqlOperation struct {
+	kind       string
+	name       string
+	variables  []gqlVariableDef
+	selections []gqlSelection
+}
+
+// gqlVariableDef declares a variable of an operation
+type gqlVariableDef struct {
+	name       string
+	typ        string
+	required   bool
+	list       bool
+	def        interface{}
+	hasDefault bool
+}
+
+// gqlFragment is a named fragment of a document
+type gqlFragment struct {
+	typeCondition string
+	selections    []gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread or an inline fragment
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	selections []gqlSelection
+
+	spread        string // Name of a spread fragment
+	inline        bool
+	typeCondition string
+}
+
+// gqlVariable is a variable reference in an argument value
+type gqlVariable string
+
+// gqlEnum is an enum value in an argument; the schema uses none, so it is
+// only reported as an error
+type gqlEnum string
+
+// gqlToken is a lexical token: a punctuator, name, number or string
+type gqlToken struct {
+	kind  byte // 'p'unctuator, 'n'ame, 'i'nt, 'f'loat, 's'tring or 0 at the end
+	value string
+	pos   int
+}
+
+// gqlParser is a recursive descent parser over the tokens of a document.
+// nesting counts the selection sets, lists and objects it is inside, so a
+// deeply nested query is refused before it is recursed through.
+type gqlParser struct {
+	src        string
+	pos        int
+	tok        gqlToken
+	nesting    int
+	maxNesting int
+}
+
+// parseGraphQL parses a query document. Selection sets may nest twice as deep
+// as graphQLLimits.MaxDepth, leaving room for an inline fragment at every
+// level; check enforces the depth of the fields themselves.
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{src: src, maxNesting: 2 * graphQLLimits.MaxDepth}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	doc := &gqlDocument{fragments: map[string]*gqlFragment{}}
+	for p.tok.kind != 0 {
+		switch {
+		case p.tok.kind == 'p' && p.tok.value == "{":
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: selections})
+		case p.tok.kind == 'n' && (p.tok.value == "query" || p.tok.value == "mutation" || p.tok.value == "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.tok.kind == 'n' && p.tok.value == "fragment":
+			name, fragment, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.fragments[name]; ok {
+				return nil, gqlErrorf("fragment %q is defined more than once", name)
+			}
+			doc.fragments[name] = fragment
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, gqlErrorf("query has no operations")
+	}
+	return doc, nil
+}
+
+// operation returns the operation to run: the named one, or the only one
+func (doc *gqlDocument) operation(name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(doc.operations) > 1 {
+			return nil, gqlErrorf("operationName is required when the query has several operations")
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, gqlErrorf("operation %q not found", name)
+}
+
+// enter records that the parser is going one level deeper, failing past maxNesting
+func (p *gqlParser) enter() error {
+	p.nesting++
+	if p.nesting > p.maxNesting {
+		return gqlErrorf("query nesting exceeds the limit of %d", p.maxNesting)
+	}
+	return nil
+}
+
+func (p *gqlParser) unexpected() error {
+	if p.tok.kind == 0 {
+		return gqlErrorf("syntax error: unexpected end of query")
+	}
+	return gqlErrorf("syntax error at offset %d: unexpected %q", p.tok.pos, p.tok.value)
+}
+
+// expect consumes the punctuator value or fails
+func (p *gqlParser) expect(value string) error {
+	if p.tok.kind != 'p' || p.tok.value != value {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+// peek reports whether the current token is the punctuator value
+func (p *gqlParser) peek(value string) bool {
+	return p.tok.kind == 'p' && p.tok.value == value
+}
+
+// name consumes a name
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != 'n' {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.next()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.tok.value}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == 'n' {
+		op.name = p.tok.value
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek("(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.peek(")") {
+			def, err := p.variableDef()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, def)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek("@") {
+		return nil, gqlErrorf("directives are not supported")
+	}
+	selections, err := p.selectionSet()
+	op.selections = selections
+	return op, err
+}
+
+func (p *gqlParser) variableDef() (gqlVariableDef, error) {
+	var def gqlVariableDef
+	if err := p.expect("$"); err != nil {
+		return def, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return def, err
+	}
+	def.name = name
+	if err := p.expect(":"); err != nil {
+		return def, err
+	}
+	if p.peek("[") {
+		def.list = true
+		if err := p.next(); err != nil {
+			return def, err
+		}
+	}
+	if def.typ, err = p.name(); err != nil {
+		return def, err
+	}
+	if def.list {
+		if p.peek("!") {
+			if err := p.next(); err != nil {
+				return def, err
+			}
+		}
+		if err := p.expect("]"); err != nil {
+			return def, err
+		}
+	}
+	if p.peek("!") {
+		def.required = true
+		if err := p.next(); err != nil {
+			return def, err
+		}
+	}
+	if p.peek("=") {
+		if err := p.next(); err != nil {
+			return def, err
+		}
+		if def.def, err = p.value(true); err != nil {
+			return def, err
+		}
+		def.hasDefault = true
+	}
+	return def, nil
+}
+
+func (p *gqlParser) fragment() (string, *gqlFragment, error) {
+	if err := p.next(); err != nil {
+		return "", nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "on" {
+		return "", nil, gqlErrorf("fragment cannot be named \"on\"")
+	}
+	if p.tok.kind != 'n' || p.tok.value != "on" {
+		return "", nil, p.unexpected()
+	}
+	if err := p.next(); err != nil {
+		return "", nil, err
+	}
+	typeCondition, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	selections, err := p.selectionSet()
+	return name, &gqlFragment{typeCondition: typeCondition, selections: selections}, err
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.nesting-- }()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []gqlSelection
+	for !p.peek("}") {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+	if len(selections) == 0 {
+		return nil, gqlErrorf("syntax error: empty selection set")
+	}
+	return selections, p.next()
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	var s gqlSelection
+	if p.peek("...") {
+		if err := p.next(); err != nil {
+			return s, err
+		}
+		if p.tok.kind == 'n' && p.tok.value != "on" {
+			s.spread = p.tok.value
+			return s, p.next()
+		}
+		s.inline = true
+		if p.tok.kind == 'n' {
+			if err := p.next(); err != nil {
+				return s, err
+			}
+			typeCondition, err := p.name()
+			if err != nil {
+				return s, err
+			}
+			s.typeCondition = typeCondition
+		}
+		selections, err := p.selectionSet()
+		s.selections = selections
+		return s, err
+	}
+
+	name, err := p.name()
+	if err != nil {
+		return s, err
+	}
+	s.name = name
+	if p.peek(":") {
+		if err := p.next(); err != nil {
+			return s, err
+		}
+		s.alias = name
+		if s.name, err = p.name(); err != nil {
+			return s, err
+		}
+	}
+	if p.peek("(") {
+		if err := p.next(); err != nil {
+			return s, err
+		}
+		s.args = map[string]interface{}{}
+		for !p.peek(")") {
+			argName, err := p.name()
+			if err != nil {
+				return s, err
+			}
+			if err := p.expect(":"); err != nil {
+				return s, err
+			}
+			if _, ok := s.args[argName]; ok {
+				return s, gqlErrorf("argument %q is given more than once", argName)
+			}
+			if s.args[argName], err = p.value(false); err != nil {
+				return s, err
+			}
+		}
+		if err := p.next(); err != nil {
+			return s, err
+		}
+	}
+	if p.peek("@") {
+		return s, gqlErrorf("directives are not supported")
+	}
+	if p.peek("{") {
+		s.selections, err = p.selectionSet()
+	}
+	return s, err
+}
+
+// value parses an argument or default value; constant values may not refer to variables
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	tok := p.tok
+	switch tok.kind {
+	case 'i':
+		n, err := strconv.Atoi(tok.value)
+		if err != nil {
+			return nil, gqlErrorf("integer %s is out of range", tok.value)
+		}
+		return n, p.next()
+	case 'f':
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, gqlErrorf("number %s is out of range", tok.value)
+		}
+		return f, p.next()
+	case 's':
+		return tok.value, p.next()
+	case 'n':
+		var value interface{}
+		switch tok.value {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		case "null":
+			value = nil
+		default:
+			value = gqlEnum(tok.value)
+		}
+		return value, p.next()
+	case 'p':
+		switch tok.value {
+		case "$":
+			if constant {
+				return nil, gqlErrorf("default values cannot refer to variables")
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			return gqlVariable(name), err
+		case "[":
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer func() { p.nesting-- }()
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			list := []interface{}{}
+			for !p.peek("]") {
+				item, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			return list, p.next()
+		case "{":
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer func() { p.nesting-- }()
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			object := map[string]interface{}{}
+			for !p.peek("}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if object[name], err = p.value(constant); err != nil {
+					return nil, err
+				}
+			}
+			return object, p.next()
+		}
+	}
+	return nil, p.unexpected()
+}
+
+// next reads the following token, skipping whitespace, commas and comments
+func (p *gqlParser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+		} else if strings.HasPrefix(p.src[p.pos:], "\uFEFF") {
+			p.pos += len("\uFEFF")
+		} else {
+			break
+		}
+	}
+
+	start := p.pos
+	if start == len(p.src) {
+		p.tok = gqlToken{pos: start}
+		return nil
+	}
+	c := p.src[start]
+	switch {
+	case strings.HasPrefix(p.src[start:], "..."):
+		p.pos += 3
+		p.tok = gqlToken{'p', "...", start}
+	case strings.ContainsRune("!$():=@[]{}|&", rune(c)):
+		p.pos++
+		p.tok = gqlToken{'p', string(c), start}
+	case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+		for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = gqlToken{'n', p.src[start:p.pos], start}
+	case c == '-' || c >= '0' && c <= '9':
+		return p.number()
+	case c == '"':
+		return p.string()
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[start:])
+		return gqlErrorf("syntax error at offset %d: unexpected character %q", start, r)
+	}
+	return nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// number reads an Int or Float token
+func (p *gqlParser) number() error {
+	start := p.pos
+	digits := func() int {
+		n := 0
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.pos++
+			n++
+		}
+		return n
+	}
+
+	kind := byte('i')
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	if digits() == 0 {
+		return gqlErrorf("syntax error at offset %d: invalid number", start)
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		kind = 'f'
+		p.pos++
+		if digits() == 0 {
+			return gqlErrorf("syntax error at offset %d: invalid number", start)
+		}
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		kind = 'f'
+		p.pos++
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		if digits() == 0 {
+			return gqlErrorf("syntax error at offset %d: invalid number", start)
+		}
+	}
+	if p.pos < len(p.src) && (isNameChar(p.src[p.pos]) || p.src[p.pos] == '.') {
+		return gqlErrorf("syntax error at offset %d: invalid number", start)
+	}
+	p.tok = gqlToken{kind, p.src[start:p.pos], start}
+	return nil
+}
+
+// string reads a quoted string token; block strings are not supported
+func (p *gqlParser) string() error {
+	start := p.pos
+	if strings.HasPrefix(p.src[start:], `"""`) {
+		return gqlErrorf("syntax error at offset %d: block strings are not supported", start)
+	}
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' || p.src[p.pos] == '\r' {
+			return gqlErrorf("syntax error at offset %d: unterminated string", start)
+		}
+		c := p.src[p.pos]
+		if c == '"' {
+			p.pos++
+			break
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			p.pos++
+			continue
+		}
+		if p.pos+1 >= len(p.src) {
+			return gqlErrorf("syntax error at offset %d: unterminated string", start)
+		}
+		escape := p.src[p.pos+1]
+		p.pos += 2
+		switch escape {
+		case '"', '\\', '/':
+			b.WriteByte(escape)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if p.pos+4 > len(p.src) {
+				return gqlErrorf("syntax error at offset %d: invalid unicode escape", p.pos)
+			}
+			code, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+			if err != nil {
+				return gqlErrorf("syntax error at offset %d: invalid unicode escape", p.pos)
+			}
+			b.WriteRune(rune(code))
+			p.pos += 4
+		default:
+			return gqlErrorf("syntax error at offset %d: invalid escape \\%c", p.pos-2, escape)
+		}
+	}
+	p.tok = gqlToken{'s', b.String(), start}
+	return nil
+}
+
+// Checking and running
+
+// gqlContext holds the document and variables of a running query
+type gqlContext struct {
+	doc       *gqlDocument
+	variables map[string]interface{}
+}
+
+// gqlFieldNode is a field to resolve, after fragments are expanded and
+// fields with the same response key are merged
+type gqlFieldNode struct {
+	key        string
+	name       string
+	args       map[string]interface{}
+	selections []gqlSelection
+	children   []*gqlFieldNode // Set by check for object fields
+}
+
+// coerceVariables checks the supplied variables against the operation's
+// declarations and applies defaults
+func (op *gqlOperation) coerceVariables(supplied map[string]interface{}) (map[string]interface{}, error) {
+	variables := map[string]interface{}{}
+	for _, def := range op.variables {
+		value, ok := supplied[def.name]
+		if !ok && def.hasDefault {
+			value, ok = def.def, true
+		}
+		if !ok || value == nil {
+			if def.required {
+				return nil, gqlErrorf("variable $%s is required", def.name)
+			}
+			variables[def.name] = nil
+			continue
+		}
+		if def.list {
+			return nil, gqlErrorf("variable $%s: list variables are not supported", def.name)
+		}
+		coerced, err := coerceScalar(def.typ, value)
+		if err != nil {
+			return nil, gqlErrorf("variable $%s: %v", def.name, err)
+		}
+		variables[def.name] = coerced
+	}
+	return variables, nil
+}
+
+// coerceScalar converts a JSON or literal value to the Go value of a scalar type
+func coerceScalar(typ string, value interface{}) (interface{}, error) {
+	switch typ {
+	case "Int":
+		switch n := value.(type) {
+		case int:
+			return n, nil
+		case float64:
+			if n == math.Trunc(n) && math.Abs(n) <= math.MaxInt32 {
+				return int(n), nil
+			}
+		}
+	case "Float":
+		switch n := value.(type) {
+		case int:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+	case "String":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case "Boolean":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %s", typ)
+	}
+	return nil, fmt.Errorf("expected %s, got %v", typ, value)
+}
+
+// collectFields expands the fragments of a selection set on typeName and
+// merges fields that share a response key
+func (ctx *gqlContext) collectFields(typeName string, selections []gqlSelection, visiting map[string]bool) ([]*gqlFieldNode, error) {
+	var fields []*gqlFieldNode
+	index := map[string]*gqlFieldNode{}
+	var collect func(selections []gqlSelection) error
+	collect = func(selections []gqlSelection) error {
+		for _, s := range selections {
+			switch {
+			case s.spread != "":
+				fragment, ok := ctx.doc.fragments[s.spread]
+				if !ok {
+					return gqlErrorf("fragment %q is not defined", s.spread)
+				}
+				if visiting[s.spread] {
+					return gqlErrorf("fragment %q spreads itself", s.spread)
+				}
+				if fragment.typeCondition != typeName {
+					return gqlErrorf("fragment %q on %s cannot be spread on %s", s.spread, fragment.typeCondition, typeName)
+				}
+				visiting[s.spread] = true
+				err := collect(fragment.selections)
+				delete(visiting, s.spread)
+				if err != nil {
+					return err
+				}
+			case s.inline:
+				if s.typeCondition != "" && s.typeCondition != typeName {
+					return gqlErrorf("inline fragment on %s cannot be used on %s", s.typeCondition, typeName)
+				}
+				if err := collect(s.selections); err != nil {
+					return err
+				}
+			default:
+				key := s.alias
+				if key == "" {
+					key = s.name
+				}
+				args, err := ctx.resolveArgs(s.args)
+				if err != nil {
+					return err
+				}
+				if existing, ok := index[key]; ok {
+					if existing.name != s.name || !sameArgs(existing.args, args) {
+						return gqlErrorf("fields named %q conflict; use aliases", key)
+					}
+					existing.selections = append(existing.selections, s.selections...)
+					continue
+				}
+				node := &gqlFieldNode{key: key, name: s.name, args: args, selections: s.selections}
+				index[key] = node
+				fields = append(fields, node)
+			}
+		}
+		return nil
+	}
+	return fields, collect(selections)
+}
+
+// resolveArgs substitutes variables into argument values
+func (ctx *gqlContext) resolveArgs(args map[string]interface{}) (map[string]interface{}, error) {
+	resolved := map[string]interface{}{}
+	for name, value := range args {
+		if v, ok := value.(gqlVariable); ok {
+			variable, declared := ctx.variables[string(v)]
+			if !declared {
+				return nil, gqlErrorf("variable $%s is not declared", v)
+			}
+			if variable == nil {
+				continue
+			}
+			value = variable
+		}
+		resolved[name] = value
+	}
+	return resolved, nil
+}
+
+func sameArgs(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if fmt.Sprint(b[name]) != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// check validates fields against typeName and returns their complexity: one
+// per field, with the fields under a list counted once per expected item
+func (ctx *gqlContext) check(typeName string, fields []*gqlFieldNode, depth int) (int, error) {
+	if depth > graphQLLimits.MaxDepth {
+		return 0, gqlErrorf("query depth exceeds the limit of %d", graphQLLimits.MaxDepth)
+	}
+	complexity := 0
+	for _, node := range fields {
+		complexity++
+		if node.name == "__typename" {
+			continue
+		}
+		field, ok := gqlSchema[typeName][node.name]
+		if !ok {
+			return 0, gqlErrorf("%s has no field %q", typeName, node.name)
+		}
+
+		for name, value := range node.args {
+			arg, ok := field.Args[name]
+			if !ok {
+				return 0, gqlErrorf("%s.%s has no argument %q", typeName, node.name, name)
+			}
+			coerced, err := coerceScalar(arg.Type, value)
+			if err != nil {
+				return 0, gqlErrorf("argument %q of %s.%s: %v", name, typeName, node.name, err)
+			}
+			node.args[name] = coerced
+		}
+		for name, arg := range field.Args {
+			if _, ok := node.args[name]; ok {
+				continue
+			}
+			if arg.Required {
+				return 0, gqlErrorf("argument %q of %s.%s is required", name, typeName, node.name)
+			}
+			if arg.Default != nil {
+				node.args[name] = arg.Default
+			}
+		}
+
+		if gqlScalars[field.Type] {
+			if len(node.selections) > 0 {
+				return 0, gqlErrorf("%s.%s has type %s and cannot have a selection", typeName, node.name, field.Type)
+			}
+			continue
+		}
+		if len(node.selections) == 0 {
+			return 0, gqlErrorf("%s.%s has type %s and needs a selection of its fields", typeName, node.name, field.Type)
+		}
+		children, err := ctx.collectFields(field.Type, node.selections, map[string]bool{})
+		if err != nil {
+			return 0, err
+		}
+		node.children = children
+		childComplexity, err := ctx.check(field.Type, children, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		if field.List {
+			items := graphQLListSize
+			if limit, ok := node.args["limit"].(int); ok {
+				items = limit
+			}
+			childComplexity *= items
+		}
+		complexity += childComplexity
+		if complexity > graphQLLimits.MaxComplexity {
+			return complexity, nil
+		}
+	}
+	return complexity, nil
+}
+
+// execute resolves fields on every parent at once, one resolver call per
+// field, and recurses into the objects they return as a single batch
+func (ctx *gqlContext) execute(typeName string, parents []interface{}, fields []*gqlFieldNode) ([]*gqlObject, error) {
+	results := make([]*gqlObject, len(parents))
+	for i := range results {
+		results[i] = &gqlObject{}
+	}
+
+	for _, node := range fields {
+		if node.name == "__typename" {
+			for _, result := range results {
+				result.set(node.key, typeName)
+			}
+			continue
+		}
+		field := gqlSchema[typeName][node.name]
+		values, err := field.Resolve(parents, node.args)
+		if _, ok := err.(*graphQLError); ok {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", typeName, node.name, err)
+		}
+		if gqlScalars[field.Type] {
+			for i, result := range results {
+				result.set(node.key, values[i])
+			}
+			continue
+		}
+
+		// Gather the objects under every parent to resolve them together
+		var children []interface{}
+		for _, value := range values {
+			if list, ok := value.([]interface{}); ok {
+				children = append(children, list...)
+			} else if value != nil {
+				children = append(children, value)
+			}
+		}
+		childResults, err := ctx.execute(field.Type, children, node.children)
+		if err != nil {
+			return nil, err
+		}
+
+		next := 0
+		for i, value := range values {
+			if list, ok := value.([]interface{}); ok {
+				items := make([]*gqlObject, len(list))
+				copy(items, childResults[next:next+len(list)])
+				next += len(list)
+				results[i].set(node.key, items)
+			} else if value != nil {
+				results[i].set(node.key, childResults[next])
+				next++
+			} else {
+				results[i].set(node.key, nil)
+			}
+		}
+	}
+	return results, nil
+}
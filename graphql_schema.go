@@ -0,0 +1,453 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// maxGraphQLPageSize caps the limit argument of the top-level list fields
+const maxGraphQLPageSize = 100
+
+// collectionItem is one copy of a media in a user's collection
+type collectionItem struct {
+	UserID   int
+	MediaID  int
+	FormatID int
+}
+
+// pageArgs are the arguments of the top-level list fields
+var pageArgs = map[string]gqlArg{
+	"limit":  {Type: "Int", Default: 50},
+	"offset": {Type: "Int", Default: 0},
+}
+
+// idArg is the argument of the top-level single object fields
+var idArg = map[string]gqlArg{"id": {Type: "Int", Required: true}}
+
+// gqlSchema is the GraphQL schema: the Query root and the object types
+// reachable from it. Every object field loads its values for a whole batch of
+// parents with one query.
+var gqlSchema = map[string]gqlType{
+	"Query": {
+		"media":    {Type: "Media", Args: idArg, Resolve: rootByID(loadMediaByIDs)},
+		"allMedia": {Type: "Media", List: true, Args: pageArgs, Resolve: rootPage(`SELECT m.id FROM media m JOIN artists a ON m.artist_id = a.id WHERE `+notTrashed+` ORDER BY `+artistSortOrder+`, m.title, m.id`, loadMediaByIDs)},
+		"artist":   {Type: "Artist", Args: idArg, Resolve: rootByID(loadArtistsByIDs)},
+		"artists":  {Type: "Artist", List: true, Args: pageArgs, Resolve: rootPage(`SELECT a.id FROM artists a ORDER BY `+artistSortOrder+`, a.id`, loadArtistsByIDs)},
+		"format":   {Type: "Format", Args: idArg, Resolve: rootByID(loadFormatsByIDs)},
+		"formats":  {Type: "Format", List: true, Args: pageArgs, Resolve: rootPage(`SELECT id FROM formats ORDER BY id`, loadFormatsByIDs)},
+		"user":     {Type: "User", Args: idArg, Resolve: rootByID(loadUsersByIDs)},
+		"users":    {Type: "User", List: true, Args: pageArgs, Resolve: rootPage(`SELECT id FROM users ORDER BY id`, loadUsersByIDs)},
+	},
+	"Media": {
+		"id":            {Type: "Int", Resolve: scalar(func(m Media) interface{} { return m.ID })},
+		"title":         {Type: "String", Resolve: scalar(func(m Media) interface{} { return m.Title })},
+		"datePublished": {Type: "String", Resolve: scalar(func(m Media) interface{} { return nullIfEmpty(m.DatePublished) })},
+		"imageUrl":      {Type: "String", Resolve: scalar(func(m Media) interface{} { return nullIfEmpty(m.ImageURL) })},
+		"genreTags":     {Type: "String", List: true, Resolve: scalar(func(m Media) interface{} { return nonEmpty(m.GenreTags) })},
+		"barcode":       {Type: "String", Resolve: scalar(func(m Media) interface{} { return nullIfEmpty(m.Barcode) })},
+		"catalogNumber": {Type: "String", Resolve: scalar(func(m Media) interface{} { return nullIfEmpty(m.CatalogNumber) })},
+		"label":         {Type: "String", Resolve: scalar(func(m Media) interface{} { return nullIfEmpty(m.LabelName) })},
+		"version":       {Type: "Int", Resolve: scalar(func(m Media) interface{} { return m.Version })},
+		"updatedAt":     {Type: "String", Resolve: scalar(func(m Media) interface{} { return m.UpdatedAt })},
+		"artist":        {Type: "Artist", Resolve: belongsTo(func(m Media) int { return m.ArtistID }, loadArtistsByIDs)},
+		"format":        {Type: "Format", Resolve: belongsTo(func(m Media) int { return m.FormatID }, loadFormatsByIDs)},
+		"tracks":        {Type: "Track", List: true, Resolve: hasMany(func(m Media) int { return m.ID }, loadTracksByMediaIDs)},
+		"owners":        {Type: "CollectionItem", List: true, Resolve: hasMany(func(m Media) int { return m.ID }, loadCollectionsByMediaIDs)},
+	},
+	"Track": {
+		"position": {Type: "String", Resolve: scalar(func(t Track) interface{} { return t.Position })},
+		"title":    {Type: "String", Resolve: scalar(func(t Track) interface{} { return t.Title })},
+		"length":   {Type: "String", Resolve: scalar(func(t Track) interface{} { return nullIfEmpty(t.Length) })},
+	},
+	"Artist": {
+		"id":         {Type: "Int", Resolve: scalar(func(a Artist) interface{} { return a.ID })},
+		"name":       {Type: "String", Resolve: scalar(func(a Artist) interface{} { return a.Name })},
+		"sortName":   {Type: "String", Resolve: scalar(func(a Artist) interface{} { return a.SortName })},
+		"country":    {Type: "String", Resolve: scalar(func(a Artist) interface{} { return nullIfEmpty(a.Country) })},
+		"activeFrom": {Type: "Int", Resolve: scalar(func(a Artist) interface{} { return a.ActiveFrom })},
+		"activeTo":   {Type: "Int", Resolve: scalar(func(a Artist) interface{} { return a.ActiveTo })},
+		"aliases":    {Type: "String", List: true, Resolve: loadAliasesByArtists},
+		"media":      {Type: "Media", List: true, Resolve: hasMany(func(a Artist) int { return a.ID }, loadMediaByArtistIDs)},
+		// Band memberships aren't stored yet, so this is always empty
+		"bands": {Type: "Band", List: true, Resolve: hasMany(func(a Artist) int { return a.ID }, func([]int) (map[int][]interface{}, error) {
+			return map[int][]interface{}{}, nil
+		})},
+	},
+	"Band": {
+		"id":         {Type: "Int", Resolve: scalar(func(b Band) interface{} { return b.ID })},
+		"name":       {Type: "String", Resolve: scalar(func(b Band) interface{} { return b.Name })},
+		"formedDate": {Type: "String", Resolve: scalar(func(b Band) interface{} { return b.FormedDate.Format(time.RFC3339) })},
+		"disbanded":  {Type: "Boolean", Resolve: scalar(func(b Band) interface{} { return b.Disbanded })},
+	},
+	"Format": {
+		"id":          {Type: "Int", Resolve: scalar(func(f Format) interface{} { return f.ID })},
+		"name":        {Type: "String", Resolve: scalar(func(f Format) interface{} { return f.Name })},
+		"description": {Type: "String", Resolve: scalar(func(f Format) interface{} { return nullIfEmpty(f.Description) })},
+	},
+	"User": {
+		"id":         {Type: "Int", Resolve: scalar(func(u User) interface{} { return u.ID })},
+		"username":   {Type: "String", Resolve: scalar(func(u User) interface{} { return u.Username })},
+		"firstName":  {Type: "String", Resolve: scalar(func(u User) interface{} { return u.FirstName })},
+		"lastName":   {Type: "String", Resolve: scalar(func(u User) interface{} { return u.LastName })},
+		"collection": {Type: "CollectionItem", List: true, Resolve: hasMany(func(u User) int { return u.ID }, loadCollectionsByUserIDs)},
+	},
+	"CollectionItem": {
+		"user":   {Type: "User", Resolve: belongsTo(func(c collectionItem) int { return c.UserID }, loadUsersByIDs)},
+		"media":  {Type: "Media", Resolve: belongsTo(func(c collectionItem) int { return c.MediaID }, loadMediaByIDs)},
+		"format": {Type: "Format", Resolve: belongsTo(func(c collectionItem) int { return c.FormatID }, loadFormatsByIDs)},
+	},
+}
+
+// nullIfEmpty returns nil for an empty string so optional fields come back as null
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nonEmpty drops the empty tag that splitting an empty genre_tags column leaves
+func nonEmpty(tags []string) []string {
+	result := []string{}
+	for _, tag := range tags {
+		if tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// scalar resolves a field read straight from each parent
+func scalar[T any](get func(T) interface{}) gqlResolver {
+	return func(parents []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+		values := make([]interface{}, len(parents))
+		for i, parent := range parents {
+			values[i] = get(parent.(T))
+		}
+		return values, nil
+	}
+}
+
+// belongsTo resolves the object each parent refers to, loading them all at once
+func belongsTo[T any](key func(T) int, load func([]int) (map[int]interface{}, error)) gqlResolver {
+	return func(parents []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+		ids := make([]int, len(parents))
+		for i, parent := range parents {
+			ids[i] = key(parent.(T))
+		}
+		objects, err := load(uniqueIDs(ids))
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(parents))
+		for i, id := range ids {
+			if object, ok := objects[id]; ok {
+				values[i] = object
+			}
+		}
+		return values, nil
+	}
+}
+
+// hasMany resolves the objects that refer to each parent, loading them all at once
+func hasMany[T any](key func(T) int, load func([]int) (map[int][]interface{}, error)) gqlResolver {
+	return func(parents []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+		ids := make([]int, len(parents))
+		for i, parent := range parents {
+			ids[i] = key(parent.(T))
+		}
+		lists, err := load(uniqueIDs(ids))
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(parents))
+		for i, id := range ids {
+			list := lists[id]
+			if list == nil {
+				list = []interface{}{}
+			}
+			values[i] = list
+		}
+		return values, nil
+	}
+}
+
+// rootByID resolves a top-level field that looks an object up by its id argument
+func rootByID(load func([]int) (map[int]interface{}, error)) gqlResolver {
+	return func(_ []interface{}, args map[string]interface{}) ([]interface{}, error) {
+		objects, err := load([]int{args["id"].(int)})
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{objects[args["id"].(int)]}, nil
+	}
+}
+
+// rootPage resolves a top-level list field: query selects the IDs in order,
+// and a page of them is loaded
+func rootPage(query string, load func([]int) (map[int]interface{}, error)) gqlResolver {
+	return func(_ []interface{}, args map[string]interface{}) ([]interface{}, error) {
+		limit, offset := args["limit"].(int), args["offset"].(int)
+		if limit < 0 || limit > maxGraphQLPageSize || offset < 0 {
+			return nil, gqlErrorf("limit must be between 0 and %d and offset must not be negative", maxGraphQLPageSize)
+		}
+		ids, err := queryIDs(query+` LIMIT ? OFFSET ?`, limit, offset)
+		if err != nil {
+			return nil, err
+		}
+		objects, err := load(ids)
+		if err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for _, id := range ids {
+			if object, ok := objects[id]; ok {
+				list = append(list, object)
+			}
+		}
+		return []interface{}{list}, nil
+	}
+}
+
+// uniqueIDs returns the distinct non-zero IDs in ids
+func uniqueIDs(ids []int) []int {
+	seen := map[int]bool{}
+	var unique []int
+	for _, id := range ids {
+		if id != 0 && !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// inClause returns "IN (?, ?, ...)" and the arguments for a list of IDs
+func inClause(ids []int) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return `IN (?` + strings.Repeat(`, ?`, len(ids)-1) + `)`, args
+}
+
+// queryIDs returns the first column of every row of query
+func queryIDs(query string, args ...interface{}) ([]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// loadMediaByIDs loads media that aren't in the trash, keyed by ID
+func loadMediaByIDs(ids []int) (map[int]interface{}, error) {
+	media := map[int]interface{}{}
+	if len(ids) == 0 {
+		return media, nil
+	}
+	in, args := inClause(ids)
+	rows, err := db.Query(selectMediaQuery+` WHERE m.id `+in+` AND `+notTrashed, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m, err := scanMedia(rows)
+		if err != nil {
+			return nil, err
+		}
+		media[m.ID] = m
+	}
+	return media, rows.Err()
+}
+
+// loadMediaByArtistIDs loads the media of each artist by release date
+func loadMediaByArtistIDs(ids []int) (map[int][]interface{}, error) {
+	media := map[int][]interface{}{}
+	if len(ids) == 0 {
+		return media, nil
+	}
+	in, args := inClause(ids)
+	rows, err := db.Query(selectMediaQuery+` WHERE m.artist_id `+in+` AND `+notTrashed+` ORDER BY `+releaseDateOrder+`, m.title`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m, err := scanMedia(rows)
+		if err != nil {
+			return nil, err
+		}
+		media[m.ArtistID] = append(media[m.ArtistID], m)
+	}
+	return media, rows.Err()
+}
+
+// loadTracksByMediaIDs loads the track lists of media
+func loadTracksByMediaIDs(ids []int) (map[int][]interface{}, error) {
+	tracks := map[int][]interface{}{}
+	if len(ids) == 0 {
+		return tracks, nil
+	}
+	in, args := inClause(ids)
+	rows, err := db.Query(`SELECT media_id, position, title, length FROM tracks WHERE media_id `+in+` ORDER BY media_id, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mediaID int
+		var t Track
+		if err := rows.Scan(&mediaID, &t.Position, &t.Title, &t.Length); err != nil {
+			return nil, err
+		}
+		tracks[mediaID] = append(tracks[mediaID], t)
+	}
+	return tracks, rows.Err()
+}
+
+// loadArtistsByIDs loads artists keyed by ID
+func loadArtistsByIDs(ids []int) (map[int]interface{}, error) {
+	artists := map[int]interface{}{}
+	if len(ids) == 0 {
+		return artists, nil
+	}
+	in, args := inClause(ids)
+	rows, err := db.Query(selectArtistQuery+` WHERE a.id `+in, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a, err := scanArtist(rows)
+		if err != nil {
+			return nil, err
+		}
+		artists[a.ID] = a
+	}
+	return artists, rows.Err()
+}
+
+// loadAliasesByArtists resolves the aliases of a batch of artists
+func loadAliasesByArtists(parents []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+	ids := make([]int, len(parents))
+	for i, parent := range parents {
+		ids[i] = parent.(Artist).ID
+	}
+	aliases := map[int][]string{}
+	if unique := uniqueIDs(ids); len(unique) > 0 {
+		in, args := inClause(unique)
+		rows, err := db.Query(`SELECT artist_id, alias FROM artist_aliases WHERE artist_id `+in+` ORDER BY id`, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var artistID int
+			var alias string
+			if err := rows.Scan(&artistID, &alias); err != nil {
+				return nil, err
+			}
+			aliases[artistID] = append(aliases[artistID], alias)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	values := make([]interface{}, len(parents))
+	for i, id := range ids {
+		values[i] = nonEmpty(aliases[id])
+	}
+	return values, nil
+}
+
+// loadFormatsByIDs loads formats keyed by ID
+func loadFormatsByIDs(ids []int) (map[int]interface{}, error) {
+	formats := map[int]interface{}{}
+	if len(ids) == 0 {
+		return formats, nil
+	}
+	in, args := inClause(ids)
+	rows, err := db.Query(`SELECT id, IFNULL(name, ''), IFNULL(description, '') FROM formats WHERE id `+in, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f Format
+		if err := rows.Scan(&f.ID, &f.Name, &f.Description); err != nil {
+			return nil, err
+		}
+		formats[f.ID] = f
+	}
+	return formats, rows.Err()
+}
+
+// loadUsersByIDs loads users keyed by ID, leaving out their email and password
+func loadUsersByIDs(ids []int) (map[int]interface{}, error) {
+	users := map[int]interface{}{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+	in, args := inClause(ids)
+	rows, err := db.Query(`SELECT id, IFNULL(username, ''), IFNULL(first_name, ''), IFNULL(last_name, '') FROM users WHERE id `+in, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.FirstName, &u.LastName); err != nil {
+			return nil, err
+		}
+		users[u.ID] = u
+	}
+	return users, rows.Err()
+}
+
+// loadCollectionsByUserIDs loads the collection of each user
+func loadCollectionsByUserIDs(ids []int) (map[int][]interface{}, error) {
+	return loadCollectionItems(`um.user_id`, ids, func(c collectionItem) int { return c.UserID })
+}
+
+// loadCollectionsByMediaIDs loads the owned copies of each media
+func loadCollectionsByMediaIDs(ids []int) (map[int][]interface{}, error) {
+	return loadCollectionItems(`um.media_id`, ids, func(c collectionItem) int { return c.MediaID })
+}
+
+// loadCollectionItems loads the collection entries whose column is one of ids,
+// leaving out media in the trash, grouped by key
+func loadCollectionItems(column string, ids []int, key func(collectionItem) int) (map[int][]interface{}, error) {
+	items := map[int][]interface{}{}
+	if len(ids) == 0 {
+		return items, nil
+	}
+	in, args := inClause(ids)
+	rows, err := db.Query(`SELECT um.user_id, um.media_id, um.format_id FROM user_media um JOIN media m ON um.media_id = m.id WHERE `+column+` `+in+` AND `+notTrashed+` ORDER BY um.user_id, um.media_id, um.format_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c collectionItem
+		var formatID sql.NullInt64
+		if err := rows.Scan(&c.UserID, &c.MediaID, &formatID); err != nil {
+			return nil, err
+		}
+		c.FormatID = int(formatID.Int64)
+		items[key(c)] = append(items[key(c)], c)
+	}
+	return items, rows.Err()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		err   string // A part of the expected error, or "" if the query parses
+	}{
+		{"shorthand", `{ media(id: 1) { title } }`, ""},
+		{"named with variables", `query Page($limit: Int = 10, $q: String!) { allMedia(limit: $limit) { id } }`, ""},
+		{"aliases and fragments", `{ a: media(id: 1) { ...M } } fragment M on Media { title ... on Media { id } }`, ""},
+		{"values", `{ f(i: -1, x: 1.5e3, s: "a\"é", b: true, n: null, e: ASC, l: [1, [2]], o: {k: "v"}) { id } }`, ""},
+		{"comments and commas", "# note\n{ id,, title }", ""},
+		{"empty", ``, "query has no operations"},
+		{"unexpected end", `{ media(id: 1) { title }`, "unexpected end of query"},
+		{"unexpected token", `{ media(id: 1) } }`, `unexpected "}"`},
+		{"empty selection", `{ }`, "empty selection set"},
+		{"bad character", `{ media% }`, "unexpected character"},
+		{"bad number", `{ media(id: 1.) { id } }`, "invalid number"},
+		{"integer out of range", `{ media(id: 99999999999999999999) { id } }`, "out of range"},
+		{"unterminated string", `{ artist(name: "abc) { id } }`, "unterminated string"},
+		{"bad escape", `{ artist(name: "\q") { id } }`, "invalid escape"},
+		{"block string", `{ artist(name: """abc""") { id } }`, "block strings are not supported"},
+		{"directive on field", `{ media(id: 1) @skip(if: true) { id } }`, "directives are not supported"},
+		{"directive on operation", `query Q @live { id }`, "directives are not supported"},
+		{"repeated argument", `{ media(id: 1, id: 2) { id } }`, `argument "id" is given more than once`},
+		{"repeated fragment", `{ ...F } fragment F on Query { id } fragment F on Query { id }`, `fragment "F" is defined more than once`},
+		{"fragment named on", `{ id } fragment on on Query { id }`, `cannot be named "on"`},
+		{"variable in default", `query ($a: Int = $b) { id }`, "default values cannot refer to variables"},
+		{"deeply nested selections", strings.Repeat("{ a ", 2*graphQLLimits.MaxDepth) + "{ b }" + strings.Repeat("}", 2*graphQLLimits.MaxDepth), "query nesting exceeds the limit"},
+		{"deeply nested lists", `{ a(l: ` + strings.Repeat("[", 1000) + `) }`, "query nesting exceeds the limit"},
+		{"deeply nested objects", `{ a(o: ` + strings.Repeat("{k: ", 1000) + `) }`, "query nesting exceeds the limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGraphQL(tt.query)
+			checkGraphQLError(t, err, tt.err)
+		})
+	}
+}
+
+func TestGraphQLChecks(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		variables map[string]interface{}
+		err       string
+	}{
+		{"unknown field", `{ media(id: 1) { colour } }`, "", nil, `Media has no field "colour"`},
+		{"unknown argument", `{ media(id: 1, colour: "red") { id } }`, "", nil, `Query.media has no argument "colour"`},
+		{"missing argument", `{ media { id } }`, "", nil, `argument "id" of Query.media is required`},
+		{"wrong argument type", `{ media(id: "one") { id } }`, "", nil, `argument "id" of Query.media`},
+		{"scalar with a selection", `{ media(id: 1) { title { id } } }`, "", nil, "cannot have a selection"},
+		{"object without a selection", `{ media(id: 1) }`, "", nil, "needs a selection of its fields"},
+		{"undefined fragment", `{ media(id: 1) { ...M } }`, "", nil, `fragment "M" is not defined`},
+		{"fragment cycle", `{ media(id: 1) { ...A } } fragment A on Media { ...B } fragment B on Media { ...A }`, "", nil, "spreads itself"},
+		{"fragment on another type", `{ media(id: 1) { ...A } } fragment A on Artist { name }`, "", nil, `fragment "A" on Artist cannot be spread on Media`},
+		{"inline fragment on another type", `{ media(id: 1) { ... on Artist { name } } }`, "", nil, "inline fragment on Artist cannot be used on Media"},
+		{"conflicting fields", `{ media(id: 1) { id } media(id: 2) { id } }`, "", nil, `fields named "media" conflict; use aliases`},
+		{"conflicting aliases", `{ x: media(id: 1) { id } x: artist(id: 1) { id } }`, "", nil, `fields named "x" conflict; use aliases`},
+		{"undeclared variable", `{ media(id: $id) { id } }`, "", nil, "variable $id is not declared"},
+		{"missing variable", `query ($id: Int!) { media(id: $id) { id } }`, "", nil, "variable $id is required"},
+		{"wrong variable type", `query ($id: Int!) { media(id: $id) { id } }`, "", map[string]interface{}{"id": "one"}, "variable $id"},
+		{"mutation", `mutation { media(id: 1) { id } }`, "", nil, "mutation operations are not supported"},
+		{"several operations", `query A { formats { id } } query B { users { id } }`, "", nil, "operationName is required"},
+		{"unknown operation", `query A { formats { id } }`, "B", nil, `operation "B" not found`},
+		{"negative limit", `{ formats(limit: -1) { id } }`, "", nil, "limit must be between 0 and"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runGraphQL(GraphQLRequest{Query: tt.query, OperationName: tt.operation, Variables: tt.variables})
+			checkGraphQLError(t, err, tt.err)
+		})
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	saved := graphQLLimits
+	defer func() { graphQLLimits = saved }()
+	graphQLLimits.MaxDepth = 3
+	graphQLLimits.MaxComplexity = 60
+
+	tests := []struct {
+		name  string
+		query string
+		err   string
+	}{
+		{"too deep", `{ media(id: 1) { artist { media { id } } } }`, "query depth exceeds the limit of 3"},
+		{"too deep through a fragment", `{ media(id: 1) { ...M } } fragment M on Media { artist { media { id } } }`, "query depth exceeds the limit of 3"},
+		// 1 for allMedia, then 5 items of title (1) and tracks (1, plus 10 items of title)
+		{"too costly", `{ allMedia(limit: 5) { title tracks { title } } }`, "query complexity 61 exceeds the limit of 60"},
+		{"too costly with the default limit", `{ users { username firstName } }`, "query complexity 101 exceeds the limit of 60"},
+		{"too deeply nested to parse", strings.Repeat("{ a ", 7) + "{ b }" + strings.Repeat("}", 7), "query nesting exceeds the limit of 6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runGraphQL(GraphQLRequest{Query: tt.query})
+			checkGraphQLError(t, err, tt.err)
+		})
+	}
+}
+
+// gqlTestBook and gqlTestAuthor make up the schema TestGraphQLBatching queries
+type gqlTestBook struct {
+	ID       int
+	AuthorID int
+}
+
+type gqlTestAuthor struct {
+	ID   int
+	Name string
+}
+
+func TestGraphQLBatching(t *testing.T) {
+	books := []gqlTestBook{{1, 10}, {2, 10}, {3, 20}, {4, 30}}
+	authors := map[int]gqlTestAuthor{10: {10, "Le Guin"}, 20: {20, "Butler"}}
+	calls := map[string]int{}
+
+	loadAuthors := func(ids []int) (map[int]interface{}, error) {
+		calls["authors"]++
+		found := map[int]interface{}{}
+		for _, id := range ids {
+			if a, ok := authors[id]; ok {
+				found[id] = a
+			}
+		}
+		return found, nil
+	}
+	loadBooksByAuthor := func(ids []int) (map[int][]interface{}, error) {
+		calls["books"]++
+		found := map[int][]interface{}{}
+		for _, id := range ids {
+			for _, b := range books {
+				if b.AuthorID == id {
+					found[id] = append(found[id], b)
+				}
+			}
+		}
+		return found, nil
+	}
+
+	saved := gqlSchema
+	defer func() { gqlSchema = saved }()
+	gqlSchema = map[string]gqlType{
+		"Query": {
+			"books": {Type: "Book", List: true, Args: pageArgs, Resolve: func(_ []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+				calls["root"]++
+				list := []interface{}{}
+				for _, b := range books {
+					list = append(list, b)
+				}
+				return []interface{}{list}, nil
+			}},
+		},
+		"Book": {
+			"id":     {Type: "Int", Resolve: scalar(func(b gqlTestBook) interface{} { return b.ID })},
+			"author": {Type: "Author", Resolve: belongsTo(func(b gqlTestBook) int { return b.AuthorID }, loadAuthors)},
+		},
+		"Author": {
+			"name":  {Type: "String", Resolve: scalar(func(a gqlTestAuthor) interface{} { return a.Name })},
+			"books": {Type: "Book", List: true, Resolve: hasMany(func(a gqlTestAuthor) int { return a.ID }, loadBooksByAuthor)},
+		},
+	}
+
+	// Each level of objects is loaded once, however many parents it has
+	data, err := runGraphQL(GraphQLRequest{Query: `{ books(limit: 4) { id author { name books { id author { __typename name } } } } }`})
+	if err != nil {
+		t.Fatalf("runGraphQL: %v", err)
+	}
+	if calls["root"] != 1 || calls["authors"] != 2 || calls["books"] != 1 {
+		t.Errorf("loader calls = %v, want root 1, authors 2 (one per level), books 1", calls)
+	}
+
+	got, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leGuin := `{"name":"Le Guin","books":[{"id":1,"author":{"__typename":"Author","name":"Le Guin"}},{"id":2,"author":{"__typename":"Author","name":"Le Guin"}}]}`
+	butler := `{"name":"Butler","books":[{"id":3,"author":{"__typename":"Author","name":"Butler"}}]}`
+	want := `{"books":[{"id":1,"author":` + leGuin + `},{"id":2,"author":` + leGuin + `},{"id":3,"author":` + butler + `},{"id":4,"author":null}]}`
+	if string(got) != want {
+		t.Errorf("data = %s\nwant %s", got, want)
+	}
+}
+
+// checkGraphQLError fails t unless err is a query error containing want, or
+// nil when want is ""
+func checkGraphQLError(t *testing.T, err error, want string) {
+	t.Helper()
+	if want == "" {
+		if err != nil {
+			t.Errorf("err = %v, want nil", err)
+		}
+		return
+	}
+	if _, ok := err.(*graphQLError); !ok || !strings.Contains(err.Error(), want) {
+		t.Errorf("err = %v, want a query error containing %q", err, want)
+	}
+}
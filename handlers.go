@@ -7,37 +7,87 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 )
 
+// releaseDateColumn renders m.date_published at its stored precision, or as an empty string if unknown
+const releaseDateColumn = `IFNULL(CASE m.date_precision
+            WHEN 'year' THEN DATE_FORMAT(m.date_published, '%Y')
+            WHEN 'month' THEN DATE_FORMAT(m.date_published, '%Y-%m')
+            ELSE DATE_FORMAT(m.date_published, '%Y-%m-%d') END, '')`
+
+// releaseDateOrder sorts media by release date, placing a year or month
+// before the full dates within it
+const releaseDateOrder = `m.date_published, FIELD(m.date_precision, 'year', 'month', 'day')`
+
+// selectMediaQuery selects media joined with their artist and format names.
+// Callers may append a WHERE clause; rows are read back with scanMedia.
+// Trashed media are included unless the clause adds notTrashed.
+const selectMediaQuery = `
+        SELECT 
+            m.id, m.title, ` + releaseDateColumn + `, m.image_url, m.genre_tags, 
+            m.artist_id, a.name, m.format_id, f.name, m.barcode, m.catalog_number,
+            m.label_id, IFNULL(l.name, ''), m.version, DATE_FORMAT(m.updated_at, '%Y-%m-%dT%H:%i:%s'),
+            IFNULL(DATE_FORMAT(m.deleted_at, '%Y-%m-%dT%H:%i:%s'), '')
+        FROM media m 
+        JOIN artists a ON m.artist_id = a.id
+        JOIN formats f ON m.format_id = f.id
+        LEFT JOIN labels l ON m.label_id = l.id
+    `
+
+// notTrashed is the condition that hides soft-deleted media (aliased as m)
+const notTrashed = `m.deleted_at IS NULL`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMedia reads a single row produced by selectMediaQuery
+func scanMedia(row rowScanner) (Media, error) {
+	var m Media
+	var genreTags string
+	var labelID sql.NullInt64
+	err := row.Scan(
+		&m.ID, &m.Title, &m.DatePublished, &m.ImageURL, &genreTags,
+		&m.ArtistID, &m.ArtistName, &m.FormatID, &m.FormatName, &m.Barcode, &m.CatalogNumber,
+		&labelID, &m.LabelName, &m.Version, &m.UpdatedAt, &m.DeletedAt,
+	)
+	if err != nil {
+		return m, err
+	}
+	if labelID.Valid {
+		id := int(labelID.Int64)
+		m.LabelID = &id
+	}
+	// Split genre tags string into a slice
+	m.GenreTags = strings.Split(genreTags, ",")
+	return m, nil
+}
+
 // createMedia handles the creation of a new media
 func createMedia(w http.ResponseWriter, r *http.Request) {
 	var m Media
 	err := json.NewDecoder(r.Body).Decode(&m)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
 		return
 	}
 
-	// Convert genre tags to a comma-separated string
-	genreTags := strings.Join(m.GenreTags, ",")
-
-	// Insert artist if it doesn't exist and get artist_id
-	var artistID int
-	err = db.QueryRow(`SELECT id FROM artists WHERE id = ?`, m.ArtistID).Scan(&artistID)
-	if err == sql.ErrNoRows {
-		http.Error(w, "Artist not found", http.StatusBadRequest)
-		return
-	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to create media", err)
 		return
 	}
+	defer tx.Rollback()
 
-	// Insert media into media table
-	_, err = db.Exec(`INSERT INTO media (title, date_published, image_url, genre_tags, artist_id, format_id) VALUES (?, ?, ?, ?, ?, ?)`,
-		m.Title, m.DatePublished, m.ImageURL, genreTags, artistID, m.FormatID)
+	_, err = insertMediaTx(tx, requestActor(r), m)
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeRequestError(w, r, "Failed to create media", err)
 		return
 	}
 
@@ -46,16 +96,30 @@ func createMedia(w http.ResponseWriter, r *http.Request) {
 
 // getMedia handles retrieving all media
 func getMedia(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query(`
-        SELECT 
-            m.id, m.title, m.date_published, m.image_url, m.genre_tags, 
-            m.artist_id, a.name, m.format_id, f.name
-        FROM media m 
-        JOIN artists a ON m.artist_id = a.id
-        JOIN formats f ON m.format_id = f.id
-    `)
+	query := selectMediaQuery + ` WHERE ` + notTrashed
+	var args []interface{}
+
+	// Optionally filter by label, including its sub-labels
+	if param := r.URL.Query().Get("label_id"); param != "" {
+		labelID, err := strconv.Atoi(param)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid label ID")
+			return
+		}
+		labelIDs, err := labelFamily(db, labelID)
+		if err != nil {
+			writeInternalError(w, r, "Failed to retrieve labels", err)
+			return
+		}
+		query += ` AND m.label_id IN (?` + strings.Repeat(`, ?`, len(labelIDs)-1) + `)`
+		for _, id := range labelIDs {
+			args = append(args, id)
+		}
+	}
+
+	rows, err := db.Query(query+` ORDER BY `+artistSortOrder+`, m.title`, args...)
 	if err != nil {
-		http.Error(w, "Failed to retrieve media", http.StatusInternalServerError)
+		writeInternalError(w, r, "Failed to retrieve media", err)
 		return
 	}
 	defer rows.Close()
@@ -63,22 +127,16 @@ func getMedia(w http.ResponseWriter, r *http.Request) {
 	var media []Media
 
 	for rows.Next() {
-		var m Media
-		var genreTags string
-		if err := rows.Scan(
-			&m.ID, &m.Title, &m.DatePublished, &m.ImageURL, &genreTags,
-			&m.ArtistID, &m.ArtistName, &m.FormatID, &m.FormatName,
-		); err != nil {
-			http.Error(w, "Failed to scan media", http.StatusInternalServerError)
+		m, err := scanMedia(rows)
+		if err != nil {
+			writeInternalError(w, r, "Failed to scan media", err)
 			return
 		}
-		// Split genre tags string into a slice
-		m.GenreTags = strings.Split(genreTags, ",")
 		media = append(media, m)
 	}
 
 	if err := rows.Err(); err != nil {
-		http.Error(w, "Error iterating over media", http.StatusInternalServerError)
+		writeInternalError(w, r, "Error iterating over media", err)
 		return
 	}
 
@@ -86,100 +144,371 @@ func getMedia(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(media)
 }
 
+// loadMedia returns a media by ID with its tracks, or sql.ErrNoRows if there is none
+func loadMedia(q dbExecutor, id int) (Media, error) {
+	m, err := scanMedia(q.QueryRow(selectMediaQuery+` WHERE m.id = ?`, id))
+	if err != nil {
+		return m, err
+	}
+	m.Tracks, err = loadTracks(q, m.ID)
+	return m, err
+}
+
 // getMediaById handles retrieving a media by ID
 func getMediaById(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid media ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "Invalid media ID")
 		return
 	}
 
-	var m Media
-	var genreTags string
-	err = db.QueryRow(`
-        SELECT 
-            m.id, m.title, m.date_published, m.image_url, m.genre_tags, 
-            m.artist_id, a.name, m.format_id, f.name
-        FROM media m 
-        JOIN artists a ON m.artist_id = a.id
-        JOIN formats f ON m.format_id = f.id
-        WHERE m.id = ?
-    `, id).Scan(
-		&m.ID, &m.Title, &m.DatePublished, &m.ImageURL, &genreTags,
-		&m.ArtistID, &m.ArtistName, &m.FormatID, &m.FormatName,
-	)
+	m, err := loadMedia(db, id)
+	if err == nil && m.DeletedAt != "" {
+		err = sql.ErrNoRows
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "Media not found", http.StatusNotFound)
+			writeError(w, r, http.StatusNotFound, "Media not found")
 		} else {
-			http.Error(w, "Failed to retrieve media", http.StatusInternalServerError)
+			writeInternalError(w, r, "Failed to retrieve media", err)
 		}
 		return
 	}
 
-	// Split genre tags string into a slice
-	m.GenreTags = strings.Split(genreTags, ",")
+	etag := versionETag(m.Version)
+	w.Header().Set("ETag", etag)
+	if notModified(w, r, etag) {
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(m)
 }
 
-// updateMedia handles updating an existing media by ID
+// checkMediaIfMatch returns the current version of a media if the request's
+// If-Match header allows writing it, and otherwise sends 404, 412 or 428
+func checkMediaIfMatch(w http.ResponseWriter, r *http.Request, id int) (int, bool) {
+	var version int
+	err := db.QueryRow(`SELECT version FROM media WHERE id = ? AND deleted_at IS NULL`, id).Scan(&version)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Media not found")
+		return 0, false
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to retrieve media", err)
+		return 0, false
+	}
+	return version, checkIfMatch(w, r, version)
+}
+
+// updateMedia handles replacing an existing media by ID. Tracks are only
+// replaced when the body includes them. If-Match must carry the current ETag.
 func updateMedia(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid media ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "Invalid media ID")
 		return
 	}
 
 	var m Media
 	err = json.NewDecoder(r.Body).Decode(&m)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
 		return
 	}
 
-	// Convert genre tags to a comma-separated string
-	genreTags := strings.Join(m.GenreTags, ",")
+	version, ok := checkMediaIfMatch(w, r, id)
+	if !ok {
+		return
+	}
+	saveMedia(w, r, id, m, version, auditUpdate)
+}
 
-	// Ensure the artist exists
-	var artistID int
-	err = db.QueryRow(`SELECT id FROM artists WHERE id = ?`, m.ArtistID).Scan(&artistID)
+// patchMedia handles a JSON Merge Patch (RFC 7396) of an existing media by ID.
+// Fields missing from the patch keep their values and null clears a field.
+// If-Match must carry the current ETag.
+func patchMedia(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid media ID")
+		return
+	}
+
+	if !isMergePatch(r) {
+		writeError(w, r, http.StatusUnsupportedMediaType, "Content-Type must be "+mergePatchContentType)
+		return
+	}
+	var patch map[string]interface{}
+	err = json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if patch == nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body: patch must be a JSON object")
+		return
+	}
+
+	current, err := loadMedia(db, id)
+	if err == nil && current.DeletedAt != "" {
+		err = sql.ErrNoRows
+	}
 	if err == sql.ErrNoRows {
-		http.Error(w, "Artist not found", http.StatusBadRequest)
+		writeError(w, r, http.StatusNotFound, "Media not found")
 		return
 	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, r, "Failed to retrieve media", err)
+		return
+	}
+	if !checkIfMatch(w, r, current.Version) {
+		return
+	}
+
+	m, err := patchedMedia(current, patch)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+	saveMedia(w, r, id, m, current.Version, auditUpdate)
+}
+
+// patchedMedia applies a merge patch to current
+func patchedMedia(current Media, patch map[string]interface{}) (Media, error) {
+	// Naming an artist or format without an ID looks it up again by name
+	if _, ok := patch["artist"]; ok {
+		if _, ok := patch["artist_id"]; !ok {
+			current.ArtistID = 0
+		}
+	}
+	if _, ok := patch["format"]; ok {
+		if _, ok := patch["format_id"]; !ok {
+			current.FormatID = 0
+		}
+	}
+
+	var m Media
+	if err := applyMergePatch(current, patch, &m); err != nil {
+		return m, err
+	}
+	if value, ok := patch["tracks"]; ok && value == nil {
+		m.Tracks = []Track{}
+	}
+	return m, nil
+}
+
+// saveMedia writes m over the media with the given ID as long as it is still
+// at version, records action in the audit log and responds with the updated media
+func saveMedia(w http.ResponseWriter, r *http.Request, id int, m Media, version int, action string) {
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to update media", err)
 		return
 	}
+	defer tx.Rollback()
 
-	// Update the media in the media table
-	_, err = db.Exec(`UPDATE media SET title = ?, date_published = ?, image_url = ?, genre_tags = ?, artist_id = ?, format_id = ? WHERE id = ?`,
-		m.Title, m.DatePublished, m.ImageURL, genreTags, artistID, m.FormatID, id)
+	updated, err := updateMediaTx(tx, requestActor(r), id, m, version, action)
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeRequestError(w, r, "Failed to update media", err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("ETag", versionETag(updated.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
 }
 
-// deleteMedia handles deleting a media by ID
+// deleteMedia handles moving a media to the trash by ID. It stays there, hidden
+// from the other endpoints, until it is restored or purged. If-Match must carry
+// the current ETag.
 func deleteMedia(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid media ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "Invalid media ID")
 		return
 	}
 
-	_, err = db.Exec(`DELETE FROM media WHERE id = ?`, id)
+	version, ok := checkMediaIfMatch(w, r, id)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, r, "Failed to delete media", err)
+		return
+	}
+	defer tx.Rollback()
+
+	err = trashMediaTx(tx, requestActor(r), id, version)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeRequestError(w, r, "Failed to delete media", err)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// Errors from the media write functions that clients can act on
+var (
+	errMediaNotFound  = &requestError{http.StatusNotFound, "Media not found"}
+	errArtistNotFound = &requestError{http.StatusBadRequest, "Artist not found"}
+	errFormatNotFound = &requestError{http.StatusBadRequest, "Format not found"}
+	errMediaModified  = &requestError{http.StatusPreconditionFailed, modifiedMessage}
+	errDuplicateMedia = &requestError{http.StatusConflict, "Media with this title, artist and format already exists"}
+)
+
+// resolveMediaRefs finds the artist and format of m, each by ID or else by name
+func resolveMediaRefs(q dbExecutor, m Media) (artistID, formatID int, err error) {
+	if m.ArtistID == 0 && m.ArtistName != "" {
+		artistID, err = resolveArtistID(q, m.ArtistName)
+	} else {
+		err = q.QueryRow(`SELECT id FROM artists WHERE id = ?`, m.ArtistID).Scan(&artistID)
+	}
+	if err == sql.ErrNoRows {
+		return 0, 0, errArtistNotFound
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	formatID, err = resolveFormatID(q, m.FormatID, m.FormatName)
+	if err == sql.ErrNoRows {
+		return 0, 0, errFormatNotFound
+	}
+	return artistID, formatID, err
+}
+
+// isDuplicateEntry reports whether err is MySQL's duplicate key error
+func isDuplicateEntry(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == 1062
+}
+
+// insertMediaTx validates m and inserts it with its tracks, falling back to
+// the label matching its catalog number, and records it in the audit log
+func insertMediaTx(tx *sql.Tx, actor auditActor, m Media) (Media, error) {
+	if err := m.Validate(); err != nil {
+		return m, err
+	}
+	artistID, formatID, err := resolveMediaRefs(tx, m)
+	if err != nil {
+		return m, err
+	}
+	if m.LabelID == nil {
+		m.LabelID, err = resolveLabelID(tx, actor, "", m.CatalogNumber)
+		if err != nil {
+			return m, err
+		}
+	}
+
+	datePublished, datePrecision := releaseDateColumns(m.DatePublished)
+	result, err := tx.Exec(`INSERT INTO media (title, date_published, date_precision, image_url, genre_tags, artist_id, format_id, barcode, catalog_number, label_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.Title, datePublished, datePrecision, m.ImageURL, strings.Join(m.GenreTags, ","), artistID, formatID, m.Barcode, m.CatalogNumber, m.LabelID)
+	if isDuplicateEntry(err) {
+		return m, errDuplicateMedia
+	} else if err != nil {
+		return m, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return m, err
+	}
+	if len(m.Tracks) > 0 {
+		if err := replaceTracks(tx, int(id), m.Tracks); err != nil {
+			return m, err
+		}
+	}
+
+	created, err := loadMedia(tx, int(id))
+	if err != nil {
+		return m, err
+	}
+	return created, recordAudit(tx, actor, auditMedia, created.ID, auditCreate, nil, created)
+}
+
+// updateMediaTx validates m and writes it over the media with the given ID as
+// long as it is still at version, recording action in the audit log. Tracks
+// are only replaced when m has them.
+func updateMediaTx(tx *sql.Tx, actor auditActor, id int, m Media, version int, action string) (Media, error) {
+	if err := m.Validate(); err != nil {
+		return m, err
+	}
+	artistID, formatID, err := resolveMediaRefs(tx, m)
+	if err != nil {
+		return m, err
+	}
+
+	before, err := loadMedia(tx, id)
+	if err == nil && before.DeletedAt != "" {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		return m, errMediaNotFound
+	} else if err != nil {
+		return m, err
+	}
+
+	// Update the media in the media table, unless another request got there first
+	datePublished, datePrecision := releaseDateColumns(m.DatePublished)
+	result, err := tx.Exec(`UPDATE media SET title = ?, date_published = ?, date_precision = ?, image_url = ?, genre_tags = ?, artist_id = ?, format_id = ?, barcode = ?, catalog_number = ?, label_id = ?, version = version + 1 WHERE id = ? AND version = ? AND deleted_at IS NULL`,
+		m.Title, datePublished, datePrecision, m.ImageURL, strings.Join(m.GenreTags, ","), artistID, formatID, m.Barcode, m.CatalogNumber, m.LabelID, id, version)
+	if isDuplicateEntry(err) {
+		return m, errDuplicateMedia
+	} else if err != nil {
+		return m, err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return m, err
+	} else if rows == 0 {
+		return m, errMediaModified
+	}
+	if m.Tracks != nil {
+		if err := replaceTracks(tx, id, m.Tracks); err != nil {
+			return m, err
+		}
+	}
+
+	updated, err := loadMedia(tx, id)
+	if err != nil {
+		return m, err
+	}
+	return updated, recordAudit(tx, actor, auditMedia, id, action, before, updated)
+}
+
+// trashMediaTx moves the media with the given ID to the trash as long as it
+// is still at version, recording it in the audit log
+func trashMediaTx(tx *sql.Tx, actor auditActor, id, version int) error {
+	before, err := loadMedia(tx, id)
+	if err == nil && before.DeletedAt != "" {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		return errMediaNotFound
+	} else if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`UPDATE media SET deleted_at = NOW(), version = version + 1 WHERE id = ? AND version = ? AND deleted_at IS NULL`, id, version)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return errMediaModified
+	}
+
+	after, err := loadMedia(tx, id)
+	if err != nil {
+		return err
+	}
+	return recordAudit(tx, actor, auditMedia, id, auditDelete, before, after)
+}
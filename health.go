@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Migration states reported by /readyz
+const (
+	migrationsPending  = "pending"
+	migrationsRunning  = "running"
+	migrationsComplete = "complete"
+	migrationsFailed   = "failed"
+)
+
+// readyzTimeout bounds the database ping made by /readyz
+const readyzTimeout = 2 * time.Second
+
+// startupWait is how long an API request waits for the migrations before
+// being turned away with a 503
+const startupWait = 5 * time.Second
+
+var (
+	migrationMu     sync.RWMutex
+	migrationStatus = migrationsPending
+	migrationsDone  = make(chan struct{}) // Closed once the migrations complete or fail
+)
+
+// setMigrationStatus records how far schema creation has got
+func setMigrationStatus(status string) {
+	migrationMu.Lock()
+	defer migrationMu.Unlock()
+	finished := migrationStatus == migrationsComplete || migrationStatus == migrationsFailed
+	migrationStatus = status
+	if !finished && (status == migrationsComplete || status == migrationsFailed) {
+		close(migrationsDone)
+	}
+}
+
+// getMigrationStatus returns the current schema creation state
+func getMigrationStatus() string {
+	migrationMu.RLock()
+	defer migrationMu.RUnlock()
+	return migrationStatus
+}
+
+// ReadinessReport struct holds the result of a readiness check
+type ReadinessReport struct {
+	Status     string `json:"status"`
+	Database   string `json:"database"`
+	Migrations string `json:"migrations"`
+}
+
+// healthz handles liveness checks; it succeeds whenever the process can serve requests
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyz handles readiness checks; it succeeds only when the database answers
+// and the schema is up to date
+func readyz(w http.ResponseWriter, r *http.Request) {
+	report := ReadinessReport{
+		Status:     "ready",
+		Database:   "ok",
+		Migrations: getMigrationStatus(),
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyzTimeout)
+	defer cancel()
+	// The pool is only settled once the migrations have started
+	if report.Migrations == migrationsPending || db == nil {
+		report.Database = "not connected"
+	} else if err := db.PingContext(ctx); err != nil {
+		report.Database = "unreachable"
+	}
+
+	status := http.StatusOK
+	if report.Database != "ok" || report.Migrations != migrationsComplete {
+		report.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// waitForMigrations holds API requests while the server is still connecting
+// to the database and creating the schema, for up to startupWait
+func waitForMigrations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if getMigrationStatus() != migrationsComplete {
+			timer := time.NewTimer(startupWait)
+			defer timer.Stop()
+			select {
+			case <-migrationsDone:
+			case <-timer.C:
+			case <-r.Context().Done():
+				return
+			}
+			if getMigrationStatus() != migrationsComplete {
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusServiceUnavailable, "The server is starting up")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// resetMigrationStatus puts the migrations back to pending for a test
+func resetMigrationStatus() {
+	migrationMu.Lock()
+	defer migrationMu.Unlock()
+	migrationStatus = migrationsPending
+	migrationsDone = make(chan struct{})
+}
+
+func TestReadyzBeforeMigrations(t *testing.T) {
+	resetMigrationStatus()
+	router := newRouter()
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /readyz = %d, want 503", rec.Code)
+	}
+	var report ReadinessReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrations != migrationsPending || report.Database != "not connected" {
+		t.Errorf("report = %+v", report)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /healthz = %d, want 200", rec.Code)
+	}
+}
+
+func TestWaitForMigrations(t *testing.T) {
+	tests := []struct {
+		final string
+		want  int
+	}{
+		{migrationsComplete, http.StatusNoContent},
+		{migrationsFailed, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.final, func(t *testing.T) {
+			resetMigrationStatus()
+			handler := waitForMigrations(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			done := make(chan *httptest.ResponseRecorder)
+			go func() {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/media", nil))
+				done <- rec
+			}()
+
+			setMigrationStatus(migrationsRunning)
+			select {
+			case <-done:
+				t.Fatal("request answered while the migrations were running")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			setMigrationStatus(tt.final)
+			select {
+			case rec := <-done:
+				if rec.Code != tt.want {
+					t.Errorf("status = %d, want %d", rec.Code, tt.want)
+				}
+				if tt.want == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+					t.Error("missing Retry-After")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("request still waiting after the migrations finished")
+			}
+		})
+	}
+	resetMigrationStatus()
+}
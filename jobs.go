@@ -0,0 +1,803 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Jobs are queued in the jobs table and run by a pool of workers, so a long
+// import or enrichment outlives the request that started it and a restart
+// picks up where the queue left off. A failed job is retried with backoff
+// until it has been tried max_attempts times.
+
+// Job struct holds a background job and how far it has got
+type Job struct {
+	ID              int64           `json:"id"`
+	Type            string          `json:"type"`
+	Status          string          `json:"status"` // queued, running, succeeded, failed or cancelled
+	Progress        JobProgress     `json:"progress"`
+	Attempts        int             `json:"attempts"`
+	MaxAttempts     int             `json:"max_attempts"`
+	Error           string          `json:"error,omitempty"`  // Why the last attempt failed
+	Result          json.RawMessage `json:"result,omitempty"` // Set once the job has succeeded
+	CancelRequested bool            `json:"cancel_requested,omitempty"`
+	CreatedBy       string          `json:"created_by"`
+	CreatedAt       time.Time       `json:"created_at"`
+	RunAt           *time.Time      `json:"run_at,omitempty"` // When a queued job is next due
+	StartedAt       *time.Time      `json:"started_at,omitempty"`
+	FinishedAt      *time.Time      `json:"finished_at,omitempty"`
+}
+
+// JobProgress counts the units of work a job has done out of its total, which
+// is 0 until the job knows it
+type JobProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// JobRequest struct holds a job to queue
+type JobRequest struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Job statuses
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// jobKind describes a type of job
+type jobKind struct {
+	// validate checks a payload before the job is queued
+	validate func(payload json.RawMessage) error
+	// run does the work, reporting progress through job, and should return
+	// ctx.Err() soon after ctx is cancelled. Its result is stored as JSON.
+	run func(ctx context.Context, job *jobRun) (interface{}, error)
+	// unique kinds are refused while another job of the kind is queued or running
+	unique bool
+}
+
+// jobKinds are the jobs the workers know how to run, by type
+var jobKinds = map[string]jobKind{
+	"seed":             {validate: validateSeedJob, run: runSeedJob, unique: true},
+	"import-media":     {validate: validateImportMediaJob, run: runImportMediaJob},
+	"import-users":     {validate: validateImportUsersJob, run: runImportUsersJob},
+	"enrichment":       {validate: noJobPayload, run: runEnrichmentJob, unique: true},
+	"normalize-genres": {validate: noJobPayload, run: runNormalizeGenresJob, unique: true},
+}
+
+// jobSettings control the workers; run sets them from the config
+var jobSettings = struct {
+	MaxAttempts int
+	Backoff     time.Duration
+}{MaxAttempts: 3, Backoff: 30 * time.Second}
+
+// jobHeartbeat is how often a running job's heartbeat is written and checked
+// for cancellation; jobStaleAfter is how long without one before the job is
+// presumed lost with its server and queued again
+var jobHeartbeat = 5 * time.Second
+
+const jobStaleAfter = time.Minute
+
+// maxJobBackoff caps the wait between attempts
+const maxJobBackoff = time.Hour
+
+// jobActiveKey is the expression of the jobs.active_key column: the type of a
+// queued or running job of a unique kind, and NULL otherwise. Its unique index
+// refuses a second active job of the kind without locking anything.
+const jobActiveKey = `IF(status IN ('` + jobQueued + `', '` + jobRunning + `'), unique_type, NULL)`
+
+// errJobActive is returned when queueing a unique job whose kind is already queued or running
+var errJobActive = &requestError{status: http.StatusConflict, message: "A job of this type is already queued or running"}
+
+// jobRun is a claimed job as seen by its kind's run function
+type jobRun struct {
+	id        int64
+	payload   []byte
+	actor     auditActor
+	mu        sync.Mutex
+	progress  JobProgress
+	lastWrite time.Time
+}
+
+// decode unmarshals the job's payload into v
+func (j *jobRun) decode(v interface{}) error {
+	return json.Unmarshal(j.payload, v)
+}
+
+// setProgress records how much of the job is done. It is written at most
+// once a second, and always when done reaches total.
+func (j *jobRun) setProgress(done, total int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.progress = JobProgress{Done: done, Total: total}
+	if time.Since(j.lastWrite) < time.Second && done < total {
+		return
+	}
+	j.lastWrite = time.Now()
+	_, err := db.Exec(`UPDATE jobs SET progress_done = ?, progress_total = ? WHERE id = ?`, done, total, j.id)
+	if err != nil {
+		log.Printf("Failed to record progress of job %d: %v", j.id, err)
+	}
+}
+
+// enqueueJob validates and queues a job, returning it as stored
+func enqueueJob(jobType string, payload json.RawMessage, actor auditActor) (Job, error) {
+	kind, ok := jobKinds[jobType]
+	if !ok {
+		return Job{}, &ValidationError{Fields: []FieldError{{Field: "type", Message: "must be a known job type"}}}
+	}
+	if len(payload) == 0 {
+		payload = json.RawMessage("null")
+	}
+	if err := kind.validate(payload); err != nil {
+		return Job{}, err
+	}
+
+	var uniqueType interface{}
+	if kind.unique {
+		uniqueType = jobType
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Job{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO jobs (type, payload, max_attempts, created_by, request_id, unique_type) VALUES (?, ?, ?, ?, ?, ?)`,
+		jobType, string(payload), jobSettings.MaxAttempts, actor.Name, actor.RequestID, uniqueType)
+	if isDuplicateEntry(err) {
+		return Job{}, errJobActive
+	} else if err != nil {
+		return Job{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Job{}, err
+	}
+	job, err := loadJob(tx, id)
+	if err != nil {
+		return Job{}, err
+	}
+	return job, tx.Commit()
+}
+
+const selectJobQuery = `
+    SELECT id, type, status, progress_done, progress_total, attempts, max_attempts, error,
+        IFNULL(result, ''), cancel_requested, created_by, created_at, run_at, started_at, finished_at
+    FROM jobs`
+
+// scanJob reads a single job row
+func scanJob(row rowScanner) (Job, error) {
+	var j Job
+	var result, createdAt, runAt string
+	var startedAt, finishedAt sql.NullString
+	err := row.Scan(&j.ID, &j.Type, &j.Status, &j.Progress.Done, &j.Progress.Total, &j.Attempts, &j.MaxAttempts, &j.Error,
+		&result, &j.CancelRequested, &j.CreatedBy, &createdAt, &runAt, &startedAt, &finishedAt)
+	if err != nil {
+		return j, err
+	}
+	if result != "" {
+		j.Result = json.RawMessage(result)
+	}
+	j.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
+	if j.Status == jobQueued {
+		t, _ := time.Parse("2006-01-02 15:04:05", runAt)
+		j.RunAt = &t
+	}
+	if startedAt.Valid {
+		t, _ := time.Parse("2006-01-02 15:04:05", startedAt.String)
+		j.StartedAt = &t
+	}
+	if finishedAt.Valid {
+		t, _ := time.Parse("2006-01-02 15:04:05", finishedAt.String)
+		j.FinishedAt = &t
+	}
+	return j, nil
+}
+
+// loadJob reads the job with the given ID
+func loadJob(q dbExecutor, id int64) (Job, error) {
+	return scanJob(q.QueryRow(selectJobQuery+` WHERE id = ?`, id))
+}
+
+// writeJobAccepted sends a 202 response with the job and where to poll it,
+// under the same API version as the request
+func writeJobAccepted(w http.ResponseWriter, r *http.Request, job Job) {
+	location := "/jobs/" + strconv.FormatInt(job.ID, 10)
+	if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		version := strings.SplitN(strings.TrimPrefix(r.URL.Path, apiPrefix+"/"), "/", 2)[0]
+		location = apiPrefix + "/" + version + location
+	}
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// createJob handles queueing a job
+func createJob(w http.ResponseWriter, r *http.Request) {
+	var req JobRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	job, err := enqueueJob(req.Type, req.Payload, requestActor(r))
+	if err != nil {
+		writeRequestError(w, r, "Failed to queue job", err)
+		return
+	}
+	writeJobAccepted(w, r, job)
+}
+
+// maxJobsListed caps the job list
+const maxJobsListed = 100
+
+// getJobs handles listing the most recent jobs, optionally only those with
+// the given status or type
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	where := `WHERE 1 = 1`
+	var args []interface{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		where += ` AND status = ?`
+		args = append(args, status)
+	}
+	if jobType := r.URL.Query().Get("type"); jobType != "" {
+		where += ` AND type = ?`
+		args = append(args, jobType)
+	}
+
+	rows, err := db.Query(selectJobQuery+` `+where+` ORDER BY id DESC LIMIT `+strconv.Itoa(maxJobsListed), args...)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve jobs", err)
+		return
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			writeInternalError(w, r, "Failed to scan job", err)
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		writeInternalError(w, r, "Error iterating over jobs", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// getJobById handles retrieving a job by ID, for polling its status and progress
+func getJobById(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid job ID")
+		return
+	}
+
+	job, err := loadJob(db, id)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Job not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to retrieve job", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// cancelJob handles cancelling a job. A queued job is cancelled at once; a
+// running one stops at its next heartbeat.
+func cancelJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid job ID")
+		return
+	}
+
+	_, err = db.Exec(`UPDATE jobs SET status = ?, cancel_requested = 1, finished_at = NOW() WHERE id = ? AND status = ?`,
+		jobCancelled, id, jobQueued)
+	if err == nil {
+		_, err = db.Exec(`UPDATE jobs SET cancel_requested = 1 WHERE id = ? AND status = ?`, id, jobRunning)
+	}
+	if err != nil {
+		writeInternalError(w, r, "Failed to cancel job", err)
+		return
+	}
+
+	job, err := loadJob(db, id)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Job not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to retrieve job", err)
+		return
+	}
+	if !job.CancelRequested {
+		writeError(w, r, http.StatusConflict, "Job has already finished")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// claimJob marks the next due job as running and returns it, or nil if none is due
+func claimJob() (*jobRun, string, error) {
+	for {
+		var id int64
+		var jobType, payload, createdBy, requestID string
+		err := db.QueryRow(`
+            SELECT id, type, payload, created_by, request_id FROM jobs
+            WHERE status = ? AND run_at <= NOW() AND cancel_requested = 0
+            ORDER BY run_at, id
+            LIMIT 1
+        `, jobQueued).Scan(&id, &jobType, &payload, &createdBy, &requestID)
+		if err == sql.ErrNoRows {
+			return nil, "", nil
+		} else if err != nil {
+			return nil, "", err
+		}
+
+		// Another worker may have claimed it first, in which case try the next one
+		result, err := db.Exec(`
+            UPDATE jobs SET status = ?, attempts = attempts + 1, started_at = NOW(), heartbeat_at = NOW()
+            WHERE id = ? AND status = ?
+        `, jobRunning, id, jobQueued)
+		if err != nil {
+			return nil, "", err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return nil, "", err
+		} else if n == 1 {
+			return &jobRun{id: id, payload: []byte(payload), actor: auditActor{Name: createdBy, RequestID: requestID}}, jobType, nil
+		}
+	}
+}
+
+// requeueStaleJobs gives running jobs that have stopped sending heartbeats,
+// because their server died, another attempt if they have any left and
+// weren't cancelled
+func requeueStaleJobs() error {
+	_, err := db.Exec(`
+        UPDATE jobs SET
+            finished_at = IF(cancel_requested OR attempts >= max_attempts, NOW(), NULL),
+            status = CASE WHEN cancel_requested THEN ? WHEN attempts >= max_attempts THEN ? ELSE ? END,
+            run_at = NOW(),
+            error = 'The worker running the job stopped'
+        WHERE status = ? AND heartbeat_at < DATE_SUB(NOW(), INTERVAL ? SECOND)
+    `, jobCancelled, jobFailed, jobQueued, jobRunning, int(jobStaleAfter.Seconds()))
+	return err
+}
+
+// runJob runs a claimed job and records how it ended. Stopping ctx, on
+// shutdown, puts the job back in the queue without using up an attempt.
+func runJob(ctx context.Context, job *jobRun, jobType string) error {
+	kind, ok := jobKinds[jobType]
+	if !ok {
+		_, err := db.Exec(`UPDATE jobs SET status = ?, finished_at = NOW(), error = ? WHERE id = ?`,
+			jobFailed, "Unknown job type "+jobType, job.id)
+		return err
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var cancelRequested bool
+	heartbeatDone := make(chan struct{})
+	heartbeatStopped := make(chan struct{})
+	go func() {
+		defer close(heartbeatStopped)
+		ticker := time.NewTicker(jobHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-heartbeatDone:
+				return
+			case <-ticker.C:
+			}
+			var requested bool
+			_, err := db.Exec(`UPDATE jobs SET heartbeat_at = NOW() WHERE id = ?`, job.id)
+			if err == nil {
+				err = db.QueryRow(`SELECT cancel_requested FROM jobs WHERE id = ?`, job.id).Scan(&requested)
+			}
+			if err != nil {
+				log.Printf("Failed to record heartbeat of job %d: %v", job.id, err)
+			} else if requested {
+				cancelRequested = true
+				cancel()
+				return
+			}
+		}
+	}()
+
+	result, runErr := kind.run(jobCtx, job)
+	close(heartbeatDone)
+	<-heartbeatStopped
+
+	switch {
+	case runErr == nil:
+		resultJSON, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		jobsFinishedTotal.inc(jobType, jobSucceeded)
+		_, err = db.Exec(`UPDATE jobs SET status = ?, result = ?, error = '', finished_at = NOW() WHERE id = ?`,
+			jobSucceeded, string(resultJSON), job.id)
+		return err
+	case cancelRequested:
+		jobsFinishedTotal.inc(jobType, jobCancelled)
+		_, err := db.Exec(`UPDATE jobs SET status = ?, finished_at = NOW() WHERE id = ?`, jobCancelled, job.id)
+		return err
+	case ctx.Err() != nil:
+		_, err := db.Exec(`
+            UPDATE jobs SET
+                finished_at = IF(cancel_requested, NOW(), NULL),
+                status = IF(cancel_requested, ?, ?),
+                attempts = attempts - 1,
+                run_at = NOW()
+            WHERE id = ?
+        `, jobCancelled, jobQueued, job.id)
+		return err
+	}
+
+	message := runErr.Error()
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	var attempts, maxAttempts int
+	err := db.QueryRow(`SELECT attempts, max_attempts, cancel_requested FROM jobs WHERE id = ?`, job.id).Scan(&attempts, &maxAttempts, &cancelRequested)
+	if err != nil {
+		return err
+	}
+	if cancelRequested {
+		// Cancelled before the heartbeat noticed; don't retry it
+		jobsFinishedTotal.inc(jobType, jobCancelled)
+		_, err = db.Exec(`UPDATE jobs SET status = ?, error = ?, finished_at = NOW() WHERE id = ?`, jobCancelled, message, job.id)
+		return err
+	}
+	if attempts >= maxAttempts {
+		jobsFinishedTotal.inc(jobType, jobFailed)
+		log.Printf("Job %d (%s) failed %d times, giving up: %v", job.id, jobType, attempts, runErr)
+		_, err = db.Exec(`UPDATE jobs SET status = ?, error = ?, finished_at = NOW() WHERE id = ?`, jobFailed, message, job.id)
+		return err
+	}
+	log.Printf("Job %d (%s) failed, retrying: %v", job.id, jobType, runErr)
+	_, err = db.Exec(`UPDATE jobs SET status = ?, error = ?, run_at = DATE_ADD(NOW(), INTERVAL ? SECOND) WHERE id = ?`,
+		jobQueued, message, int(jobBackoff(attempts-1).Seconds()), job.id)
+	return err
+}
+
+// jobBackoff returns how long to wait after the given number of earlier
+// failed attempts: the configured backoff, doubling each time. It counts
+// attempts as webhookBackoff does, so the first retry waits the backoff.
+func jobBackoff(attempts int) time.Duration {
+	backoff := jobSettings.Backoff
+	for i := 0; i < attempts && backoff < maxJobBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxJobBackoff {
+		backoff = maxJobBackoff
+	}
+	return backoff
+}
+
+// startJobWorkers runs queued jobs on the given number of workers, checking
+// for new ones every interval, until the returned stop function is called.
+// Jobs still running then are queued again for the next start.
+func startJobWorkers(workers int, interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				// The first worker also looks for jobs lost with another server
+				if worker == 0 {
+					if err := requeueStaleJobs(); err != nil {
+						log.Printf("Failed to requeue stale jobs: %v", err)
+					}
+				}
+				job, jobType, err := claimJob()
+				if err != nil {
+					log.Printf("Failed to claim a job: %v", err)
+				} else if job != nil {
+					if err := runJob(ctx, job, jobType); err != nil {
+						log.Printf("Failed to record the outcome of job %d: %v", job.id, err)
+					}
+					if ctx.Err() == nil {
+						continue
+					}
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(i)
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// noJobPayload accepts jobs that take no payload
+func noJobPayload(payload json.RawMessage) error {
+	return nil
+}
+
+// seedJobPayload names the profile a seed job applies
+type seedJobPayload struct {
+	Profile string `json:"profile"`
+	Force   bool   `json:"force"`
+}
+
+// validateSeedJob checks that a seed job names a known profile
+func validateSeedJob(payload json.RawMessage) error {
+	var p seedJobPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return &requestError{status: http.StatusBadRequest, message: "Invalid payload: " + err.Error()}
+	}
+	if _, ok := seedProfiles[p.Profile]; !ok {
+		return &ValidationError{Fields: []FieldError{{Field: "payload.profile", Message: "must be a known seed profile"}}}
+	}
+	return nil
+}
+
+// runSeedJob applies a seed profile
+func runSeedJob(ctx context.Context, job *jobRun) (interface{}, error) {
+	var p seedJobPayload
+	if err := job.decode(&p); err != nil {
+		return nil, err
+	}
+	return nil, seed(ctx, p.Profile, p.Force, job.setProgress)
+}
+
+// importMediaJobPayload lists the media an import job adds
+type importMediaJobPayload struct {
+	Media []Media `json:"media"`
+}
+
+// importBatchSize is how many media an import job adds between progress updates
+const importBatchSize = 100
+
+// validateImportMediaJob checks that an import job has media to add; each
+// media is validated as it is imported, and invalid ones are skipped
+func validateImportMediaJob(payload json.RawMessage) error {
+	var p importMediaJobPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return &requestError{status: http.StatusBadRequest, message: "Invalid payload: " + err.Error()}
+	}
+	if len(p.Media) == 0 {
+		return &ValidationError{Fields: []FieldError{{Field: "payload.media", Message: "is required"}}}
+	}
+	return nil
+}
+
+// runImportMediaJob adds media in batches, as the seed files do, on behalf of
+// whoever queued the job. Media imported by an earlier attempt are skipped as
+// duplicates.
+func runImportMediaJob(ctx context.Context, job *jobRun) (interface{}, error) {
+	var p importMediaJobPayload
+	if err := job.decode(&p); err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(p.Media); start += importBatchSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		job.setProgress(start, len(p.Media))
+		end := start + importBatchSize
+		if end > len(p.Media) {
+			end = len(p.Media)
+		}
+		if err := importMedia(job.actor, p.Media[start:end]); err != nil {
+			return nil, err
+		}
+	}
+	job.setProgress(len(p.Media), len(p.Media))
+	return nil, nil
+}
+
+// importUsersJobPayload lists the users an import job adds
+type importUsersJobPayload struct {
+	Users []User `json:"users"`
+}
+
+// validateImportUsersJob checks every user of an import job before it is
+// queued, so a bad row refuses the whole import
+func validateImportUsersJob(payload json.RawMessage) error {
+	var p importUsersJobPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return &requestError{status: http.StatusBadRequest, message: "Invalid payload: " + err.Error()}
+	}
+	if len(p.Users) == 0 {
+		return &ValidationError{Fields: []FieldError{{Field: "payload.users", Message: "is required"}}}
+	}
+	var fields []FieldError
+	for i := range p.Users {
+		var invalid *ValidationError
+		if errors.As(p.Users[i].Validate(), &invalid) {
+			for _, f := range invalid.Fields {
+				fields = append(fields, FieldError{Field: fmt.Sprintf("payload.users[%d].%s", i, f.Field), Message: f.Message})
+			}
+		}
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// runImportUsersJob adds users in batches. Users whose username is taken,
+// including those imported by an earlier attempt, are skipped.
+func runImportUsersJob(ctx context.Context, job *jobRun) (interface{}, error) {
+	var p importUsersJobPayload
+	if err := job.decode(&p); err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(p.Users); start += importBatchSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		job.setProgress(start, len(p.Users))
+		end := start + importBatchSize
+		if end > len(p.Users) {
+			end = len(p.Users)
+		}
+		if err := importUsers(p.Users[start:end]); err != nil {
+			return nil, err
+		}
+	}
+	job.setProgress(len(p.Users), len(p.Users))
+	return nil, nil
+}
+
+// importUsers validates and inserts users in one transaction, skipping taken usernames
+func importUsers(users []User) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, u := range users {
+		_, err := insertUserTx(tx, u)
+		if err == errUsernameTaken {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to import user %q: %v", u.Username, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// runEnrichmentJob looks up missing metadata and queues reviews of it
+func runEnrichmentJob(ctx context.Context, job *jobRun) (interface{}, error) {
+	if metadataProvider == nil {
+		return nil, fmt.Errorf("no metadata provider configured")
+	}
+	queued, err := enrichCatalog(ctx, metadataProvider, job.setProgress)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"reviews_queued": queued}, nil
+}
+
+// runNormalizeGenresJob rewrites the genre tags of every media through the
+// genre mappings, so tags added before a mapping existed are brought in line.
+// Media changed by someone else while the job runs are left for the next run.
+func runNormalizeGenresJob(ctx context.Context, job *jobRun) (interface{}, error) {
+	rows, err := db.Query(`SELECT id FROM media WHERE deleted_at IS NULL AND IFNULL(genre_tags, '') <> '' ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	updated, skipped := 0, 0
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		job.setProgress(i, len(ids))
+		changed, err := normalizeMediaGenres(job.actor, id)
+		if err == errMediaModified || err == errMediaNotFound {
+			skipped++
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("media %d: %v", id, err)
+		}
+		if changed {
+			updated++
+		}
+	}
+	job.setProgress(len(ids), len(ids))
+	return map[string]int{"updated": updated, "skipped": skipped}, nil
+}
+
+// normalizeMediaGenres maps the genre tags of one media, dropping tags that
+// map to one it already has, and reports whether anything changed
+func normalizeMediaGenres(actor auditActor, id int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	m, err := loadMedia(tx, id)
+	if err == sql.ErrNoRows {
+		return false, errMediaNotFound
+	} else if err != nil {
+		return false, err
+	}
+
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range m.GenreTags {
+		normalized, err := NormalizeGenre(tx, tag)
+		if err != nil {
+			return false, err
+		}
+		if !seen[normalized] {
+			seen[normalized] = true
+			tags = append(tags, normalized)
+		}
+	}
+	if strings.Join(tags, ",") == strings.Join(m.GenreTags, ",") {
+		return false, nil
+	}
+
+	m.GenreTags = tags
+	m.Tracks = nil
+	if _, err := updateMediaTx(tx, actor, id, m, m.Version, auditUpdate); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
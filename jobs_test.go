@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJobBackoff(t *testing.T) {
+	saved := jobSettings
+	defer func() { jobSettings = saved }()
+	jobSettings.Backoff = 30 * time.Second
+
+	// Like webhookBackoff, attempts counts the failures before the latest one
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, maxJobBackoff},
+		{100, maxJobBackoff},
+	}
+	for _, tt := range tests {
+		if got := jobBackoff(tt.attempts); got != tt.want {
+			t.Errorf("jobBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+		if got := webhookBackoff(tt.attempts); tt.attempts < 7 && got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v like jobBackoff", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// TestJobRunner runs jobs of test kinds against the scratch database named
+// by RECORD_TEST_DB_NAME
+func TestJobRunner(t *testing.T) {
+	openTestDB(t)
+
+	savedSettings, savedHeartbeat := jobSettings, jobHeartbeat
+	jobSettings.MaxAttempts = 2
+	jobHeartbeat = 50 * time.Millisecond
+	waitForCancel := func(ctx context.Context, job *jobRun) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	jobKinds["test-wait"] = jobKind{validate: noJobPayload, run: waitForCancel}
+	jobKinds["test-unique"] = jobKind{validate: noJobPayload, run: waitForCancel, unique: true}
+	jobKinds["test-fail"] = jobKind{validate: noJobPayload, run: func(ctx context.Context, job *jobRun) (interface{}, error) {
+		return nil, errors.New("the record player is on fire")
+	}}
+	finishTestJobs := func() {
+		_, err := db.Exec(`UPDATE jobs SET status = ?, finished_at = NOW() WHERE type LIKE 'test-%' AND status IN (?, ?)`,
+			jobCancelled, jobQueued, jobRunning)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	finishTestJobs()
+	t.Cleanup(func() {
+		finishTestJobs()
+		delete(jobKinds, "test-wait")
+		delete(jobKinds, "test-unique")
+		delete(jobKinds, "test-fail")
+		jobSettings, jobHeartbeat = savedSettings, savedHeartbeat
+	})
+
+	actor := auditActor{Name: "tester"}
+	router := newRouter()
+	cancel := func(id int64) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", fmt.Sprintf("/api/v1/jobs/%d/cancel", id), nil))
+		return rec.Code
+	}
+	enqueue := func(jobType string) Job {
+		t.Helper()
+		job, err := enqueueJob(jobType, nil, actor)
+		if err != nil {
+			t.Fatalf("enqueueJob(%s): %v", jobType, err)
+		}
+		return job
+	}
+	// start claims a job as claimJob does, whatever else is queued
+	start := func(id int64) *jobRun {
+		t.Helper()
+		result, err := db.Exec(`UPDATE jobs SET status = ?, attempts = attempts + 1, started_at = NOW(), heartbeat_at = NOW() WHERE id = ? AND status = ?`,
+			jobRunning, id, jobQueued)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := result.RowsAffected(); n != 1 {
+			t.Fatalf("job %d was not queued", id)
+		}
+		return &jobRun{id: id, payload: []byte("null"), actor: actor}
+	}
+	// run runs a started job in the background; wait returns once it has ended
+	run := func(ctx context.Context, job *jobRun, jobType string) (wait func()) {
+		done := make(chan error, 1)
+		go func() { done <- runJob(ctx, job, jobType) }()
+		return func() {
+			t.Helper()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("runJob: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("job did not stop")
+			}
+		}
+	}
+	load := func(id int64) Job {
+		t.Helper()
+		job, err := loadJob(db, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+
+	t.Run("cancel queued", func(t *testing.T) {
+		job := enqueue("test-wait")
+		if code := cancel(job.ID); code != http.StatusAccepted {
+			t.Fatalf("cancel = %d, want 202", code)
+		}
+		if job = load(job.ID); job.Status != jobCancelled || job.FinishedAt == nil || job.Attempts != 0 {
+			t.Errorf("job = %s after %d attempts, finished %v; want cancelled without running", job.Status, job.Attempts, job.FinishedAt)
+		}
+		if code := cancel(job.ID); code != http.StatusConflict {
+			t.Errorf("second cancel = %d, want 409", code)
+		}
+	})
+
+	t.Run("cancel running", func(t *testing.T) {
+		job := enqueue("test-wait")
+		wait := run(context.Background(), start(job.ID), "test-wait")
+		if code := cancel(job.ID); code != http.StatusAccepted {
+			t.Fatalf("cancel = %d, want 202", code)
+		}
+		// The job stops at its next heartbeat
+		wait()
+		if job = load(job.ID); job.Status != jobCancelled || job.FinishedAt == nil {
+			t.Errorf("job = %s, finished %v; want cancelled", job.Status, job.FinishedAt)
+		}
+	})
+
+	t.Run("requeue on shutdown", func(t *testing.T) {
+		job := enqueue("test-wait")
+		ctx, shutdown := context.WithCancel(context.Background())
+		wait := run(ctx, start(job.ID), "test-wait")
+		shutdown()
+		wait()
+		if job = load(job.ID); job.Status != jobQueued || job.Attempts != 0 || job.FinishedAt != nil {
+			t.Errorf("job = %s after %d attempts; want queued again without using an attempt", job.Status, job.Attempts)
+		}
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		job := enqueue("test-fail")
+		run(context.Background(), start(job.ID), "test-fail")()
+		job = load(job.ID)
+		if job.Status != jobQueued || job.Attempts != 1 || job.Error != "the record player is on fire" {
+			t.Fatalf("job = %s after %d attempts (%q); want queued for a retry", job.Status, job.Attempts, job.Error)
+		}
+		if job.RunAt == nil || job.RunAt.Before(job.CreatedAt.Add(jobSettings.Backoff-time.Second)) {
+			t.Errorf("retry at %v, want a backoff of %v after %v", job.RunAt, jobSettings.Backoff, job.CreatedAt)
+		}
+
+		run(context.Background(), start(job.ID), "test-fail")()
+		if job = load(job.ID); job.Status != jobFailed || job.Attempts != 2 || job.FinishedAt == nil {
+			t.Errorf("job = %s after %d attempts; want failed after 2", job.Status, job.Attempts)
+		}
+	})
+
+	t.Run("one active unique job", func(t *testing.T) {
+		first := enqueue("test-unique")
+		if _, err := enqueueJob("test-unique", nil, actor); err != errJobActive {
+			t.Fatalf("second queued unique job: err = %v, want errJobActive", err)
+		}
+		wait := run(context.Background(), start(first.ID), "test-unique")
+		if _, err := enqueueJob("test-unique", nil, actor); err != errJobActive {
+			t.Errorf("unique job while one runs: err = %v, want errJobActive", err)
+		}
+		enqueue("test-wait")
+		enqueue("test-wait")
+
+		cancel(first.ID)
+		wait()
+		enqueue("test-unique")
+	})
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// resolveLabelID finds a label by name, creating it on behalf of actor if
+// needed, or failing that by the longest catalog number prefix that matches.
+// It returns nil if neither a name nor a matching prefix is available.
+func resolveLabelID(q dbExecutor, actor auditActor, name, catalogNumber string) (*int, error) {
+	var labelID int
+	if name != "" {
+		err := q.QueryRow(`SELECT id FROM labels WHERE name = ?`, name).Scan(&labelID)
+		if err == sql.ErrNoRows {
+			result, err := q.Exec(`INSERT INTO labels (name) VALUES (?)`, name)
+			if err != nil {
+				return nil, err
+			}
+			id, err := result.LastInsertId()
+			if err != nil {
+				return nil, err
+			}
+			labelID = int(id)
+			created, err := loadLabel(q, labelID)
+			if err == nil {
+				err = recordAudit(q, actor, auditLabel, labelID, auditCreate, nil, created)
+			}
+			if err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		return &labelID, nil
+	}
+
+	if catalogNumber == "" {
+		return nil, nil
+	}
+	err := q.QueryRow(`
+        SELECT label_id FROM label_catalog_prefixes
+        WHERE ? LIKE CONCAT(prefix, '%')
+        ORDER BY LENGTH(prefix) DESC
+        LIMIT 1
+    `, catalogNumber).Scan(&labelID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &labelID, nil
+}
+
+// errLabelParentNotFound is returned when a label's parent_id doesn't exist
+var errLabelParentNotFound = &requestError{http.StatusBadRequest, "Parent label not found"}
+
+// errLabelCycle is returned when a label would become a sub-label of itself
+var errLabelCycle = &requestError{http.StatusBadRequest, "Parent label would create a cycle"}
+
+// labelFamily returns the given label ID followed by the IDs of all its sub-labels, at any depth
+func labelFamily(q dbExecutor, labelID int) ([]int, error) {
+	rows, err := q.Query(`SELECT id, parent_id FROM labels WHERE parent_id IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	children := map[int][]int{}
+	for rows.Next() {
+		var id, parentID int
+		if err := rows.Scan(&id, &parentID); err != nil {
+			return nil, err
+		}
+		children[parentID] = append(children[parentID], id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	family := []int{labelID}
+	seen := map[int]bool{labelID: true}
+	for i := 0; i < len(family); i++ {
+		for _, child := range children[family[i]] {
+			if !seen[child] {
+				seen[child] = true
+				family = append(family, child)
+			}
+		}
+	}
+	return family, nil
+}
+
+// loadLabels returns labels matching the optional WHERE clause, with their prefixes and sub-labels filled in
+func loadLabels(q dbExecutor, where string, args ...interface{}) ([]Label, error) {
+	rows, err := q.Query(`SELECT id, name, parent_id FROM labels `+where+` ORDER BY name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []Label{}
+	index := map[int]int{}
+	for rows.Next() {
+		var l Label
+		var parentID sql.NullInt64
+		if err := rows.Scan(&l.ID, &l.Name, &parentID); err != nil {
+			return nil, err
+		}
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			l.ParentID = &id
+		}
+		l.CatalogPrefixes = []string{}
+		l.SublabelIDs = []int{}
+		index[l.ID] = len(labels)
+		labels = append(labels, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	prefixRows, err := q.Query(`SELECT label_id, prefix FROM label_catalog_prefixes ORDER BY prefix`)
+	if err != nil {
+		return nil, err
+	}
+	defer prefixRows.Close()
+	for prefixRows.Next() {
+		var labelID int
+		var prefix string
+		if err := prefixRows.Scan(&labelID, &prefix); err != nil {
+			return nil, err
+		}
+		if i, ok := index[labelID]; ok {
+			labels[i].CatalogPrefixes = append(labels[i].CatalogPrefixes, prefix)
+		}
+	}
+	if err := prefixRows.Err(); err != nil {
+		return nil, err
+	}
+
+	childRows, err := q.Query(`SELECT id, parent_id FROM labels WHERE parent_id IS NOT NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer childRows.Close()
+	for childRows.Next() {
+		var id, parentID int
+		if err := childRows.Scan(&id, &parentID); err != nil {
+			return nil, err
+		}
+		if i, ok := index[parentID]; ok {
+			labels[i].SublabelIDs = append(labels[i].SublabelIDs, id)
+		}
+	}
+	return labels, childRows.Err()
+}
+
+// loadLabel returns a label by ID, or sql.ErrNoRows if there is none
+func loadLabel(q dbExecutor, id int) (Label, error) {
+	labels, err := loadLabels(q, `WHERE id = ?`, id)
+	if err != nil {
+		return Label{}, err
+	}
+	if len(labels) == 0 {
+		return Label{}, sql.ErrNoRows
+	}
+	return labels[0], nil
+}
+
+// checkLabelParentTx checks within tx that a label's parent exists and
+// that the label isn't the parent or an ancestor of it
+func checkLabelParentTx(tx *sql.Tx, id int, parentID int) error {
+	var exists int
+	err := tx.QueryRow(`SELECT id FROM labels WHERE id = ? LOCK IN SHARE MODE`, parentID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return errLabelParentNotFound
+	} else if err != nil {
+		return err
+	}
+
+	family, err := labelFamily(tx, id)
+	if err != nil {
+		return err
+	}
+	for _, familyID := range family {
+		if familyID == parentID {
+			return errLabelCycle
+		}
+	}
+	return nil
+}
+
+// saveLabelTx writes a label's parent and catalog prefixes within tx
+func saveLabelTx(tx *sql.Tx, id int, l Label) error {
+	if l.ParentID != nil {
+		if err := checkLabelParentTx(tx, id, *l.ParentID); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`UPDATE labels SET name = ?, parent_id = ? WHERE id = ?`, l.Name, l.ParentID, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM label_catalog_prefixes WHERE label_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range l.CatalogPrefixes {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		_, err = tx.Exec(`INSERT IGNORE INTO label_catalog_prefixes (label_id, prefix) VALUES (?, ?)`, id, prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateLabelTx writes l over the label with the given ID within tx and
+// records action in the audit log. It returns sql.ErrNoRows if there is no
+// such label.
+func updateLabelTx(tx *sql.Tx, actor auditActor, id int, l Label, action string) (Label, error) {
+	before, err := loadLabel(tx, id)
+	if err != nil {
+		return l, err
+	}
+	if err := saveLabelTx(tx, id, l); err != nil {
+		return l, err
+	}
+	after, err := loadLabel(tx, id)
+	if err != nil {
+		return l, err
+	}
+	return after, recordAudit(tx, actor, auditLabel, id, action, before, after)
+}
+
+// getLabels handles retrieving all labels
+func getLabels(w http.ResponseWriter, r *http.Request) {
+	labels, err := loadLabels(db, "")
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve labels", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labels)
+}
+
+// getLabelById handles retrieving a label by ID
+func getLabelById(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid label ID")
+		return
+	}
+
+	l, err := loadLabel(db, id)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Label not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to retrieve label", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
+
+// createLabel handles the creation of a new label
+func createLabel(w http.ResponseWriter, r *http.Request) {
+	var l Label
+	err := json.NewDecoder(r.Body).Decode(&l)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if err := l.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to create label", err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO labels (name) VALUES (?)`, l.Name)
+	if err != nil {
+		writeInternalError(w, r, "Failed to create label", err)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err == nil {
+		err = saveLabelTx(tx, int(id), l)
+	}
+	if err == nil {
+		var created Label
+		created, err = loadLabel(tx, int(id))
+		if err == nil {
+			err = recordAudit(tx, requestActor(r), auditLabel, int(id), auditCreate, nil, created)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeRequestError(w, r, "Failed to create label", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// updateLabel handles updating an existing label by ID
+func updateLabel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid label ID")
+		return
+	}
+
+	var l Label
+	err = json.NewDecoder(r.Body).Decode(&l)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if err := l.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to update label", err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = updateLabelTx(tx, requestActor(r), id, l, auditUpdate)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Label not found")
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeRequestError(w, r, "Failed to update label", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// revertLabel handles restoring a label's name, parent and catalog prefixes
+// to the state recorded by one of its audit entries. The revert is itself
+// recorded in the audit log.
+func revertLabel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid label ID")
+		return
+	}
+
+	var l Label
+	if !loadRevertState(w, r, auditLabel, "label", id, &l) {
+		return
+	}
+	if err := l.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to revert label", err)
+		return
+	}
+	defer tx.Rollback()
+
+	updated, err := updateLabelTx(tx, requestActor(r), id, l, auditRevert)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Label not found")
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeRequestError(w, r, "Failed to revert label", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// getLabelDiscography handles retrieving the media released on a label and its sub-labels, oldest first
+func getLabelDiscography(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid label ID")
+		return
+	}
+
+	var exists int
+	err = db.QueryRow(`SELECT id FROM labels WHERE id = ?`, id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Label not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to retrieve label", err)
+		return
+	}
+
+	labelIDs, err := labelFamily(db, id)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve labels", err)
+		return
+	}
+	args := make([]interface{}, len(labelIDs))
+	for i, labelID := range labelIDs {
+		args[i] = labelID
+	}
+
+	rows, err := db.Query(selectMediaQuery+` WHERE m.label_id IN (?`+strings.Repeat(`, ?`, len(labelIDs)-1)+`) AND `+notTrashed+` ORDER BY `+releaseDateOrder+`, m.title`, args...)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve media", err)
+		return
+	}
+	defer rows.Close()
+
+	media := []Media{}
+	for rows.Next() {
+		m, err := scanMedia(rows)
+		if err != nil {
+			writeInternalError(w, r, "Failed to scan media", err)
+			return
+		}
+		media = append(media, m)
+	}
+	if err := rows.Err(); err != nil {
+		writeInternalError(w, r, "Error iterating over media", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(media)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// bodyLimits cap the size of request bodies; run sets them from the config
+var bodyLimits = struct {
+	MaxBytes       int64
+	MaxImportBytes int64
+}{MaxBytes: 1 << 20, MaxImportBytes: 32 << 20}
+
+// unlimitedPaths are probed by load balancers and scrapers and never rate limited
+var unlimitedPaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// importRoutes accept large uploads, so they get max_import_body_bytes rather
+// than max_body_bytes. Paths are relative to the API version.
+var importRoutes = map[string]bool{"/media/bulk": true, "/jobs": true}
+
+// tokenBucket holds the tokens left for one client and when it was last refilled
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a set of token buckets, one per client key, that refill at
+// rate tokens per second up to burst
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMinute requests a minute with
+// bursts of up to burst, or nil if perMinute is zero
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token for key. If there is none it returns false and how long
+// until one is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets buckets that have refilled completely, which behave the same
+// as new ones, at most once a minute
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the address of the client connection
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitUser returns the key of the per-user bucket: the user named by
+// X-User, as recorded in the audit log, or the client's address for anonymous
+// requests. The two are prefixed so an address can't be claimed as a name.
+func rateLimitUser(r *http.Request) string {
+	if actor := requestActor(r); actor.Name != "anonymous" {
+		return "user:" + actor.Name
+	}
+	return "ip:" + clientIP(r)
+}
+
+// withRateLimit rejects requests once the client's IP address, or the user
+// making them, has used up its tokens. A nil limiter disables that check.
+func withRateLimit(perIP, perUser *rateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if unlimitedPaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if perIP != nil {
+				if ok, wait := perIP.allow(clientIP(r)); !ok {
+					tooManyRequests(w, r, "ip", wait)
+					return
+				}
+			}
+			if perUser != nil {
+				if ok, wait := perUser.allow(rateLimitUser(r)); !ok {
+					tooManyRequests(w, r, "user", wait)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// tooManyRequests sends a 429 response telling the client when to retry
+func tooManyRequests(w http.ResponseWriter, r *http.Request, limit string, wait time.Duration) {
+	rateLimitedTotal.inc(limit)
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, r, http.StatusTooManyRequests, "Rate limit exceeded; retry after the number of seconds in Retry-After")
+}
+
+// limitBody is router middleware that caps the size of request bodies at
+// bodyLimits.MaxBytes, or MaxImportBytes on import routes. Bodies declared too
+// large are rejected up front; others fail to decode once they pass the limit,
+// which writeBodyError reports as a 413.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := bodyLimits.MaxBytes
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil && importRoutes[versionRelativePath(template)] {
+				limit = bodyLimits.MaxImportBytes
+			}
+		}
+		if r.ContentLength > limit {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "Request body is larger than "+strconv.FormatInt(limit, 10)+" bytes")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errBodyTooLarge is the message of the error http.MaxBytesReader returns once
+// a body passes its limit
+const errBodyTooLarge = "http: request body too large"
+
+// bodyTooLarge reports whether reading a request body failed because it passed the limit
+func bodyTooLarge(err error) bool {
+	return err != nil && err.Error() == errBodyTooLarge
+}
+
+// writeBodyError sends a 413 if decoding a request body failed because it
+// passed the limit, or a 400 for any other problem with it
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	if bodyTooLarge(err) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "Request body is larger than the limit")
+		return
+	}
+	writeError(w, r, http.StatusBadRequest, "Invalid request body: "+err.Error())
+}
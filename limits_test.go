@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// chunkedBody hides the length of a reader so the request streams without a Content-Length
+type chunkedBody struct{ io.Reader }
+
+func TestStreamedBodyOverLimit(t *testing.T) {
+	saved := bodyLimits
+	defer func() { bodyLimits = saved }()
+	bodyLimits.MaxBytes = 16
+	setMigrationStatus(migrationsComplete)
+	defer resetMigrationStatus()
+	router := newRouter()
+
+	for _, target := range []string{"/api/v1/artists", "/api/v1/graphql"} {
+		req := httptest.NewRequest("POST", target, chunkedBody{strings.NewReader(`{"name": "` + strings.Repeat("a", 64) + `"}`)})
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("POST %s with a streamed body over the limit = %d, want 413", target, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/artists", strings.NewReader("{")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("POST with a broken body = %d, want 400", rec.Code)
+	}
+}
+
+func TestRateLimitPerUser(t *testing.T) {
+	limit := withRateLimit(nil, newRateLimiter(60, 1))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	send := func(addr, user string) int {
+		req := httptest.NewRequest("GET", "/api/v1/media", nil)
+		req.RemoteAddr = addr
+		req.Header.Set(actorHeader, user)
+		rec := httptest.NewRecorder()
+		limit.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name string
+		addr string
+		user string
+		want int
+	}{
+		{"first request", "192.0.2.1:1000", "alice", http.StatusNoContent},
+		{"same user from another address", "192.0.2.2:1000", "alice", http.StatusTooManyRequests},
+		{"same user with padding", "192.0.2.1:1001", " alice ", http.StatusTooManyRequests},
+		{"another user from the same address", "192.0.2.1:1002", "bob", http.StatusNoContent},
+		{"anonymous", "192.0.2.1:1003", "", http.StatusNoContent},
+		{"anonymous from the same address", "192.0.2.1:1004", "", http.StatusTooManyRequests},
+		{"anonymous from another address", "192.0.2.3:1000", "", http.StatusNoContent},
+		{"user named like an address", "192.0.2.4:1000", "192.0.2.3", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if code := send(tt.addr, tt.user); code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrReleaseNotFound is returned by a MetadataProvider when it has no match
+var ErrReleaseNotFound = errors.New("release not found")
+
+// MetadataProvider looks up release metadata from an external catalog.
+// Implementations return a Media draft with ArtistName and FormatName filled
+// in; IDs are resolved against our own tables by the caller.
+type MetadataProvider interface {
+	Name() string
+	LookupBarcode(barcode string) (*Media, error)
+	LookupCatalogNumber(catalogNumber string) (*Media, error)
+	LookupRelease(artist, title string) (*Media, error)
+}
+
+// metadataProvider is the external provider consulted by lookupMedia, nil if none is configured
+var metadataProvider MetadataProvider
+
+// LookupResult holds a media draft and where it was found
+type LookupResult struct {
+	Source string `json:"source"`
+	Media  Media  `json:"media"`
+}
+
+// normalizeBarcode strips the spaces and dashes commonly printed in UPC/EAN codes
+func normalizeBarcode(barcode string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(barcode))
+}
+
+// findMediaByCode searches the catalog for media with the given barcode or,
+// failing that, the given catalog number
+func findMediaByCode(barcode, catalogNumber string) (*Media, error) {
+	for _, code := range []struct{ column, value string }{{"barcode", barcode}, {"catalog_number", catalogNumber}} {
+		if code.value == "" {
+			continue
+		}
+		m, err := scanMedia(db.QueryRow(selectMediaQuery+` WHERE m.`+code.column+` = ? AND `+notTrashed+` LIMIT 1`, code.value))
+		if err == nil {
+			return &m, nil
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// lookupProvider asks the configured provider for a release and resolves the
+// artist and format names in the draft to existing IDs where possible
+func lookupProvider(barcode, catalogNumber string) (*Media, error) {
+	var m *Media
+	var err error
+	if barcode != "" {
+		m, err = metadataProvider.LookupBarcode(barcode)
+	}
+	if catalogNumber != "" && (barcode == "" || err == ErrReleaseNotFound) {
+		m, err = metadataProvider.LookupCatalogNumber(catalogNumber)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.ID = 0
+	if m.Barcode == "" {
+		m.Barcode = barcode
+	}
+	if m.CatalogNumber == "" {
+		m.CatalogNumber = catalogNumber
+	}
+
+	m.ArtistID, err = resolveArtistID(db, m.ArtistName)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	err = db.QueryRow(`SELECT id FROM formats WHERE name = ?`, m.FormatName).Scan(&m.FormatID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return m, nil
+}
+
+// lookupMedia handles looking up a media draft by barcode or catalog number.
+// Our own catalog is checked first, then the external metadata provider. When
+// both codes are given, each source is asked by barcode and then by catalog
+// number.
+func lookupMedia(w http.ResponseWriter, r *http.Request) {
+	barcode := normalizeBarcode(r.URL.Query().Get("barcode"))
+	catalogNumber := strings.TrimSpace(r.URL.Query().Get("catalog_number"))
+	if barcode == "" && catalogNumber == "" {
+		writeError(w, r, http.StatusBadRequest, "barcode or catalog_number is required")
+		return
+	}
+
+	m, err := findMediaByCode(barcode, catalogNumber)
+	if err != nil {
+		writeInternalError(w, r, "Failed to search catalog", err)
+		return
+	}
+	result := LookupResult{Source: "catalog"}
+
+	if m == nil {
+		if metadataProvider == nil {
+			writeError(w, r, http.StatusNotFound, "Media not found")
+			return
+		}
+		m, err = lookupProvider(barcode, catalogNumber)
+		if err == ErrReleaseNotFound {
+			writeError(w, r, http.StatusNotFound, "Media not found")
+			return
+		} else if err != nil {
+			logError(r, "Failed to look up media", err)
+			writeError(w, r, http.StatusBadGateway, "Failed to look up media")
+			return
+		}
+		result.Source = metadataProvider.Name()
+	}
+	result.Media = *m
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
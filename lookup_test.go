@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestLookupMedia looks media up in the scratch database named by
+// RECORD_TEST_DB_NAME, and then in a fake provider
+func TestLookupMedia(t *testing.T) {
+	openTestDB(t)
+	saved := metadataProvider
+	defer func() { metadataProvider = saved }()
+
+	suffix := time.Now().UnixNano() % 1e12
+	barcode := fmt.Sprintf("9%012d", suffix)
+	otherBarcode := fmt.Sprintf("8%012d", suffix)
+	catalogNumber := fmt.Sprintf("LOOKUP %d", suffix)
+	providedCatalogNumber := fmt.Sprintf("PROVIDED %d", suffix)
+	artistName := fmt.Sprintf("Lookup Artist %d", suffix)
+
+	result, err := db.Exec(`INSERT INTO artists (name, sort_name) VALUES (?, ?)`, artistName, artistName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	artistID, _ := result.LastInsertId()
+	result, err = db.Exec(`INSERT INTO formats (name, description) VALUES (?, '')`, "Lookup LP "+catalogNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatID, _ := result.LastInsertId()
+	result, err = db.Exec(`INSERT INTO media (title, artist_id, format_id, barcode, catalog_number) VALUES (?, ?, ?, ?, ?)`,
+		"In the Catalog", artistID, formatID, barcode, catalogNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaID, _ := result.LastInsertId()
+
+	provider := &fakeProvider{releases: map[string]*Media{
+		"barcode:" + otherBarcode:        {Title: "From the Provider", ArtistName: artistName, FormatName: "No Such Format"},
+		"catno:" + providedCatalogNumber: {Title: "By Catalog Number", ArtistName: "Nobody We Know"},
+	}}
+	metadataProvider = provider
+	router := newRouter()
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+		source string
+		title  string
+	}{
+		{"no code", url.Values{}, http.StatusBadRequest, "", ""},
+		{"catalog by barcode", url.Values{"barcode": {barcode[:4] + " " + barcode[4:]}}, http.StatusOK, "catalog", "In the Catalog"},
+		{"catalog by catalog number", url.Values{"catalog_number": {catalogNumber}}, http.StatusOK, "catalog", "In the Catalog"},
+		{"catalog by catalog number after the barcode", url.Values{"barcode": {"0000000000000"}, "catalog_number": {catalogNumber}}, http.StatusOK, "catalog", "In the Catalog"},
+		{"provider by barcode", url.Values{"barcode": {otherBarcode}}, http.StatusOK, "fake", "From the Provider"},
+		{"provider by catalog number after the barcode", url.Values{"barcode": {"0000000000000"}, "catalog_number": {providedCatalogNumber}}, http.StatusOK, "fake", "By Catalog Number"},
+		{"not found", url.Values{"barcode": {"0000000000000"}, "catalog_number": {"NOWHERE"}}, http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/media/lookup?"+tt.query.Encode(), nil))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got LookupResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Source != tt.source || got.Media.Title != tt.title {
+				t.Errorf("found %q from %s, want %q from %s", got.Media.Title, got.Source, tt.title, tt.source)
+			}
+			if tt.source == "catalog" && got.Media.ID != int(mediaID) {
+				t.Errorf("media ID = %d, want %d", got.Media.ID, mediaID)
+			}
+		})
+	}
+
+	// Provider drafts have their names resolved to our IDs where they exist
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/media/lookup?barcode="+otherBarcode, nil))
+	var got LookupResult
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if got.Media.ID != 0 || got.Media.ArtistID != int(artistID) || got.Media.FormatID != 0 || got.Media.Barcode != otherBarcode {
+		t.Errorf("provider draft = %+v, want artist %d, no format and the barcode asked for", got.Media, artistID)
+	}
+
+	// The provider failing is a bad gateway rather than not found
+	provider.err = fmt.Errorf("provider is down")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/media/lookup?barcode="+otherBarcode, nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("failing provider = %d, want 502", rec.Code)
+	}
+}
@@ -1,40 +1,241 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
 func main() {
-	config, err := loadConfig()
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		err := runSeedCommand(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	configPath := flag.String("config", "", "path to a JSON config file (default: config.json if present)")
+	flag.Parse()
+
+	config, err := loadConfig(*configPath)
 	if err != nil {
-		log.Fatal("Failed to load config:", err)
+		log.Fatal("Failed to load config: ", err)
 	}
 
-	initDB()
-	defer db.Close()
+	err = run(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	router := mux.NewRouter()
-	router.HandleFunc("/media", createMedia).Methods("POST")
-	router.HandleFunc("/media", getMedia).Methods("GET")
-	router.HandleFunc("/media/{id}", getMediaById).Methods("GET")
-	router.HandleFunc("/media/{id}", updateMedia).Methods("PUT")
-	router.HandleFunc("/media/{id}", deleteMedia).Methods("DELETE")
+// run starts the server and blocks until it has shut down. The listener
+// starts before the database is ready, so /healthz and /readyz answer while
+// startServices connects and migrates. The database pool is closed only
+// after in-flight requests have drained.
+func run(config *Config) error {
+	var err error
+	metadataProvider, err = newMetadataProvider(config)
+	if err != nil {
+		return fmt.Errorf("failed to configure metadata provider: %v", err)
+	}
+
+	jobSettings.MaxAttempts = config.JobMaxAttempts
+	jobSettings.Backoff = config.JobRetryBackoff.Duration
+
+	graphQLLimits.MaxDepth = config.GraphQLMaxDepth
+	graphQLLimits.MaxComplexity = config.GraphQLMaxComplexity
+
+	legacySunset = config.LegacyAPISunset
+	bodyLimits.MaxBytes = config.MaxBodyBytes
+	bodyLimits.MaxImportBytes = config.MaxImportBodyBytes
+
+	// Streams end a little before the write timeout would cut them off
+	changeEvents = newEventHub(config.EventsBufferSize)
+	eventStreamLimit = config.ServerWriteTimeout.Duration
+	if eventStreamLimit > 10*time.Second {
+		eventStreamLimit -= 5 * time.Second
+	} else {
+		eventStreamLimit /= 2
+	}
+
+	webhookSettings.MaxAttempts = config.WebhookMaxAttempts
+	webhookSettings.Backoff = config.WebhookBackoff.Duration
+	webhookSettings.Timeout = config.WebhookTimeout.Duration
+	webhookSettings.AllowLocal = config.WebhookAllowLocal
 
 	// Configure CORS
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedOrigins:   config.CORSAllowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "If-Match", "If-None-Match", actorHeader, requestIDHeader},
+		ExposedHeaders:   []string{"ETag", requestIDHeader, "Deprecation", "Sunset", "Link", "Retry-After"},
 		AllowCredentials: true,
 	})
 
-	// Add the CORS middleware to the router
-	handler := c.Handler(router)
+	router := newRouter()
+	openAPIDocument, err = buildOpenAPI(router)
+	if err != nil {
+		return fmt.Errorf("failed to build OpenAPI document: %v", err)
+	}
+
+	// Rate limit inside the CORS middleware so 429 responses can be read by
+	// browsers, then wrap everything in request IDs, access logging, metrics
+	// and panic recovery
+	limit := withRateLimit(
+		newRateLimiter(config.RateLimitIPPerMinute, config.RateLimitIPBurst),
+		newRateLimiter(config.RateLimitUserPerMinute, config.RateLimitUserBurst),
+	)
+	handler := withRequestID(withAccessLog(withMetrics(withRecovery(c.Handler(limit(router))))))
+
+	started := make(chan func(), 1)
+	failed := make(chan error, 1)
+	go func() {
+		stop, err := startServices(config)
+		if err != nil {
+			failed <- err
+			return
+		}
+		started <- stop
+	}()
 
-	log.Printf("Starting server on port %s...", config.ServerPort)
-	log.Fatal(http.ListenAndServe(":"+config.ServerPort, handler)) // Use handler instead of router
+	err = serve(config, handler, failed)
+	// If startup is still going the process is about to exit anyway
+	select {
+	case stop := <-started:
+		stop()
+	default:
+	}
+	return err
+}
+
+// startServices connects to the database, creates the schema and starts the
+// background workers. The returned function stops the workers and closes
+// the database pool.
+func startServices(config *Config) (stop func(), err error) {
+	err = initDB(config)
+	if err != nil {
+		setMigrationStatus(migrationsFailed)
+		return nil, fmt.Errorf("failed to initialize database: %v", err)
+	}
+
+	// Seeding runs as a job so the server can answer while it does
+	if config.SeedProfile != "" {
+		payload, _ := json.Marshal(seedJobPayload{Profile: config.SeedProfile})
+		_, err = enqueueJob("seed", payload, importerActor)
+		if err != nil && err != errJobActive {
+			db.Close()
+			return nil, fmt.Errorf("failed to queue seeding: %v", err)
+		}
+	}
+	stopJobs := startJobWorkers(config.JobWorkers, config.JobPollInterval.Duration)
+	stopPurge := startTrashPurge(config.TrashRetention.Duration, config.TrashPurgeInterval.Duration)
+
+	stopEvents, err := startEventFeed(config.EventsPollInterval.Duration)
+	if err != nil {
+		stopPurge()
+		stopJobs()
+		db.Close()
+		return nil, fmt.Errorf("failed to start event feed: %v", err)
+	}
+	stopWebhooks := startWebhookDispatcher(config.EventsPollInterval.Duration)
+
+	return func() {
+		stopWebhooks()
+		stopEvents()
+		stopPurge()
+		stopJobs()
+		db.Close()
+	}, nil
+}
+
+// newRouter registers the operational endpoints at the root, each API version
+// under its prefix, and the legacy root aliases of v1
+func newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.Use(recordRoute, limitBody)
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	router.HandleFunc("/healthz", healthz).Methods("GET")
+	router.HandleFunc("/readyz", readyz).Methods("GET")
+	router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	router.HandleFunc("/openapi.json", getOpenAPI).Methods("GET")
+
+	for _, version := range apiVersions {
+		api := router.PathPrefix(version.prefix).Subrouter()
+		api.Use(waitForMigrations)
+		version.register(api)
+	}
+
+	// Requests under /api/ never fall through to the legacy aliases, so an
+	// unsupported method on a versioned path still gets a 405
+	legacy := router.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		return !strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+	}).Subrouter()
+	legacy.Use(waitForMigrations, withDeprecation(legacyVersion.prefix))
+	legacyVersion.register(legacy)
+
+	return router
+}
+
+// registerV1Routes registers the routes of version 1 of the API
+func registerV1Routes(router *mux.Router) {
+	router.HandleFunc("/media", createMedia).Methods("POST")
+	router.HandleFunc("/media", getMedia).Methods("GET")
+	router.HandleFunc("/media/lookup", lookupMedia).Methods("GET")
+	router.HandleFunc("/media/duplicates", getMediaDuplicates).Methods("GET")
+	router.HandleFunc("/media/merge", mergeMedia).Methods("POST")
+	router.HandleFunc("/media/trash", getTrash).Methods("GET")
+	router.HandleFunc("/media/bulk", bulkMedia).Methods("POST")
+	router.HandleFunc("/media/{id}", getMediaById).Methods("GET")
+	router.HandleFunc("/media/{id}", updateMedia).Methods("PUT")
+	router.HandleFunc("/media/{id}", patchMedia).Methods("PATCH")
+	router.HandleFunc("/media/{id}", deleteMedia).Methods("DELETE")
+	router.HandleFunc("/media/{id}/history", getMediaHistory).Methods("GET")
+	router.HandleFunc("/media/{id}/revert", revertMedia).Methods("POST")
+	router.HandleFunc("/media/{id}/restore", restoreMedia).Methods("POST")
+	router.HandleFunc("/artists", createArtist).Methods("POST")
+	router.HandleFunc("/artists", getArtists).Methods("GET")
+	router.HandleFunc("/artists/duplicates", getArtistDuplicates).Methods("GET")
+	router.HandleFunc("/artists/merge", mergeArtists).Methods("POST")
+	router.HandleFunc("/artists/{id}", getArtistById).Methods("GET")
+	router.HandleFunc("/artists/{id}", updateArtist).Methods("PUT")
+	router.HandleFunc("/artists/{id}/history", getArtistHistory).Methods("GET")
+	router.HandleFunc("/artists/{id}/revert", revertArtist).Methods("POST")
+	router.HandleFunc("/labels", createLabel).Methods("POST")
+	router.HandleFunc("/labels", getLabels).Methods("GET")
+	router.HandleFunc("/labels/{id}", getLabelById).Methods("GET")
+	router.HandleFunc("/labels/{id}", updateLabel).Methods("PUT")
+	router.HandleFunc("/labels/{id}/discography", getLabelDiscography).Methods("GET")
+	router.HandleFunc("/labels/{id}/history", getLabelHistory).Methods("GET")
+	router.HandleFunc("/labels/{id}/revert", revertLabel).Methods("POST")
+	router.HandleFunc("/users", createUser).Methods("POST")
+	router.HandleFunc("/users/{id}", getUserById).Methods("GET")
+	router.HandleFunc("/users/{id}", updateUser).Methods("PUT")
+	router.HandleFunc("/graphql", postGraphQL).Methods("POST")
+	router.HandleFunc("/events", getEvents).Methods("GET")
+	router.HandleFunc("/webhooks", createWebhook).Methods("POST")
+	router.HandleFunc("/webhooks", getWebhooks).Methods("GET")
+	router.HandleFunc("/webhooks/dead-letters", getWebhookDeadLetters).Methods("GET")
+	router.HandleFunc("/webhooks/deliveries/{id}/retry", retryWebhookDelivery).Methods("POST")
+	router.HandleFunc("/webhooks/{id}", getWebhookById).Methods("GET")
+	router.HandleFunc("/webhooks/{id}", updateWebhook).Methods("PUT")
+	router.HandleFunc("/webhooks/{id}", deleteWebhook).Methods("DELETE")
+	router.HandleFunc("/webhooks/{id}/deliveries", getWebhookDeliveries).Methods("GET")
+	router.HandleFunc("/jobs", createJob).Methods("POST")
+	router.HandleFunc("/jobs", getJobs).Methods("GET")
+	router.HandleFunc("/jobs/{id}", getJobById).Methods("GET")
+	router.HandleFunc("/jobs/{id}/cancel", cancelJob).Methods("POST")
+	router.HandleFunc("/enrichment/run", runEnrichment).Methods("POST")
+	router.HandleFunc("/enrichment/reviews", getEnrichmentReviews).Methods("GET")
+	router.HandleFunc("/enrichment/reviews/{id}/approve", approveEnrichmentReview).Methods("POST")
+	router.HandleFunc("/enrichment/reviews/{id}/reject", rejectEnrichmentReview).Methods("POST")
 }
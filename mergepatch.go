@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+)
+
+// mergePatchContentType is the media type of a JSON Merge Patch (RFC 7396)
+const mergePatchContentType = "application/merge-patch+json"
+
+// isMergePatch reports whether the request body is a merge patch. Plain
+// application/json is accepted too, for clients that can't set the type.
+func isMergePatch(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == mergePatchContentType || mediaType == "application/json")
+}
+
+// mergePatch applies patch to target following RFC 7396: objects are merged
+// key by key, null removes a key and any other value replaces the target
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// applyMergePatch patches the JSON form of current and decodes the result into result
+func applyMergePatch(current interface{}, patch map[string]interface{}, result interface{}) error {
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	data, err = json.Marshal(mergePatch(document, patch))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
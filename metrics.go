@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal Prometheus text-format (version 0.0.4) implementation covering
+// the counters, gauges and histograms this service exports.
+
+// metric is anything that can write itself in the text exposition format
+type metric interface {
+	write(w io.Writer)
+}
+
+// metricsRegistry holds every metric exposed on /metrics, in registration order
+var metricsRegistry []metric
+
+// register adds m to the registry and returns it
+func register[M metric](m M) M {
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+// labelKey joins label values into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels renders name="value" pairs, escaping values as the format requires
+func formatLabels(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabel escapes backslashes, quotes and newlines in a label value
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatFloat renders a sample value
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric family
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// counterVec is a counter partitioned by label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+// newCounterVec registers a counter with the given label names
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return register(&counterVec{name: name, help: help, labels: labels, values: map[string]float64{}, keys: map[string][]string{}})
+}
+
+// add increases the counter for the label values by delta
+func (c *counterVec) add(delta float64, values ...string) {
+	key := labelKey(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += delta
+	c.keys[key] = values
+}
+
+// inc increases the counter for the label values by one
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, c.keys[key]), formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram partitioned by label values
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+// histogramSeries is the state of one labelled histogram
+type histogramSeries struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// defaultLatencyBuckets are upper bounds in seconds for request latencies
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// newHistogramVec registers a histogram with the given bucket upper bounds and label names
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return register(&histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}})
+}
+
+// observe records v for the label values
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.values), s.count)
+	}
+}
+
+// gaugeFunc is a metric whose samples are computed at scrape time
+type gaugeFunc struct {
+	name    string
+	help    string
+	kind    string
+	collect func() []gaugeSample
+}
+
+// gaugeSample is one value of a gaugeFunc, with optional label name/value pairs
+type gaugeSample struct {
+	labels []string
+	value  float64
+}
+
+// newGaugeFunc registers a gauge (or counter, if kind says so) read by collect on every scrape
+func newGaugeFunc(name, help, kind string, collect func() []gaugeSample) *gaugeFunc {
+	return register(&gaugeFunc{name: name, help: help, kind: kind, collect: collect})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	samples := g.collect()
+	if samples == nil {
+		return
+	}
+	writeHeader(w, g.name, g.help, g.kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(nil, nil, s.labels...), formatFloat(s.value))
+	}
+}
+
+// sortedKeys returns the keys of a map in order so output is stable
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// HTTP metrics, labelled by mux route template rather than raw path to keep cardinality bounded
+var (
+	httpRequestsTotal = newCounterVec("http_requests_total",
+		"HTTP requests handled, by method, route template and status code.", "method", "route", "status")
+	httpRequestDuration = newHistogramVec("http_request_duration_seconds",
+		"HTTP request latency in seconds, by method and route template.", defaultLatencyBuckets, "method", "route")
+	rateLimitedTotal = newCounterVec("http_rate_limited_total",
+		"Requests rejected with 429, by the limit they hit (ip, user).", "limit")
+)
+
+// Import and background job metrics
+var (
+	importMediaTotal = newCounterVec("import_media_total",
+		"Media processed by importers, by result (inserted, skipped, invalid).", "result")
+	seedStepsTotal = newCounterVec("seed_steps_total",
+		"Seed steps considered, by result (applied, skipped).", "result")
+	enrichmentLookupsTotal = newCounterVec("enrichment_lookups_total",
+		"Metadata provider lookups made by enrichment jobs, by provider and result.", "provider", "result")
+	enrichmentReviewsQueuedTotal = newCounterVec("enrichment_reviews_queued_total",
+		"Enrichment reviews queued, by provider.", "provider")
+	mediaPurgedTotal = newCounterVec("trash_purged_total",
+		"Media permanently deleted from the trash after the retention period.")
+	bulkOperationsTotal = newCounterVec("bulk_operations_total",
+		"Bulk media operations run, by operation and result (succeeded, failed, rolled_back).", "op", "result")
+	webhookDeliveriesTotal = newCounterVec("webhook_deliveries_total",
+		"Webhook delivery attempts, by result (delivered, failed, dead).", "result")
+	jobsFinishedTotal = newCounterVec("jobs_finished_total",
+		"Background jobs finished, by type and status (succeeded, failed, cancelled).", "type", "status")
+)
+
+// catalogTables are counted for the catalog size gauge
+var catalogTables = []string{"media", "artists", "labels", "formats", "users", "user_media"}
+
+// migratedDB returns the database pool once the migrations have completed,
+// or nil before then. initDB assigns db in another goroutine, and the lock
+// around the migration status orders that before the status reads complete.
+func migratedDB() *sql.DB {
+	if getMigrationStatus() != migrationsComplete {
+		return nil
+	}
+	return db
+}
+
+// Database pool and catalog gauges are read at scrape time, once the migrations
+// have completed
+func init() {
+	newGaugeFunc("db_pool_connections", "Database pool connections by state.", "gauge", func() []gaugeSample {
+		db := migratedDB()
+		if db == nil {
+			return nil
+		}
+		stats := db.Stats()
+		return []gaugeSample{
+			{[]string{"state", "open"}, float64(stats.OpenConnections)},
+			{[]string{"state", "in_use"}, float64(stats.InUse)},
+			{[]string{"state", "idle"}, float64(stats.Idle)},
+			{[]string{"state", "max_open"}, float64(stats.MaxOpenConnections)},
+		}
+	})
+	newGaugeFunc("db_pool_wait_total", "Connections waited for because the pool was exhausted.", "counter", func() []gaugeSample {
+		db := migratedDB()
+		if db == nil {
+			return nil
+		}
+		return []gaugeSample{{value: float64(db.Stats().WaitCount)}}
+	})
+	newGaugeFunc("db_pool_wait_seconds_total", "Total time spent waiting for a pool connection.", "counter", func() []gaugeSample {
+		db := migratedDB()
+		if db == nil {
+			return nil
+		}
+		return []gaugeSample{{value: db.Stats().WaitDuration.Seconds()}}
+	})
+	newGaugeFunc("db_pool_closed_total", "Connections closed by the pool, by reason.", "counter", func() []gaugeSample {
+		db := migratedDB()
+		if db == nil {
+			return nil
+		}
+		stats := db.Stats()
+		return []gaugeSample{
+			{[]string{"reason", "max_idle"}, float64(stats.MaxIdleClosed)},
+			{[]string{"reason", "max_idle_time"}, float64(stats.MaxIdleTimeClosed)},
+			{[]string{"reason", "max_lifetime"}, float64(stats.MaxLifetimeClosed)},
+		}
+	})
+	newGaugeFunc("catalog_entities", "Rows in each catalog table, not counting trashed media.", "gauge", func() []gaugeSample {
+		db := migratedDB()
+		if db == nil {
+			return nil
+		}
+		var samples []gaugeSample
+		for _, table := range catalogTables {
+			var count int
+			query := `SELECT COUNT(*) FROM ` + table
+			if table == "media" {
+				query += ` WHERE deleted_at IS NULL`
+			}
+			if err := db.QueryRow(query).Scan(&count); err != nil {
+				continue
+			}
+			samples = append(samples, gaugeSample{[]string{"table", table}, float64(count)})
+		}
+		return samples
+	})
+}
+
+// withMetrics records request counts and latencies
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		route := getRequestInfo(r).Route
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestsTotal.inc(r.Method, route, strconv.Itoa(rec.status))
+		httpRequestDuration.observe(time.Since(start).Seconds(), r.Method, route)
+	})
+}
+
+// metricsHandler handles scrapes in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricsRegistry {
+		m.write(w)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits the request IDs accepted from clients to something safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// structuredLog writes one JSON object per line
+var structuredLog = log.New(os.Stdout, "", 0)
+
+// requestInfoKey is the context key for *requestInfo
+type requestInfoKey struct{}
+
+// requestInfo holds per-request details shared between middleware. The route
+// template is filled in by recordRoute once the router has matched the request.
+type requestInfo struct {
+	ID    string
+	Route string
+}
+
+// getRequestInfo returns the request's info, or an empty one outside the middleware chain
+func getRequestInfo(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// requestID returns the ID assigned to the request
+func requestID(r *http.Request) string {
+	return getRequestInfo(r).ID
+}
+
+// newRequestID returns a random 16-byte hex ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logEvent writes a structured log line
+func logEvent(fields map[string]interface{}) {
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(fields)
+	if err != nil {
+		log.Printf("Failed to encode log line: %v", err)
+		return
+	}
+	structuredLog.Println(string(line))
+}
+
+// logError records an error against a request without exposing it to the client
+func logError(r *http.Request, message string, err error) {
+	fields := map[string]interface{}{
+		"level":      "error",
+		"request_id": requestID(r),
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"message":    message,
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	logEvent(fields)
+}
+
+// withRequestID assigns each request an ID, reusing a well-formed X-Request-ID from the client
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{ID: id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// recordRoute is router middleware that notes the matched route template for logging
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				getRequestInfo(r).Route = template
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder captures the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// withAccessLog writes a JSON access log line for every request
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		info := getRequestInfo(r)
+		logEvent(map[string]interface{}{
+			"level":       "info",
+			"request_id":  info.ID,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"route":       info.Route,
+			"status":      rec.status,
+			"bytes":       rec.bytes,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"remote_addr": r.RemoteAddr,
+			"user_agent":  r.UserAgent(),
+		})
+	})
+}
+
+// withRecovery turns a panicking handler into a logged 500 response
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				logEvent(map[string]interface{}{
+					"level":      "error",
+					"request_id": requestID(r),
+					"method":     r.Method,
+					"path":       r.URL.Path,
+					"message":    "panic serving request",
+					"panic":      fmt.Sprint(p),
+					"stack":      string(debug.Stack()),
+				})
+				writeError(w, r, http.StatusInternalServerError, "Internal server error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -2,21 +2,10 @@ package main
 
 import (
 	"database/sql"
-	"log"
 	"strings"
 	"time"
 )
 
-// Config struct holds the database configuration details
-type Config struct {
-	DBUser     string `json:"db_user"`
-	DBPassword string `json:"db_password"`
-	DBName     string `json:"db_name"`
-	DBHost     string `json:"db_host"`
-	DBPort     string `json:"db_port"`
-	ServerPort string `json:"server_port"`
-}
-
 // Format struct holds the format details
 type Format struct {
 	ID          int    `json:"id"`
@@ -32,17 +21,69 @@ type Media struct {
 	ArtistName    string   `json:"artist"` // This field is not stored in the database, temp field for holding the artist name to check if exists
 	Media         string   `json:"media"`
 	FormatID      int      `json:"format_id"`
-	FormatName    string   `json:"format"` // This field is not stored in the database, temp field for holding the format name to check if exists
-	DatePublished string   `json:"date_published"`
+	FormatName    string   `json:"format"`         // This field is not stored in the database, temp field for holding the format name to check if exists
+	DatePublished string   `json:"date_published"` // YYYY, YYYY-MM or YYYY-MM-DD, as precise as the release date is known
 	ImageURL      string   `json:"image_url,omitempty"`
 	GenreTags     []string `json:"genre_tags,omitempty"`
+	Barcode       string   `json:"barcode,omitempty"`
+	CatalogNumber string   `json:"catalog_number,omitempty"`
+	Tracks        []Track  `json:"tracks,omitempty"`
+	LabelID       *int     `json:"label_id,omitempty"`
+	LabelName     string   `json:"label,omitempty"`      // Not stored with the media; the importer resolves it to a label_id
+	Version       int      `json:"version,omitempty"`    // Incremented on every change; the ETag of the media
+	UpdatedAt     string   `json:"updated_at,omitempty"` // Server time of the last change
+	DeletedAt     string   `json:"deleted_at,omitempty"` // Set while the media is in the trash
+}
+
+// Precision of a release date, stored alongside it in media.date_precision
+const (
+	precisionYear  = "year"
+	precisionMonth = "month"
+	precisionDay   = "day"
+)
+
+// releaseDateColumns splits a validated YYYY, YYYY-MM or YYYY-MM-DD date into
+// the value for the DATE column, which holds the first day of the period, and
+// its precision. An empty date is stored as NULL.
+func releaseDateColumns(date string) (interface{}, string) {
+	switch len(date) {
+	case 0:
+		return nil, precisionDay
+	case len("2006"):
+		return date + "-01-01", precisionYear
+	case len("2006-01"):
+		return date + "-01", precisionMonth
+	}
+	return date, precisionDay
+}
+
+// Track struct holds a single track on a media
+type Track struct {
+	Position string `json:"position"`
+	Title    string `json:"title"`
+	Length   string `json:"length,omitempty"`
 }
 
 // Artist struct holds the artist details
 type Artist struct {
-	ID      int    `json:"id"`
-	Name    string `json:"name"`
-	BandIDs []int  `json:"band_ids"`
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	SortName   string   `json:"sort_name"`
+	Aliases    []string `json:"aliases"`
+	Country    string   `json:"country,omitempty"`
+	ActiveFrom *int     `json:"active_from,omitempty"`
+	ActiveTo   *int     `json:"active_to,omitempty"`
+	BandIDs    []int    `json:"band_ids"`
+	Version    int      `json:"version,omitempty"` // Incremented on every change; the ETag of the artist
+}
+
+// Label struct holds the record label details
+type Label struct {
+	ID              int      `json:"id"`
+	Name            string   `json:"name"`
+	ParentID        *int     `json:"parent_id,omitempty"`
+	CatalogPrefixes []string `json:"catalog_prefixes"`
+	SublabelIDs     []int    `json:"sublabel_ids"`
 }
 
 // Band struct holds the band details
@@ -68,7 +109,7 @@ type User struct {
 	LastName  string `json:"last_name"`
 	Username  string `json:"username"`
 	Email     string `json:"email"`
-	Password  string `json:"password"`
+	Password  string `json:"password,omitempty"` // Only read; stored hashed and never returned
 }
 
 // UserMedia struct holds the details of the media owned by a user
@@ -80,14 +121,14 @@ type UserMedia struct {
 }
 
 // NormalizeGenre normalizes the genre name based on the genre_mappings table
-func NormalizeGenre(db *sql.DB, genre string) string {
+func NormalizeGenre(q dbExecutor, genre string) (string, error) {
 	var normalizedGenre string
-	err := db.QueryRow(`SELECT normalized_genre FROM genre_mappings WHERE genre = ?`, strings.ToLower(genre)).Scan(&normalizedGenre)
+	err := q.QueryRow(`SELECT normalized_genre FROM genre_mappings WHERE genre = ?`, strings.ToLower(genre)).Scan(&normalizedGenre)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return genre
+			return genre, nil
 		}
-		log.Fatal("Failed to query genre mapping:", err)
+		return "", err
 	}
-	return normalizedGenre
+	return normalizedGenre, nil
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultMusicBrainzURL is used when no musicbrainz_url is configured
+const defaultMusicBrainzURL = "https://musicbrainz.org"
+
+// coverArtArchiveURL is the front cover image for a MusicBrainz release ID
+const coverArtArchiveURL = "https://coverartarchive.org/release/%s/front"
+
+// MusicBrainzProvider looks up releases through the MusicBrainz web service
+type MusicBrainzProvider struct {
+	client *providerClient
+}
+
+// NewMusicBrainzProvider creates a provider for the MusicBrainz API at baseURL.
+// MusicBrainz allows one request per second per client.
+func NewMusicBrainzProvider(baseURL string) *MusicBrainzProvider {
+	if baseURL == "" {
+		baseURL = defaultMusicBrainzURL
+	}
+	return &MusicBrainzProvider{client: newProviderClient(baseURL, time.Second)}
+}
+
+// mbRelease is the subset of a MusicBrainz release we use
+type mbRelease struct {
+	ID           string `json:"id"`
+	Title        string `json:"title"`
+	Date         string `json:"date"`
+	Barcode      string `json:"barcode"`
+	ArtistCredit []struct {
+		Name string `json:"name"`
+	} `json:"artist-credit"`
+	LabelInfo []struct {
+		CatalogNumber string `json:"catalog-number"`
+	} `json:"label-info"`
+	ReleaseGroup struct {
+		PrimaryType string `json:"primary-type"`
+	} `json:"release-group"`
+	Media []struct {
+		Format string `json:"format"`
+		Tracks []struct {
+			Number string `json:"number"`
+			Title  string `json:"title"`
+			Length int    `json:"length"`
+		} `json:"tracks"`
+	} `json:"media"`
+	Genres []struct {
+		Name string `json:"name"`
+	} `json:"genres"`
+	CoverArtArchive struct {
+		Front bool `json:"front"`
+	} `json:"cover-art-archive"`
+}
+
+// Name returns the provider name
+func (p *MusicBrainzProvider) Name() string {
+	return "musicbrainz"
+}
+
+// LookupBarcode finds a release by its UPC/EAN barcode
+func (p *MusicBrainzProvider) LookupBarcode(barcode string) (*Media, error) {
+	return p.search("barcode:" + escapeLucene(barcode))
+}
+
+// LookupCatalogNumber finds a release by its label catalog number
+func (p *MusicBrainzProvider) LookupCatalogNumber(catalogNumber string) (*Media, error) {
+	return p.search(fmt.Sprintf(`catno:"%s"`, escapeLucene(catalogNumber)))
+}
+
+// LookupRelease finds a release by artist name and title
+func (p *MusicBrainzProvider) LookupRelease(artist, title string) (*Media, error) {
+	return p.search(fmt.Sprintf(`artist:"%s" AND release:"%s"`, escapeLucene(artist), escapeLucene(title)))
+}
+
+// luceneSpecial are the characters with a meaning in the Lucene query syntax
+// MusicBrainz searches use
+const luceneSpecial = `+-&|!(){}[]^"~*?:\/`
+
+// escapeLucene backslash-escapes the special characters in s, so user text
+// can't end a quoted phrase or change the query
+func escapeLucene(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(luceneSpecial, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// search runs a release search and fetches the full details of the best match
+func (p *MusicBrainzProvider) search(query string) (*Media, error) {
+	var result struct {
+		Releases []mbRelease `json:"releases"`
+	}
+	err := p.client.getJSON("/ws/2/release/?limit=1&fmt=json&query="+url.QueryEscape(query), &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Releases) == 0 {
+		return nil, ErrReleaseNotFound
+	}
+
+	var release mbRelease
+	err = p.client.getJSON("/ws/2/release/"+url.PathEscape(result.Releases[0].ID)+"?fmt=json&inc=artist-credits+labels+recordings+release-groups+genres", &release)
+	if err != nil {
+		return nil, err
+	}
+	return release.toMedia(), nil
+}
+
+// toMedia converts a MusicBrainz release into a Media draft
+func (r *mbRelease) toMedia() *Media {
+	m := &Media{
+		Title:         r.Title,
+		DatePublished: r.Date,
+		Barcode:       r.Barcode,
+	}
+
+	var artists []string
+	for _, credit := range r.ArtistCredit {
+		artists = append(artists, credit.Name)
+	}
+	m.ArtistName = strings.Join(artists, ", ")
+
+	if len(r.LabelInfo) > 0 {
+		m.CatalogNumber = r.LabelInfo[0].CatalogNumber
+	}
+	if r.CoverArtArchive.Front {
+		m.ImageURL = fmt.Sprintf(coverArtArchiveURL, r.ID)
+	}
+	for _, genre := range r.Genres {
+		m.GenreTags = append(m.GenreTags, genre.Name)
+	}
+
+	var medium string
+	for _, disc := range r.Media {
+		if medium == "" {
+			medium = disc.Format
+		}
+		for _, t := range disc.Tracks {
+			m.Tracks = append(m.Tracks, Track{
+				Position: t.Number,
+				Title:    t.Title,
+				Length:   formatTrackLength(t.Length / 1000),
+			})
+		}
+	}
+	m.Media = medium
+	m.FormatName = formatForReleaseType(medium, r.ReleaseGroup.PrimaryType)
+	return m
+}
+
+// formatTrackLength formats a duration in seconds as m:ss, or "" if unknown
+func formatTrackLength(seconds int) string {
+	if seconds <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
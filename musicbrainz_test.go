@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// newStubMusicBrainz returns a MusicBrainz provider backed by handler, without the request throttle
+func newStubMusicBrainz(t *testing.T, handler http.HandlerFunc) *MusicBrainzProvider {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	p := NewMusicBrainzProvider(server.URL)
+	p.client.limit.interval = 0
+	return p
+}
+
+func TestMusicBrainzLookupBarcode(t *testing.T) {
+	var queries []string
+	p := newStubMusicBrainz(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ws/2/release/":
+			queries = append(queries, r.URL.Query().Get("query"))
+			w.Write([]byte(`{"releases": [{"id": "b84ee12a"}]}`))
+		case "/ws/2/release/b84ee12a":
+			if got := r.URL.Query().Get("inc"); got != "artist-credits labels recordings release-groups genres" {
+				t.Errorf("inc = %q", got)
+			}
+			w.Write([]byte(`{
+                "id": "b84ee12a",
+                "title": "Kind of Blue",
+                "date": "1959-08-17",
+                "barcode": "074646793524",
+                "artist-credit": [{"name": "Miles Davis"}],
+                "label-info": [{"catalog-number": "CK 64935"}],
+                "release-group": {"primary-type": "Album"},
+                "media": [
+                    {"format": "CD", "tracks": [{"number": "1", "title": "So What", "length": 562000}]},
+                    {"format": "CD", "tracks": [{"number": "1", "title": "Flamenco Sketches", "length": 0}]}
+                ],
+                "genres": [{"name": "jazz"}, {"name": "modal jazz"}],
+                "cover-art-archive": {"front": true}
+            }`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	m, err := p.LookupBarcode("074646793524")
+	if err != nil {
+		t.Fatalf("LookupBarcode() error = %v", err)
+	}
+	if want := []string{"barcode:074646793524"}; !reflect.DeepEqual(queries, want) {
+		t.Errorf("queries = %q, want %q", queries, want)
+	}
+	want := &Media{
+		Title:         "Kind of Blue",
+		ArtistName:    "Miles Davis",
+		DatePublished: "1959-08-17",
+		Barcode:       "074646793524",
+		CatalogNumber: "CK 64935",
+		ImageURL:      "https://coverartarchive.org/release/b84ee12a/front",
+		GenreTags:     []string{"jazz", "modal jazz"},
+		Media:         "CD",
+		FormatName:    "CD",
+		Tracks: []Track{
+			{Position: "1", Title: "So What", Length: "9:22"},
+			{Position: "1", Title: "Flamenco Sketches"},
+		},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("LookupBarcode() = %+v, want %+v", m, want)
+	}
+}
+
+func TestMusicBrainzLookupQueries(t *testing.T) {
+	var query string
+	p := newStubMusicBrainz(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		w.Write([]byte(`{"releases": []}`))
+	})
+
+	tests := []struct {
+		name   string
+		lookup func() (*Media, error)
+		want   string
+	}{
+		{"barcode", func() (*Media, error) { return p.LookupBarcode("0074646493525") }, `barcode:0074646493525`},
+		{"catalog number", func() (*Media, error) { return p.LookupCatalogNumber("CK 64935") }, `catno:"CK 64935"`},
+		{"catalog number with a slash", func() (*Media, error) { return p.LookupCatalogNumber("SST-001/2") }, `catno:"SST\-001\/2"`},
+		{"release", func() (*Media, error) { return p.LookupRelease("Miles Davis", "Kind of Blue") }, `artist:"Miles Davis" AND release:"Kind of Blue"`},
+		{"release with quotes", func() (*Media, error) { return p.LookupRelease(`The "Heavy" Band`, `Live" OR artist:"*`) },
+			`artist:"The \"Heavy\" Band" AND release:"Live\" OR artist\:\"\*"`},
+		{"release with operators", func() (*Media, error) { return p.LookupRelease("AC/DC", "Who Made Who (Live) && More!") },
+			`artist:"AC\/DC" AND release:"Who Made Who \(Live\) \&\& More\!"`},
+		{"release with a backslash", func() (*Media, error) { return p.LookupRelease(`Back\Slash`, "Title") }, `artist:"Back\\Slash" AND release:"Title"`},
+	}
+	for _, tt := range tests {
+		if _, err := tt.lookup(); err != ErrReleaseNotFound {
+			t.Errorf("%s: error = %v, want ErrReleaseNotFound", tt.name, err)
+		}
+		if query != tt.want {
+			t.Errorf("%s: query = %q, want %q", tt.name, query, tt.want)
+		}
+	}
+}
+
+func TestMusicBrainzLookupErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		notFound bool
+	}{
+		{"not found", http.StatusNotFound, true},
+		{"rate limited", http.StatusServiceUnavailable, false},
+		{"server error", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newStubMusicBrainz(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			})
+			_, err := p.LookupBarcode("074646793524")
+			if err == nil {
+				t.Fatal("LookupBarcode() error = nil")
+			}
+			if (err == ErrReleaseNotFound) != tt.notFound {
+				t.Errorf("LookupBarcode() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestEnrichmentWithMusicBrainz(t *testing.T) {
+	p := newStubMusicBrainz(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ws/2/release/":
+			w.Write([]byte(`{"releases": [{"id": "b84ee12a"}]}`))
+		default:
+			w.Write([]byte(`{"id": "b84ee12a", "date": "1959-08-17", "genres": [{"name": "jazz"}]}`))
+		}
+	})
+
+	changes, err := lookupEnrichment(p, enrichmentCandidate{ArtistName: "Miles Davis", Title: "Kind of Blue", DatePublished: "1959", ImageURL: "cover.jpg", TrackCount: 5})
+	if err != nil {
+		t.Fatalf("lookupEnrichment() error = %v", err)
+	}
+	want := EnrichmentChanges{DatePublished: "1959-08-17", GenreTags: []string{"jazz"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %+v, want %+v", changes, want)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// openAPIDocument is the OpenAPI 3 description of the API served by
+// GET /openapi.json, built from the router when the server starts
+var openAPIDocument []byte
+
+// apiParam documents a query parameter
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// apiOperation documents one route. Request and Response are values of the
+// JSON body types, or nil if there is no body.
+type apiOperation struct {
+	Summary      string
+	Query        []apiParam
+	Request      interface{}
+	RequestType  string // Content type of the request body, JSON if empty
+	Status       int
+	Response     interface{}
+	ResponseType string // Content type of the response body, JSON if empty
+	IfMatch      bool   // Writes that require the current ETag in If-Match
+	ETag         bool   // Responses that carry the ETag of the media
+	// Errors holds the bodies of error responses that aren't an APIError, by status
+	Errors map[int]interface{}
+}
+
+// apiOperations documents every route in newRouter, keyed by method and path
+// template, relative to the version prefix for versioned routes. buildOpenAPI
+// refuses to start the server if the two disagree.
+var apiOperations = map[string]apiOperation{
+	"GET /healthz": {Summary: "Liveness check", Status: http.StatusOK, Response: map[string]string{}},
+	"GET /readyz": {Summary: "Readiness check; 503 until the database is reachable and migrated", Status: http.StatusOK, Response: ReadinessReport{},
+		Errors: map[int]interface{}{http.StatusServiceUnavailable: ReadinessReport{}}},
+	"GET /metrics":      {Summary: "Prometheus metrics", Status: http.StatusOK, Response: "", ResponseType: "text/plain"},
+	"GET /openapi.json": {Summary: "This document", Status: http.StatusOK, Response: map[string]interface{}{}},
+
+	"POST /media": {Summary: "Create a media, naming the artist and format by ID or by name", Request: Media{}, Status: http.StatusCreated},
+	"GET /media": {Summary: "List media", Status: http.StatusOK, Response: []Media{},
+		Query: []apiParam{{"label_id", "integer", "Only media on this label or its sublabels"}}},
+	"GET /media/lookup": {Summary: "Find a media by barcode or catalog number, in the catalog or else the metadata provider", Status: http.StatusOK, Response: LookupResult{},
+		Query: []apiParam{{"barcode", "string", "UPC or EAN barcode"}, {"catalog_number", "string", "Label catalog number, tried when nothing matches the barcode"}}},
+	"GET /media/duplicates": {Summary: "List pairs of media that look like duplicates", Status: http.StatusOK, Response: []DuplicateCandidate{},
+		Query: []apiParam{{"threshold", "number", "Minimum similarity score between 0 and 1"}}},
+	"POST /media/merge": {Summary: "Fold duplicate media into a surviving media", Request: MergeRequest{}, Status: http.StatusNoContent},
+	"GET /media/trash":  {Summary: "List media in the trash, most recently deleted first", Status: http.StatusOK, Response: []Media{}},
+	"POST /media/bulk": {Summary: "Run a list of media operations in a single transaction", Request: BulkRequest{}, Status: http.StatusOK, Response: BulkResponse{},
+		Errors: map[int]interface{}{http.StatusUnprocessableEntity: BulkResponse{}}},
+	"GET /media/{id}":          {Summary: "Get a media with its tracks", Status: http.StatusOK, Response: Media{}, ETag: true},
+	"PUT /media/{id}":          {Summary: "Replace a media; tracks are only replaced when given", Request: Media{}, Status: http.StatusOK, Response: Media{}, IfMatch: true, ETag: true},
+	"PATCH /media/{id}":        {Summary: "Update a media with a JSON Merge Patch", Request: map[string]interface{}{}, RequestType: mergePatchContentType, Status: http.StatusOK, Response: Media{}, IfMatch: true, ETag: true},
+	"DELETE /media/{id}":       {Summary: "Move a media to the trash", Status: http.StatusNoContent, IfMatch: true},
+	"GET /media/{id}/history":  {Summary: "List the recorded changes to a media, newest first", Status: http.StatusOK, Response: []AuditEntry{}},
+	"POST /media/{id}/revert":  {Summary: "Restore a media to the state recorded by one of its audit entries", Request: RevertRequest{}, Status: http.StatusOK, Response: Media{}, IfMatch: true, ETag: true},
+	"POST /media/{id}/restore": {Summary: "Take a media back out of the trash", Status: http.StatusOK, Response: Media{}, ETag: true},
+
+	"POST /artists": {Summary: "Create an artist", Request: Artist{}, Status: http.StatusCreated},
+	"GET /artists":  {Summary: "List artists", Status: http.StatusOK, Response: []Artist{}},
+	"GET /artists/duplicates": {Summary: "List pairs of artists that look like duplicates", Status: http.StatusOK, Response: []DuplicateCandidate{},
+		Query: []apiParam{{"threshold", "number", "Minimum similarity score between 0 and 1"}}},
+	"POST /artists/merge":       {Summary: "Fold duplicate artists into a surviving artist", Request: MergeRequest{}, Status: http.StatusNoContent},
+	"GET /artists/{id}":         {Summary: "Get an artist with their aliases", Status: http.StatusOK, Response: Artist{}, ETag: true},
+	"PUT /artists/{id}":         {Summary: "Replace an artist; aliases are only replaced when given", Request: Artist{}, Status: http.StatusOK, Response: Artist{}, IfMatch: true, ETag: true},
+	"GET /artists/{id}/history": {Summary: "List the recorded changes to an artist, newest first", Status: http.StatusOK, Response: []AuditEntry{}},
+	"POST /artists/{id}/revert": {Summary: "Restore an artist and their aliases to the state recorded by one of their audit entries", Request: RevertRequest{}, Status: http.StatusOK, Response: Artist{}, IfMatch: true, ETag: true},
+
+	"POST /labels":                 {Summary: "Create a label", Request: Label{}, Status: http.StatusCreated},
+	"GET /labels":                  {Summary: "List labels", Status: http.StatusOK, Response: []Label{}},
+	"GET /labels/{id}":             {Summary: "Get a label", Status: http.StatusOK, Response: Label{}},
+	"PUT /labels/{id}":             {Summary: "Replace a label", Request: Label{}, Status: http.StatusOK},
+	"GET /labels/{id}/discography": {Summary: "List the media on a label and its sublabels by release date", Status: http.StatusOK, Response: []Media{}},
+	"GET /labels/{id}/history":     {Summary: "List the recorded changes to a label, newest first", Status: http.StatusOK, Response: []AuditEntry{}},
+	"POST /labels/{id}/revert":     {Summary: "Restore a label to the state recorded by one of its audit entries", Request: RevertRequest{}, Status: http.StatusOK, Response: Label{}},
+
+	"POST /users":     {Summary: "Create a user; the password is stored hashed", Request: User{}, Status: http.StatusCreated},
+	"GET /users/{id}": {Summary: "Get a user, without their password", Status: http.StatusOK, Response: User{}},
+	"PUT /users/{id}": {Summary: "Replace a user; the password is only changed when given", Request: User{}, Status: http.StatusOK},
+
+	"POST /graphql": {Summary: "Run a GraphQL query over the catalog and collections", Request: GraphQLRequest{}, Status: http.StatusOK, Response: GraphQLResponse{},
+		Errors: map[int]interface{}{http.StatusBadRequest: GraphQLResponse{}}},
+	"GET /events": {Summary: "Stream media, artist and collection changes as server-sent events; send Last-Event-ID to resume", Status: http.StatusOK, Response: ChangeEvent{}, ResponseType: "text/event-stream",
+		Query: []apiParam{{"type", "string", "Comma-separated entity types, such as media, or event types, such as media.create"}, {"user", "string", "Comma-separated users who made the changes"}}},
+
+	"POST /webhooks":                       {Summary: "Subscribe a URL to media and collection events; the response holds the signing secret", Request: Webhook{}, Status: http.StatusCreated, Response: Webhook{}},
+	"GET /webhooks":                        {Summary: "List webhooks", Status: http.StatusOK, Response: []Webhook{}},
+	"GET /webhooks/dead-letters":           {Summary: "List the most recent deliveries that failed every attempt", Status: http.StatusOK, Response: []WebhookDelivery{}},
+	"POST /webhooks/deliveries/{id}/retry": {Summary: "Send a dead delivery again", Status: http.StatusAccepted},
+	"GET /webhooks/{id}":                   {Summary: "Get a webhook", Status: http.StatusOK, Response: Webhook{}},
+	"PUT /webhooks/{id}":                   {Summary: "Replace a webhook's URL and event types, and its secret if one is given", Request: Webhook{}, Status: http.StatusOK},
+	"DELETE /webhooks/{id}":                {Summary: "Delete a webhook and its deliveries", Status: http.StatusNoContent},
+	"GET /webhooks/{id}/deliveries": {Summary: "List a webhook's most recent deliveries", Status: http.StatusOK, Response: []WebhookDelivery{},
+		Query: []apiParam{{"status", "string", "pending, delivered or dead"}}},
+
+	"POST /jobs": {Summary: "Queue a background job: seed, import-media, import-users, enrichment or normalize-genres; poll it at the returned Location", Request: JobRequest{}, Status: http.StatusAccepted, Response: Job{}},
+	"GET /jobs": {Summary: "List the most recent jobs", Status: http.StatusOK, Response: []Job{},
+		Query: []apiParam{{"status", "string", "queued, running, succeeded, failed or cancelled"}, {"type", "string", "Job type"}}},
+	"GET /jobs/{id}":         {Summary: "Get a job's status and progress", Status: http.StatusOK, Response: Job{}},
+	"POST /jobs/{id}/cancel": {Summary: "Cancel a queued job, or stop a running one at its next heartbeat", Status: http.StatusAccepted, Response: Job{}},
+
+	"POST /enrichment/run": {Summary: "Queue a job looking up missing media details; poll it at the returned Location", Status: http.StatusAccepted, Response: Job{}},
+	"GET /enrichment/reviews": {Summary: "List proposed changes", Status: http.StatusOK, Response: []EnrichmentReview{},
+		Query: []apiParam{{"status", "string", "pending (the default), approved or rejected"}}},
+	"POST /enrichment/reviews/{id}/approve": {Summary: "Apply a proposed change, unless its media has changed or been trashed since it was proposed", Status: http.StatusNoContent},
+	"POST /enrichment/reviews/{id}/reject":  {Summary: "Discard a proposed change", Status: http.StatusNoContent},
+}
+
+// schemaFieldDocs describes model fields whose JSON shape isn't obvious from
+// the name, keyed by schema and property name
+var schemaFieldDocs = map[string]string{
+	"Media.artist":          "Artist name. Only read when artist_id is 0, to find the artist by name or alias.",
+	"Media.artist_id":       "Artist ID. Takes precedence over artist.",
+	"Media.format":          "Format name. Only read when format_id is 0, to find the format by name.",
+	"Media.format_id":       "Format ID. Takes precedence over format.",
+	"Media.date_published":  "YYYY, YYYY-MM or YYYY-MM-DD, as precise as the release date is known.",
+	"Media.label":           "Label name. Only read by the importer, which resolves it to a label_id.",
+	"Media.label_id":        "Label ID. Defaults to the label whose catalog prefix matches catalog_number.",
+	"Media.tracks":          "Tracks in order. Omitted from a PUT, the existing tracks are kept.",
+	"Artist.aliases":        "Other names the artist is found by. Omitted from a PUT, the existing aliases are kept.",
+	"Media.version":         "Incremented on every change; the ETag of the media.",
+	"Media.deleted_at":      "Set while the media is in the trash.",
+	"BulkOperation.op":      "create, patch, delete, add-genre, remove-genre or change-format.",
+	"BulkOperation.version": "Required for every op but create; the operation fails unless the media is still at this version.",
+	"MergeRequest.versions": "The version of the survivor and of every duplicate, keyed by ID; the merge fails if any has changed.",
+	"User.password":         "Write only. At least 8 characters; stored hashed.",
+	"BulkRequest.mode":      "atomic (the default) or best_effort.",
+	"Webhook.url":           "An http or https URL. Loopback and link-local hosts are refused unless the server allows them.",
+	"Webhook.secret":        "Signs deliveries. Generated if left empty on create, kept if left empty on update, and only returned on create.",
+	"JobRequest.payload":    "seed takes {\"profile\": ..., \"force\": ...}; import-media takes {\"media\": [...]}; import-users takes {\"users\": [...]}; the others take none.",
+	"Webhook.event_types":   "media or collection for every change to them, or media.create, collection.delete and so on.",
+}
+
+// pathParamPattern finds the variables in a mux path template
+var pathParamPattern = regexp.MustCompile(`\{(\w+)(?::[^}]*)?\}`)
+
+// getOpenAPI handles serving the OpenAPI document
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// buildOpenAPI describes every route registered on router. It fails if a
+// route has no entry in apiOperations or an entry has no route, so the
+// document can't drift from the handlers.
+func buildOpenAPI(router *mux.Router) ([]byte, error) {
+	schemas := schemaBuilder{schemas: map[string]interface{}{}}
+	errorSchema := schemas.schema(reflect.TypeOf(APIError{}))
+	paths := map[string]map[string]interface{}{}
+	documented := map[string]bool{}
+	var undocumented []string
+
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		// Versioned routes are documented by their path within the version;
+		// the legacy root aliases of a version are left out of the document
+		relative := versionRelativePath(path)
+		legacy := relative == path && len(ancestors) > 0
+
+		for _, method := range methods {
+			key := method + " " + relative
+			op, ok := apiOperations[key]
+			if !ok {
+				undocumented = append(undocumented, key)
+				continue
+			}
+			documented[key] = true
+			if legacy {
+				continue
+			}
+			if paths[path] == nil {
+				paths[path] = map[string]interface{}{}
+			}
+			paths[path][strings.ToLower(method)] = op.describe(&schemas, path, handlerName(route), errorSchema)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for key := range apiOperations {
+		if !documented[key] {
+			undocumented = append(undocumented, key+" (no such route)")
+		}
+	}
+	if len(undocumented) > 0 {
+		sort.Strings(undocumented)
+		return nil, fmt.Errorf("routes and OpenAPI operations differ: %s", strings.Join(undocumented, ", "))
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "record-collection API",
+			"version": "1.0.0",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas.schemas},
+	}, "", "  ")
+}
+
+// handlerName returns the name of the function handling a route, used as its operationId
+func handlerName(route *mux.Route) string {
+	handler := route.GetHandler()
+	if handler == nil {
+		return ""
+	}
+	name := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// describe returns the OpenAPI operation object for op on path
+func (op apiOperation) describe(schemas *schemaBuilder, path, operationID string, errorSchema map[string]interface{}) map[string]interface{} {
+	var params []interface{}
+	for _, match := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]interface{}{
+			"name": match[1], "in": "path", "required": true,
+			"schema": map[string]interface{}{"type": "integer"},
+		})
+	}
+	for _, p := range op.Query {
+		params = append(params, map[string]interface{}{
+			"name": p.Name, "in": "query", "description": p.Description,
+			"schema": map[string]interface{}{"type": p.Type},
+		})
+	}
+	if op.IfMatch {
+		params = append(params, map[string]interface{}{
+			"name": "If-Match", "in": "header", "required": true,
+			"description": "ETag from the last GET; 428 if missing, 412 if the media has changed since",
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+	params = append(params, map[string]interface{}{
+		"name": actorHeader, "in": "header",
+		"description": "User making the request, recorded in the audit log",
+		"schema":      map[string]interface{}{"type": "string"},
+	})
+
+	success := map[string]interface{}{"description": http.StatusText(op.Status)}
+	if op.Response != nil {
+		success["content"] = contentOf(schemas, op.Response, op.ResponseType)
+	}
+	if op.ETag {
+		success["headers"] = map[string]interface{}{
+			"ETag": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		}
+	}
+
+	responses := map[string]interface{}{
+		fmt.Sprint(op.Status): success,
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": errorSchema}},
+		},
+	}
+	for status, body := range op.Errors {
+		responses[fmt.Sprint(status)] = map[string]interface{}{
+			"description": http.StatusText(status),
+			"content":     contentOf(schemas, body, ""),
+		}
+	}
+
+	operation := map[string]interface{}{
+		"operationId": operationID,
+		"summary":     op.Summary,
+		"parameters":  params,
+		"responses":   responses,
+	}
+	if op.Request != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  contentOf(schemas, op.Request, op.RequestType),
+		}
+	}
+	return operation
+}
+
+// contentOf returns an OpenAPI content map for a body of the given type
+func contentOf(schemas *schemaBuilder, body interface{}, contentType string) map[string]interface{} {
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return map[string]interface{}{
+		contentType: map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(body))},
+	}
+}
+
+// schemaBuilder derives JSON schemas from Go types, collecting named structs
+// as components so each is described once
+type schemaBuilder struct {
+	schemas map[string]interface{}
+}
+
+// schema returns the schema of t, or a reference to it for named structs
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := b.schema(t.Elem())
+		if _, isRef := s["$ref"]; !isRef {
+			s["nullable"] = true
+		}
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := b.schemas[t.Name()]; !ok {
+			// Register the name first so self-referencing types terminate
+			b.schemas[t.Name()] = nil
+			b.schemas[t.Name()] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema describes the JSON object encoding/json produces for t
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		s := b.schema(field.Type)
+		if doc, ok := schemaFieldDocs[t.Name()+"."+name]; ok {
+			if _, isRef := s["$ref"]; isRef {
+				s = map[string]interface{}{"allOf": []interface{}{s}}
+			}
+			s["description"] = doc
+		}
+		properties[name] = s
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
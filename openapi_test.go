@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// contract calls routes and checks each response against the OpenAPI
+// document: the status must be documented, and the body must have the
+// documented content type and match its schema
+type contract struct {
+	t       *testing.T
+	router  *mux.Router
+	paths   map[string]interface{}
+	schemas map[string]interface{}
+	covered map[string]bool
+}
+
+// newContract builds the router and its OpenAPI document
+func newContract(t *testing.T) *contract {
+	t.Helper()
+	router := newRouter()
+	var err error
+	openAPIDocument, err = buildOpenAPI(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths      map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPIDocument, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return &contract{t: t, router: router, paths: doc.Paths, schemas: doc.Components.Schemas, covered: map[string]bool{}}
+}
+
+// call sends a request with an optional JSON body and header name/value
+// pairs, checks the response against the document and returns it
+func (c *contract) call(method, target, body string, header ...string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, target, nil)
+	} else {
+		req = httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if method == "PATCH" {
+			req.Header.Set("Content-Type", mergePatchContentType)
+		}
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	// Streams run until the client goes away
+	ctx, cancel := context.WithTimeout(req.Context(), 200*time.Millisecond)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	rec := httptest.NewRecorder()
+	c.router.ServeHTTP(rec, req)
+	c.check(req, rec)
+	return rec
+}
+
+// check compares a response to the operation documented for the route that handled it
+func (c *contract) check(req *http.Request, rec *httptest.ResponseRecorder) {
+	c.t.Helper()
+	name := req.Method + " " + req.URL.Path
+
+	var match mux.RouteMatch
+	c.router.Match(req, &match)
+	if match.Route == nil {
+		// Unmatched paths and methods answer with an APIError
+		if rec.Code != http.StatusNotFound && rec.Code != http.StatusMethodNotAllowed {
+			c.t.Errorf("%s: unrouted request answered %d", name, rec.Code)
+		}
+		c.checkBody(name, rec, map[string]interface{}{"$ref": "#/components/schemas/APIError"})
+		return
+	}
+	template, err := match.Route.GetPathTemplate()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	op, _ := c.paths[template].(map[string]interface{})[strings.ToLower(req.Method)].(map[string]interface{})
+	if op == nil {
+		c.t.Errorf("%s: %s %s is not documented", name, req.Method, template)
+		return
+	}
+	c.covered[req.Method+" "+versionRelativePath(template)] = true
+
+	responses := op["responses"].(map[string]interface{})
+	response, ok := responses[strconv.Itoa(rec.Code)].(map[string]interface{})
+	if !ok {
+		if rec.Code < http.StatusBadRequest {
+			c.t.Errorf("%s: status %d is not documented", name, rec.Code)
+			return
+		}
+		response = responses["default"].(map[string]interface{})
+	}
+	headers, _ := response["headers"].(map[string]interface{})
+	if _, ok := headers["ETag"]; ok && rec.Header().Get("ETag") == "" {
+		c.t.Errorf("%s: documented ETag header is missing", name)
+	}
+
+	content, _ := response["content"].(map[string]interface{})
+	if content == nil {
+		if rec.Body.Len() > 0 {
+			c.t.Errorf("%s: status %d is documented without a body, got %q", name, rec.Code, rec.Body.String())
+		}
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	media, ok := content[contentType].(map[string]interface{})
+	if !ok {
+		c.t.Errorf("%s: content type %q is not documented for status %d", name, contentType, rec.Code)
+		return
+	}
+	if contentType == "application/json" {
+		c.checkBody(name, rec, media["schema"].(map[string]interface{}))
+	}
+}
+
+// checkBody decodes a JSON response and reports where it differs from schema
+func (c *contract) checkBody(name string, rec *httptest.ResponseRecorder, schema map[string]interface{}) {
+	c.t.Helper()
+	var body interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		c.t.Errorf("%s: invalid JSON body %q: %v", name, rec.Body.String(), err)
+		return
+	}
+	for _, problem := range c.validate(schema, body, "body") {
+		c.t.Errorf("%s (%d): %s", name, rec.Code, problem)
+	}
+}
+
+// validate returns the ways value doesn't match schema, which may refer to
+// the document's component schemas
+func (c *contract) validate(schema map[string]interface{}, value interface{}, at string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		component, _ := c.schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{})
+		if component == nil {
+			return []string{at + ": unknown schema " + ref}
+		}
+		return c.validate(component, value, at)
+	}
+
+	var problems []string
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range all {
+			problems = append(problems, c.validate(s.(map[string]interface{}), value, at)...)
+		}
+	}
+	if value == nil {
+		if schema["type"] != nil && schema["nullable"] != true {
+			problems = append(problems, at+": is null")
+		}
+		return problems
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: %v is not an object", at, value))
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		for key, v := range object {
+			if s, ok := properties[key].(map[string]interface{}); ok {
+				problems = append(problems, c.validate(s, v, at+"."+key)...)
+			} else if additional != nil {
+				problems = append(problems, c.validate(additional, v, at+"."+key)...)
+			} else {
+				problems = append(problems, at+"."+key+": is not documented")
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: %v is not an array", at, value))
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, v := range array {
+			problems = append(problems, c.validate(items, v, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			problems = append(problems, fmt.Sprintf("%s: %v is not a string", at, value))
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			problems = append(problems, fmt.Sprintf("%s: %v is not an integer", at, value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			problems = append(problems, fmt.Sprintf("%s: %v is not a number", at, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s: %v is not a boolean", at, value))
+		}
+	}
+	return problems
+}
+
+// completeMigrations lets requests through waitForMigrations until the test ends
+func completeMigrations(t *testing.T) {
+	setMigrationStatus(migrationsComplete)
+	t.Cleanup(resetMigrationStatus)
+}
+
+func TestContractWithoutDatabase(t *testing.T) {
+	resetMigrationStatus()
+	c := newContract(t)
+
+	if rec := c.call("GET", "/readyz", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz before migrating = %d, want 503", rec.Code)
+	}
+	completeMigrations(t)
+
+	c.call("GET", "/healthz", "")
+	c.call("GET", "/openapi.json", "")
+	c.call("GET", "/metrics", "")
+	c.call("GET", "/no-such-route", "")
+	c.call("DELETE", "/api/v1/media", "")
+
+	// Bodies are read before the database is touched
+	for _, target := range []string{"/api/v1/media", "/api/v1/artists", "/api/v1/labels", "/api/v1/media/bulk",
+		"/api/v1/media/merge", "/api/v1/artists/merge", "/api/v1/webhooks", "/api/v1/jobs", "/api/v1/graphql"} {
+		if rec := c.call("POST", target, "{"); rec.Code != http.StatusBadRequest {
+			t.Errorf("POST %s with a broken body = %d, want 400", target, rec.Code)
+		}
+	}
+	if rec := c.call("POST", "/api/v1/graphql", `{"query": "{ media(id: 1) { title }"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /api/v1/graphql with a broken query = %d, want 400", rec.Code)
+	}
+
+	// IDs are parsed before the database is touched
+	var operations []string
+	for key := range apiOperations {
+		operations = append(operations, key)
+	}
+	sort.Strings(operations)
+	for _, key := range operations {
+		parts := strings.SplitN(key, " ", 2)
+		method, path := parts[0], parts[1]
+		if !strings.Contains(path, "{id}") {
+			continue
+		}
+		target := apiV1.prefix + strings.Replace(path, "{id}", "x", 1)
+		if rec := c.call(method, target, "{}", "If-Match", `"1"`); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %s = %d, want 400", method, target, rec.Code)
+		}
+	}
+}
+
+// openTestDB connects db to the scratch database named by RECORD_TEST_DB_NAME,
+// creating and migrating it if needed, and skips the test if it isn't set.
+// The connection is configured by the usual RECORD_ variables.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	dbName := os.Getenv("RECORD_TEST_DB_NAME")
+	if dbName == "" {
+		t.Skip("RECORD_TEST_DB_NAME is not set")
+	}
+	config := defaultConfig()
+	if err := applyEnv(config, os.LookupEnv); err != nil {
+		t.Fatal(err)
+	}
+	config.DBName = dbName
+	if err := initDB(config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		resetMigrationStatus()
+	})
+}
+
+// TestContract calls every documented route against a real database. It
+// runs when RECORD_TEST_DB_NAME names a scratch database, which it creates
+// if needed and fills with test data; the connection is configured by the
+// usual RECORD_ variables.
+func TestContract(t *testing.T) {
+	openTestDB(t)
+
+	result, err := db.Exec(`INSERT INTO formats (name, description) VALUES ('Contract LP', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatID, _ := result.LastInsertId()
+
+	c := newContract(t)
+	v1 := apiV1.prefix
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	// send calls a route, fails on a server error or a status other than
+	// want, if given, and decodes the response into out, if given
+	send := func(want int, out interface{}, method, target, body string, header ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := c.call(method, target, body, header...)
+		if rec.Code >= http.StatusInternalServerError || (want != 0 && rec.Code != want) {
+			t.Fatalf("%s %s = %d, want %d: %s", method, target, rec.Code, want, rec.Body.String())
+		}
+		if out != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+				t.Fatalf("%s %s: %v", method, target, err)
+			}
+		}
+		return rec
+	}
+	id := func(prefix string, id interface{}) string { return fmt.Sprintf("%s%s/%v", v1, prefix, id) }
+	// created returns the ID of a row a create route inserted, as those
+	// routes answer without a body
+	created := func(query string, args ...interface{}) int {
+		t.Helper()
+		var id int
+		if err := db.QueryRow(query, args...).Scan(&id); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return id
+	}
+
+	c.call("GET", "/healthz", "")
+	send(http.StatusOK, nil, "GET", "/readyz", "")
+	c.call("GET", "/metrics", "")
+	c.call("GET", "/openapi.json", "")
+
+	var artist, otherArtist Artist
+	send(http.StatusCreated, nil, "POST", v1+"/artists", `{"name": "Contract Artist `+suffix+`", "aliases": ["CA `+suffix+`"]}`)
+	send(http.StatusCreated, nil, "POST", v1+"/artists", `{"name": "Contract Artist `+suffix+`s"}`)
+	artist.ID = created(`SELECT id FROM artists WHERE name = ?`, "Contract Artist "+suffix)
+	otherArtist.ID = created(`SELECT id FROM artists WHERE name = ?`, "Contract Artist "+suffix+"s")
+	send(http.StatusOK, nil, "GET", v1+"/artists", "")
+	send(0, nil, "GET", v1+"/artists/duplicates", "")
+	rec := send(http.StatusOK, &artist, "GET", id("/artists", artist.ID), "")
+	send(http.StatusPreconditionRequired, nil, "PUT", id("/artists", artist.ID), `{"name": "Contract Artist `+suffix+`"}`)
+	send(http.StatusPreconditionFailed, nil, "PUT", id("/artists", artist.ID), `{"name": "Contract Artist `+suffix+`"}`, "If-Match", `"0"`)
+	send(http.StatusOK, &artist, "PUT", id("/artists", artist.ID), `{"name": "Contract Artist `+suffix+`", "country": "NZ"}`,
+		"If-Match", rec.Header().Get("ETag"))
+	var artistHistory []AuditEntry
+	send(http.StatusOK, &artistHistory, "GET", id("/artists", artist.ID)+"/history", "")
+	rec = send(http.StatusOK, &artist, "GET", id("/artists", artist.ID), "")
+	send(http.StatusOK, &artist, "POST", id("/artists", artist.ID)+"/revert", fmt.Sprintf(`{"audit_id": %d}`, artistHistory[len(artistHistory)-1].ID),
+		"If-Match", rec.Header().Get("ETag"))
+	send(http.StatusOK, &otherArtist, "GET", id("/artists", otherArtist.ID), "")
+	send(http.StatusNoContent, nil, "POST", v1+"/artists/merge",
+		fmt.Sprintf(`{"survivor_id": %d, "duplicate_ids": [%d], "versions": {"%d": %d, "%d": %d}}`,
+			artist.ID, otherArtist.ID, artist.ID, artist.Version, otherArtist.ID, otherArtist.Version))
+
+	var label, sublabel Label
+	send(http.StatusCreated, nil, "POST", v1+"/labels", `{"name": "Contract Label `+suffix+`", "catalog_prefixes": ["CT`+suffix+`"]}`)
+	label.ID = created(`SELECT id FROM labels WHERE name = ?`, "Contract Label "+suffix)
+	send(http.StatusCreated, nil, "POST", v1+"/labels", fmt.Sprintf(`{"name": "Contract Sublabel %s", "parent_id": %d}`, suffix, label.ID))
+	sublabel.ID = created(`SELECT id FROM labels WHERE name = ?`, "Contract Sublabel "+suffix)
+	send(http.StatusOK, nil, "GET", v1+"/labels", "")
+	send(http.StatusOK, nil, "GET", id("/labels", label.ID), "")
+	send(http.StatusOK, nil, "PUT", id("/labels", sublabel.ID), fmt.Sprintf(`{"name": "Contract Imprint %s", "parent_id": %d}`, suffix, label.ID))
+	var labelHistory []AuditEntry
+	send(http.StatusOK, &labelHistory, "GET", id("/labels", sublabel.ID)+"/history", "")
+	send(http.StatusOK, nil, "POST", id("/labels", sublabel.ID)+"/revert", fmt.Sprintf(`{"audit_id": %d}`, labelHistory[len(labelHistory)-1].ID))
+	send(http.StatusBadRequest, nil, "PUT", id("/labels", sublabel.ID), `{"name": "Orphan", "parent_id": 2147483647}`)
+
+	mediaBody := func(title, barcode string) string {
+		return fmt.Sprintf(`{"title": %q, "artist_id": %d, "format_id": %d, "date_published": "1999-04", "genre_tags": ["Rock"],
+			"barcode": %q, "catalog_number": "CT%s-1", "tracks": [{"position": "A1", "title": "Opening"}]}`,
+			title, artist.ID, formatID, barcode, suffix)
+	}
+	barcode := fmt.Sprintf("%013d", time.Now().UnixNano()%1e13)
+	var media, otherMedia Media
+	send(http.StatusCreated, nil, "POST", v1+"/media", mediaBody("Contract Album "+suffix, barcode))
+	send(http.StatusCreated, nil, "POST", v1+"/media", mediaBody("Contract Album "+suffix+"!", ""))
+	media.ID = created(`SELECT id FROM media WHERE title = ?`, "Contract Album "+suffix)
+	otherMedia.ID = created(`SELECT id FROM media WHERE title = ?`, "Contract Album "+suffix+"!")
+	send(http.StatusOK, nil, "GET", v1+"/media", "")
+	send(http.StatusOK, nil, "GET", v1+"/media/lookup?barcode="+barcode, "")
+	send(0, nil, "GET", v1+"/media/duplicates", "")
+	send(http.StatusOK, nil, "GET", id("/labels", label.ID)+"/discography", "")
+
+	rec = send(http.StatusOK, nil, "GET", id("/media", media.ID), "")
+	rec = send(http.StatusOK, nil, "PUT", id("/media", media.ID), mediaBody("Contract Album "+suffix, barcode),
+		"If-Match", rec.Header().Get("ETag"))
+	rec = send(http.StatusOK, nil, "PATCH", id("/media", media.ID), `{"image_url": "https://example.com/cover.jpg"}`,
+		"If-Match", rec.Header().Get("ETag"))
+	var mediaHistory []AuditEntry
+	send(http.StatusOK, &mediaHistory, "GET", id("/media", media.ID)+"/history", "")
+	send(http.StatusOK, &media, "POST", id("/media", media.ID)+"/revert", fmt.Sprintf(`{"audit_id": %d}`, mediaHistory[len(mediaHistory)-1].ID),
+		"If-Match", rec.Header().Get("ETag"))
+
+	var bulk BulkResponse
+	send(http.StatusOK, &bulk, "POST", v1+"/media/bulk", fmt.Sprintf(`{"operations": [{"op": "add-genre", "id": %d, "version": %d, "genre": "Jazz"}]}`,
+		media.ID, media.Version))
+	media.Version = bulk.Results[0].Media.Version
+	send(http.StatusUnprocessableEntity, nil, "POST", v1+"/media/bulk", fmt.Sprintf(`{"operations": [{"op": "delete", "id": %d, "version": %d}]}`,
+		media.ID, media.Version+1))
+	send(http.StatusOK, &otherMedia, "GET", id("/media", otherMedia.ID), "")
+	send(http.StatusNoContent, nil, "POST", v1+"/media/merge",
+		fmt.Sprintf(`{"survivor_id": %d, "duplicate_ids": [%d], "versions": {"%d": %d, "%d": %d}}`,
+			media.ID, otherMedia.ID, media.ID, media.Version, otherMedia.ID, otherMedia.Version))
+
+	rec = send(http.StatusOK, nil, "GET", id("/media", media.ID), "")
+	send(http.StatusNoContent, nil, "DELETE", id("/media", media.ID), "", "If-Match", rec.Header().Get("ETag"))
+	send(http.StatusOK, nil, "GET", v1+"/media/trash", "")
+	send(http.StatusOK, nil, "POST", id("/media", media.ID)+"/restore", "")
+
+	send(http.StatusOK, nil, "POST", v1+"/graphql", fmt.Sprintf(`{"query": "{ media(id: %d) { title } }"}`, media.ID))
+	send(http.StatusBadRequest, nil, "POST", v1+"/graphql", `{"query": "mutation { x }"}`)
+	send(http.StatusOK, nil, "GET", v1+"/events?type=media", "")
+
+	username := "contract" + suffix
+	send(http.StatusCreated, nil, "POST", v1+"/users", fmt.Sprintf(`{"username": %q, "email": "%s@example.com", "password": "correct horse"}`, username, username))
+	userID := created(`SELECT id FROM users WHERE username = ?`, username)
+	send(http.StatusOK, nil, "GET", id("/users", userID), "")
+	send(http.StatusOK, nil, "PUT", id("/users", userID), fmt.Sprintf(`{"username": %q, "email": "%s@example.com", "first_name": "Con"}`, username, username))
+	send(http.StatusUnprocessableEntity, nil, "PUT", id("/users", userID), `{"username": "x", "email": "nope"}`)
+
+	var webhook Webhook
+	send(http.StatusCreated, &webhook, "POST", v1+"/webhooks", `{"url": "https://example.com/hook", "event_types": ["media"]}`)
+	send(http.StatusOK, nil, "GET", v1+"/webhooks", "")
+	send(http.StatusOK, nil, "GET", id("/webhooks", webhook.ID), "")
+	send(http.StatusOK, nil, "PUT", id("/webhooks", webhook.ID), `{"url": "https://example.com/hook2", "event_types": ["media.create"]}`)
+	send(http.StatusOK, nil, "GET", id("/webhooks", webhook.ID)+"/deliveries", "")
+	send(http.StatusOK, nil, "GET", v1+"/webhooks/dead-letters", "")
+	send(http.StatusNotFound, nil, "POST", v1+"/webhooks/deliveries/0/retry", "")
+	send(http.StatusNoContent, nil, "DELETE", id("/webhooks", webhook.ID), "")
+
+	var job Job
+	send(0, &job, "POST", v1+"/jobs", `{"type": "normalize-genres"}`)
+	send(http.StatusOK, nil, "GET", v1+"/jobs", "")
+	send(0, nil, "GET", id("/jobs", job.ID), "")
+	send(0, nil, "POST", id("/jobs", job.ID)+"/cancel", "")
+
+	send(0, nil, "POST", v1+"/enrichment/run", "")
+	send(http.StatusOK, nil, "GET", v1+"/enrichment/reviews", "")
+	send(http.StatusNotFound, nil, "POST", v1+"/enrichment/reviews/0/approve", "")
+	send(http.StatusNotFound, nil, "POST", v1+"/enrichment/reviews/0/reject", "")
+
+	for key := range apiOperations {
+		if !c.covered[key] {
+			t.Errorf("%s was not called", key)
+		}
+	}
+}
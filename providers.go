@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// providerUserAgent identifies us to external metadata services
+const providerUserAgent = "record-collection-backend/1.0 (https://github.com/cameronfenton/record-collection)"
+
+// throttle spaces out calls so that at most one happens per interval
+type throttle struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     time.Time
+}
+
+// wait blocks until the next call is allowed
+func (t *throttle) wait() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if next := t.last.Add(t.interval); time.Now().Before(next) {
+		time.Sleep(time.Until(next))
+	}
+	t.last = time.Now()
+}
+
+// providerClient is the HTTP plumbing shared by the metadata providers
+type providerClient struct {
+	baseURL string
+	headers map[string]string
+	http    *http.Client
+	limit   *throttle
+}
+
+// newProviderClient creates a client for baseURL that makes at most one request per interval
+func newProviderClient(baseURL string, interval time.Duration) *providerClient {
+	return &providerClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		headers: map[string]string{},
+		http:    &http.Client{Timeout: 15 * time.Second},
+		limit:   &throttle{interval: interval},
+	}
+}
+
+// getJSON fetches path relative to the base URL and decodes the JSON response into out.
+// A 404 response is reported as ErrReleaseNotFound.
+func (c *providerClient) getJSON(path string, out interface{}) error {
+	c.limit.wait()
+
+	req, err := http.NewRequest("GET", c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", providerUserAgent)
+	req.Header.Set("Accept", "application/json")
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrReleaseNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// newMetadataProvider returns the provider selected in the config, or nil if none is configured
+func newMetadataProvider(config *Config) (MetadataProvider, error) {
+	switch strings.ToLower(config.MetadataProvider) {
+	case "":
+		return nil, nil
+	case "musicbrainz":
+		return NewMusicBrainzProvider(config.MusicBrainzURL), nil
+	case "discogs":
+		return NewDiscogsProvider(config.DiscogsURL, config.DiscogsToken), nil
+	default:
+		return nil, fmt.Errorf("unknown metadata provider %q", config.MetadataProvider)
+	}
+}
+
+// formatForReleaseType maps a release type such as "Album" or "EP" to one of our format names
+func formatForReleaseType(medium, releaseType string) string {
+	medium = strings.ToLower(medium)
+	switch {
+	case strings.Contains(medium, "blu-ray"):
+		return "Blu-ray"
+	case strings.Contains(medium, "dvd"):
+		return "DVD"
+	case strings.Contains(medium, "cd"):
+		return "CD"
+	}
+	switch strings.ToLower(releaseType) {
+	case "ep":
+		return "EP"
+	case "single":
+		return "Single"
+	default:
+		return "LP"
+	}
+}
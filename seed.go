@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+)
+
+// seedStep is one unit of seed data, applied at most once per checksum
+type seedStep struct {
+	Name string
+	// Checksum identifies the content; a changed file gets a new checksum and is applied again
+	Checksum func() (string, error)
+	Apply    func() error
+}
+
+// seedProfiles lists the fixture profiles accepted by the seed command
+var seedProfiles = map[string][]seedStep{
+	// empty has only the reference formats needed to create media
+	"empty": {fileSeed("formats.json", importFormatsByFile)},
+	// demo adds the sample catalog in media.json
+	"demo": {fileSeed("formats.json", importFormatsByFile), fileSeed("media.json", importMediaByFile)},
+	// large adds a generated catalog for exercising paging and search
+	"large": {
+		fileSeed("formats.json", importFormatsByFile),
+		fileSeed("media.json", importMediaByFile),
+		syntheticSeed(syntheticArtists, syntheticMediaPerArtist),
+	},
+}
+
+// Size of the catalog generated by the large profile
+const (
+	syntheticArtists        = 500
+	syntheticMediaPerArtist = 20
+)
+
+// fileSeed seeds from a JSON file, identified by the SHA-256 of its contents
+func fileSeed(filename string, apply func(string) error) seedStep {
+	return seedStep{
+		Name: filename,
+		Checksum: func() (string, error) {
+			file, err := os.Open(filename)
+			if err != nil {
+				return "", err
+			}
+			defer file.Close()
+
+			hash := sha256.New()
+			if _, err := io.Copy(hash, file); err != nil {
+				return "", err
+			}
+			return hex.EncodeToString(hash.Sum(nil)), nil
+		},
+		Apply: func() error { return apply(filename) },
+	}
+}
+
+// syntheticSeed generates a deterministic catalog of artists*perArtist media
+func syntheticSeed(artists, perArtist int) seedStep {
+	params := fmt.Sprintf("synthetic:v1:%d:%d", artists, perArtist)
+	return seedStep{
+		Name: "synthetic",
+		Checksum: func() (string, error) {
+			sum := sha256.Sum256([]byte(params))
+			return hex.EncodeToString(sum[:]), nil
+		},
+		Apply: func() error { return importMedia(importerActor, syntheticMedia(artists, perArtist)) },
+	}
+}
+
+// syntheticMedia builds a repeatable list of made-up media
+func syntheticMedia(artists, perArtist int) []Media {
+	random := rand.New(rand.NewSource(1))
+	formats := []string{"LP", "EP", "Single", "CD"}
+	genres := []string{"Rock", "Jazz", "Soul", "Folk", "Electronic", "Blues", "Punk", "Hip Hop", "Classical", "Reggae"}
+
+	media := make([]Media, 0, artists*perArtist)
+	for a := 1; a <= artists; a++ {
+		artist := fmt.Sprintf("Synthetic Artist %04d", a)
+		for n := 1; n <= perArtist; n++ {
+			tags := []string{genres[random.Intn(len(genres))]}
+			if extra := genres[random.Intn(len(genres))]; extra != tags[0] {
+				tags = append(tags, extra)
+			}
+			media = append(media, Media{
+				Title:         fmt.Sprintf("Volume %d", n),
+				ArtistName:    artist,
+				FormatName:    formats[random.Intn(len(formats))],
+				DatePublished: fmt.Sprintf("%d-%02d-%02d", 1950+random.Intn(75), 1+random.Intn(12), 1+random.Intn(28)),
+				GenreTags:     tags,
+			})
+		}
+	}
+	return media
+}
+
+// seed applies the steps of a profile, skipping any already applied with the
+// same checksum unless force is set. It stops between steps once ctx is
+// cancelled, and reports the steps done to progress if it isn't nil.
+func seed(ctx context.Context, profile string, force bool, progress func(done, total int)) error {
+	steps, ok := seedProfiles[profile]
+	if !ok {
+		return fmt.Errorf("unknown seed profile %q (choose from %s)", profile, strings.Join(seedProfileNames(), ", "))
+	}
+
+	for i, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(i, len(steps))
+		}
+		checksum, err := step.Checksum()
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %v", step.Name, err)
+		}
+
+		var appliedID int
+		err = db.QueryRow(`SELECT id FROM seed_files WHERE name = ? AND checksum = ?`, step.Name, checksum).Scan(&appliedID)
+		if err == nil && !force {
+			log.Printf("Seed %s already applied, skipping", step.Name)
+			seedStepsTotal.inc("skipped")
+			continue
+		} else if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		log.Printf("Applying seed %s...", step.Name)
+		if err := step.Apply(); err != nil {
+			return fmt.Errorf("failed to apply %s: %v", step.Name, err)
+		}
+		_, err = db.Exec(`INSERT IGNORE INTO seed_files (name, checksum) VALUES (?, ?)`, step.Name, checksum)
+		if err != nil {
+			return err
+		}
+		seedStepsTotal.inc("applied")
+	}
+	if progress != nil {
+		progress(len(steps), len(steps))
+	}
+	return nil
+}
+
+// seedProfileNames returns the available profiles in order
+func seedProfileNames() []string {
+	var names []string
+	for name := range seedProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runSeedCommand implements the seed subcommand:
+//
+//	record-collection-backend seed [-config path] [-profile demo] [-force]
+func runSeedCommand(args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to a JSON config file (default: config.json if present)")
+	profile := flags.String("profile", "demo", "fixture profile: "+strings.Join(seedProfileNames(), ", "))
+	force := flags.Bool("force", false, "apply seed files even if they were applied before")
+	flags.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	err = initDB(config)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	return seed(context.Background(), *profile, *force, nil)
+}
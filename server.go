@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// newServer builds the HTTP server with the timeouts from the config
+func newServer(config *Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + config.ServerPort,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ServerReadTimeout.Duration,
+		ReadTimeout:       config.ServerReadTimeout.Duration,
+		WriteTimeout:      config.ServerWriteTimeout.Duration,
+		IdleTimeout:       config.ServerIdleTimeout.Duration,
+	}
+}
+
+// serve runs the server until it fails, receives SIGINT or SIGTERM, or an
+// error arrives on failed. It then stops accepting connections and waits up
+// to shutdown_timeout for in-flight requests to finish.
+func serve(config *Config, handler http.Handler, failed <-chan error) error {
+	server := newServer(config, handler)
+	// Event streams never finish on their own, so end them on shutdown
+	server.RegisterOnShutdown(changeEvents.close)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		var err error
+		if config.TLSCertFile != "" {
+			log.Printf("Starting server with TLS on port %s...", config.ServerPort)
+			err = server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			log.Printf("Starting server on port %s...", config.ServerPort)
+			err = server.ListenAndServe()
+		}
+		errs <- err
+	}()
+
+	var failure error
+	select {
+	case err := <-errs:
+		return err
+	case failure = <-failed:
+		log.Printf("Startup failed: %v", failure)
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for requests to finish...", config.ServerShutdownTimeout)
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ServerShutdownTimeout.Duration)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Server stopped")
+	return failure
+}
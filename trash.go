@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// purgeActor makes the changes applied by the scheduled trash purge
+var purgeActor = auditActor{Name: "trash-purge"}
+
+// getTrash handles retrieving the media in the trash, most recently deleted first
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(selectMediaQuery + ` WHERE m.deleted_at IS NOT NULL ORDER BY m.deleted_at DESC, m.id`)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve trash", err)
+		return
+	}
+	defer rows.Close()
+
+	media := []Media{}
+	for rows.Next() {
+		m, err := scanMedia(rows)
+		if err != nil {
+			writeInternalError(w, r, "Failed to scan media", err)
+			return
+		}
+		media = append(media, m)
+	}
+	if err := rows.Err(); err != nil {
+		writeInternalError(w, r, "Error iterating over media", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(media)
+}
+
+// restoreMedia handles taking a media back out of the trash by ID
+func restoreMedia(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid media ID")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to restore media", err)
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := loadMedia(tx, id)
+	if err == nil && before.DeletedAt == "" {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Media not found in trash")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to retrieve media", err)
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE media SET deleted_at = NULL, version = version + 1 WHERE id = ?`, id)
+	var after Media
+	if err == nil {
+		after, err = loadMedia(tx, id)
+	}
+	if err == nil {
+		err = recordAudit(tx, requestActor(r), auditMedia, id, auditRestore, before, after)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeInternalError(w, r, "Failed to restore media", err)
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(after.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(after)
+}
+
+// purgeTrash permanently deletes media that have been in the trash for longer
+// than retention, removing them from any collections first. It returns the
+// number of media purged.
+func purgeTrash(retention time.Duration) (int, error) {
+	rows, err := db.Query(`SELECT id FROM media WHERE deleted_at < NOW() - INTERVAL ? SECOND ORDER BY id`, int64(retention.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, id := range ids {
+		if err := purgeMedia(id); err != nil {
+			return purged, fmt.Errorf("failed to purge media %d: %v", id, err)
+		}
+		purged++
+		mediaPurgedTotal.inc()
+	}
+	return purged, nil
+}
+
+// purgeMedia permanently deletes one trashed media in its own transaction
+func purgeMedia(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := loadMedia(tx, id)
+	if err != nil {
+		return err
+	}
+	owners, err := collectionOwners(tx, id)
+	if err != nil {
+		return err
+	}
+	collections := make([]collectionSnapshot, len(owners))
+	for i, userID := range owners {
+		if collections[i], err = loadCollection(tx, userID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM user_media WHERE media_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM media WHERE id = ? AND deleted_at IS NOT NULL`, id); err != nil {
+		return err
+	}
+
+	for _, beforeCollection := range collections {
+		afterCollection, err := loadCollection(tx, beforeCollection.UserID)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(tx, purgeActor, auditCollection, beforeCollection.UserID, auditUpdate, beforeCollection, afterCollection); err != nil {
+			return err
+		}
+	}
+	if err := recordAudit(tx, purgeActor, auditMedia, id, auditPurge, before, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// startTrashPurge purges the trash every interval until the returned stop
+// function is called. A zero retention disables purging.
+func startTrashPurge(retention, interval time.Duration) (stop func()) {
+	if retention <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			purged, err := purgeTrash(retention)
+			if err != nil {
+				log.Printf("Trash purge failed: %v", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d media from the trash", purged)
+			}
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
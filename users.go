@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// passwordIterations is the PBKDF2-HMAC-SHA256 work factor for stored passwords
+const passwordIterations = 210000
+
+// errUsernameTaken is returned when a username already belongs to another user
+var errUsernameTaken = &requestError{http.StatusConflict, "Username is already taken"}
+
+// hashPassword returns the PBKDF2-HMAC-SHA256 hash of password with a new
+// random salt, as "pbkdf2-sha256$iterations$salt$hash"
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, hex.EncodeToString(salt), hex.EncodeToString(key)), nil
+}
+
+// pbkdf2SHA256 derives a 32-byte key from password and salt (RFC 8018)
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// loadUser returns a user without their password
+func loadUser(q dbExecutor, id int) (User, error) {
+	var u User
+	err := q.QueryRow(`SELECT id, IFNULL(first_name, ''), IFNULL(last_name, ''), IFNULL(username, ''), IFNULL(email, '') FROM users WHERE id = ?`, id).
+		Scan(&u.ID, &u.FirstName, &u.LastName, &u.Username, &u.Email)
+	return u, err
+}
+
+// checkUsernameFree fails with errUsernameTaken if another user has the username
+func checkUsernameFree(q dbExecutor, username string, id int) error {
+	var otherID int
+	err := q.QueryRow(`SELECT id FROM users WHERE username = ? AND id <> ? LIMIT 1`, username, id).Scan(&otherID)
+	if err == nil {
+		return errUsernameTaken
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// insertUserTx validates u and inserts it, returning the new ID
+func insertUserTx(tx *sql.Tx, u User) (int, error) {
+	if err := u.Validate(); err != nil {
+		return 0, err
+	}
+	if err := checkUsernameFree(tx, u.Username, 0); err != nil {
+		return 0, err
+	}
+	var password interface{}
+	if u.Password != "" {
+		hash, err := hashPassword(u.Password)
+		if err != nil {
+			return 0, err
+		}
+		password = hash
+	}
+	result, err := tx.Exec(`INSERT INTO users (first_name, last_name, username, email, password) VALUES (?, ?, ?, ?, ?)`,
+		u.FirstName, u.LastName, u.Username, u.Email, password)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// getUserById handles retrieving a user by ID; the password is never returned
+func getUserById(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	u, err := loadUser(db, id)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to retrieve user", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// createUser handles the creation of a new user
+func createUser(w http.ResponseWriter, r *http.Request) {
+	var u User
+	err := json.NewDecoder(r.Body).Decode(&u)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if err := u.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to create user", err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = insertUserTx(tx, u)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeRequestError(w, r, "Failed to create user", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// updateUser handles updating an existing user by ID. The password is only
+// changed when one is given.
+func updateUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var u User
+	err = json.NewDecoder(r.Body).Decode(&u)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if err := u.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "Failed to update user", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = loadUser(tx, id); err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	if err == nil {
+		err = checkUsernameFree(tx, u.Username, id)
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE users SET first_name = ?, last_name = ?, username = ?, email = ? WHERE id = ?`,
+			u.FirstName, u.LastName, u.Username, u.Email, id)
+	}
+	if err == nil && u.Password != "" {
+		var hash string
+		if hash, err = hashPassword(u.Password); err == nil {
+			_, err = tx.Exec(`UPDATE users SET password = ? WHERE id = ?`, hash, id)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeRequestError(w, r, "Failed to update user", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
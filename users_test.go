@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// validationFields returns the fields err reports problems with
+func validationFields(err error) []string {
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		return nil
+	}
+	var fields []string
+	for _, f := range invalid.Fields {
+		fields = append(fields, f.Field)
+	}
+	return fields
+}
+
+func TestUserValidate(t *testing.T) {
+	valid := func() User {
+		return User{Username: "jo.smith", Email: "jo@example.com", FirstName: "Jo", LastName: "Smith", Password: "correct horse"}
+	}
+	tests := []struct {
+		name   string
+		change func(u *User)
+		want   string // The field that should fail, or "" if none
+	}{
+		{"valid", func(u *User) {}, ""},
+		{"no password", func(u *User) { u.Password = "" }, ""},
+		{"username missing", func(u *User) { u.Username = "  " }, "username"},
+		{"username too short", func(u *User) { u.Username = "jo" }, "username"},
+		{"username too long", func(u *User) { u.Username = strings.Repeat("j", 33) }, "username"},
+		{"username leading dot", func(u *User) { u.Username = ".jo" }, "username"},
+		{"username with space", func(u *User) { u.Username = "jo smith" }, "username"},
+		{"email missing", func(u *User) { u.Email = "" }, "email"},
+		{"email without at", func(u *User) { u.Email = "jo.example.com" }, "email"},
+		{"email with display name", func(u *User) { u.Email = "Jo <jo@example.com>" }, "email"},
+		{"email without dotted domain", func(u *User) { u.Email = "jo@localhost" }, "email"},
+		{"email too long", func(u *User) { u.Email = strings.Repeat("j", 250) + "@example.com" }, "email"},
+		{"first name too long", func(u *User) { u.FirstName = strings.Repeat("j", maxNameLength+1) }, "first_name"},
+		{"last name too long", func(u *User) { u.LastName = strings.Repeat("s", maxNameLength+1) }, "last_name"},
+		{"password too short", func(u *User) { u.Password = "hunter2" }, "password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := valid()
+			tt.change(&u)
+			fields := validationFields(u.Validate())
+			if tt.want == "" && len(fields) > 0 {
+				t.Errorf("Validate failed %v, want no errors", fields)
+			}
+			if tt.want != "" && (len(fields) != 1 || fields[0] != tt.want) {
+				t.Errorf("Validate failed %v, want only %s", fields, tt.want)
+			}
+		})
+	}
+
+	u := User{Username: " jos ", Email: " jo@example.com ", FirstName: " Jo "}
+	if err := u.Validate(); err != nil || u.Username != "jos" || u.Email != "jo@example.com" || u.FirstName != "Jo" {
+		t.Errorf("Validate = %v, user = %+v; want trimmed fields", err, u)
+	}
+}
+
+func TestValidateImportUsersJob(t *testing.T) {
+	err := validateImportUsersJob([]byte(`{"users": [{"username": "jo", "email": "jo@example.com"}, {"username": "sam", "email": "nope"}]}`))
+	fields := validationFields(err)
+	if len(fields) != 2 || fields[0] != "payload.users[0].username" || fields[1] != "payload.users[1].email" {
+		t.Errorf("fields = %v, want payload.users[0].username and payload.users[1].email", fields)
+	}
+	if fields := validationFields(validateImportUsersJob([]byte(`{"users": []}`))); len(fields) != 1 || fields[0] != "payload.users" {
+		t.Errorf("empty import: fields = %v", fields)
+	}
+	if err := validateImportUsersJob([]byte(`{"users": [{"username": "sam", "email": "sam@example.com"}]}`)); err != nil {
+		t.Errorf("valid import: %v", err)
+	}
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// Test vectors for PBKDF2-HMAC-SHA256 with P = "password" and S = "salt"
+	tests := []struct {
+		iterations int
+		want       string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(pbkdf2SHA256([]byte("password"), []byte("salt"), tt.iterations)); got != tt.want {
+			t.Errorf("%d iterations = %s, want %s", tt.iterations, got, tt.want)
+		}
+	}
+
+	hash, err := hashPassword("correct horse")
+	if err != nil || !strings.HasPrefix(hash, "pbkdf2-sha256$") || strings.Contains(hash, "correct horse") {
+		t.Errorf("hashPassword = %q, %v", hash, err)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FieldError describes a problem with a single field of a payload
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every field problem found in a payload
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		problems[i] = f.Field + ": " + f.Message
+	}
+	return "invalid " + strings.Join(problems, "; ")
+}
+
+// validator accumulates field errors while a payload is checked
+type validator struct {
+	fields []FieldError
+}
+
+// fail records a problem with field
+func (v *validator) fail(field, format string, args ...interface{}) {
+	v.fields = append(v.fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// required fails field if value is blank
+func (v *validator) required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.fail(field, "is required")
+		return false
+	}
+	return true
+}
+
+// maxLength fails field if value has more than max characters
+func (v *validator) maxLength(field, value string, max int) {
+	if utf8.RuneCountInString(value) > max {
+		v.fail(field, "must be at most %d characters", max)
+	}
+}
+
+// err returns the collected problems, or nil if there were none
+func (v *validator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: v.fields}
+}
+
+// Length limits, matching the column sizes where the schema has them
+const (
+	maxTitleLength         = 255
+	maxNameLength          = 255
+	maxDescriptionLength   = 1000
+	maxURLLength           = 2048
+	maxCatalogNumberLength = 64
+	maxCatalogPrefixLength = 32
+	maxCountryLength       = 64
+	maxAliases             = 50
+	maxGenreTags           = 20
+	maxGenreTagLength      = 50
+	maxTracks              = 500
+	maxTrackPositionLength = 16
+	maxTrackLengthLength   = 16
+	maxEmailLength         = 254
+	minPasswordLength      = 8
+)
+
+// Accepted release date layouts: a full ISO date, or a partial one when only
+// the year or month is known
+var dateLayouts = []string{"2006-01-02", "2006-01", "2006"}
+
+// validDate reports whether value is YYYY, YYYY-MM or YYYY-MM-DD and a real date
+func validDate(value string) bool {
+	for _, layout := range dateLayouts {
+		if len(value) != len(layout) {
+			continue
+		}
+		if _, err := time.Parse(layout, value); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// validURL reports whether value is an absolute http or https URL
+func validURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// barcodePattern matches UPC-A, EAN-8, EAN-13 and similar numeric barcodes once normalized
+var barcodePattern = regexp.MustCompile(`^[0-9]{8,14}$`)
+
+// usernamePattern allows letters, digits, dots, dashes and underscores, starting with a letter or digit
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{2,31}$`)
+
+// normalize trims free-text fields and drops blank genre tags
+func (m *Media) normalize() {
+	m.Title = strings.TrimSpace(m.Title)
+	m.ArtistName = strings.TrimSpace(m.ArtistName)
+	m.FormatName = strings.TrimSpace(m.FormatName)
+	m.DatePublished = strings.TrimSpace(m.DatePublished)
+	m.ImageURL = strings.TrimSpace(m.ImageURL)
+	m.Barcode = normalizeBarcode(m.Barcode)
+	m.CatalogNumber = strings.TrimSpace(m.CatalogNumber)
+	m.LabelName = strings.TrimSpace(m.LabelName)
+
+	tags := []string{}
+	for _, tag := range m.GenreTags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	m.GenreTags = tags
+}
+
+// Validate normalizes and checks a media payload. The artist and format may
+// be given by ID or by name, as the importers do.
+func (m *Media) Validate() error {
+	var v validator
+
+	m.normalize()
+
+	if v.required("title", m.Title) {
+		v.maxLength("title", m.Title, maxTitleLength)
+	}
+	if m.ArtistID == 0 && v.required("artist", m.ArtistName) {
+		v.maxLength("artist", m.ArtistName, maxNameLength)
+	} else if m.ArtistID < 0 {
+		v.fail("artist_id", "must be a positive ID")
+	}
+	if m.FormatID == 0 {
+		v.required("format", m.FormatName)
+	} else if m.FormatID < 0 {
+		v.fail("format_id", "must be a positive ID")
+	}
+	if m.DatePublished != "" && !validDate(m.DatePublished) {
+		v.fail("date_published", "must be a date in the form YYYY, YYYY-MM or YYYY-MM-DD")
+	}
+	if m.ImageURL != "" {
+		if !validURL(m.ImageURL) {
+			v.fail("image_url", "must be an absolute http or https URL")
+		}
+		v.maxLength("image_url", m.ImageURL, maxURLLength)
+	}
+	validateGenreTags(&v, "genre_tags", m.GenreTags)
+	if m.Barcode != "" && !barcodePattern.MatchString(m.Barcode) {
+		v.fail("barcode", "must be 8 to 14 digits")
+	}
+	v.maxLength("catalog_number", m.CatalogNumber, maxCatalogNumberLength)
+	v.maxLength("label", m.LabelName, maxNameLength)
+	if m.LabelID != nil && *m.LabelID <= 0 {
+		v.fail("label_id", "must be a positive ID")
+	}
+
+	if len(m.Tracks) > maxTracks {
+		v.fail("tracks", "must have at most %d entries", maxTracks)
+	}
+	for i, t := range m.Tracks {
+		field := fmt.Sprintf("tracks[%d]", i)
+		if v.required(field+".title", t.Title) {
+			v.maxLength(field+".title", t.Title, maxTitleLength)
+		}
+		v.maxLength(field+".position", t.Position, maxTrackPositionLength)
+		v.maxLength(field+".length", t.Length, maxTrackLengthLength)
+	}
+
+	return v.err()
+}
+
+// validateGenreTags checks the count and length of genre tags, and that none
+// contain a comma (tags are stored comma-separated) or repeat another tag
+func validateGenreTags(v *validator, field string, tags []string) {
+	if len(tags) > maxGenreTags {
+		v.fail(field, "must have at most %d tags", maxGenreTags)
+	}
+	seen := map[string]bool{}
+	for i, tag := range tags {
+		tagField := fmt.Sprintf("%s[%d]", field, i)
+		switch {
+		case strings.Contains(tag, ","):
+			v.fail(tagField, "must not contain a comma")
+		case utf8.RuneCountInString(tag) > maxGenreTagLength:
+			v.fail(tagField, "must be at most %d characters", maxGenreTagLength)
+		case seen[strings.ToLower(tag)]:
+			v.fail(tagField, "duplicates another tag")
+		}
+		seen[strings.ToLower(tag)] = true
+	}
+}
+
+// Validate normalizes and checks an artist payload
+func (a *Artist) Validate() error {
+	var v validator
+
+	a.Name = strings.TrimSpace(a.Name)
+	a.SortName = strings.TrimSpace(a.SortName)
+	a.Country = strings.TrimSpace(a.Country)
+
+	if v.required("name", a.Name) {
+		v.maxLength("name", a.Name, maxNameLength)
+	}
+	v.maxLength("sort_name", a.SortName, maxNameLength)
+	v.maxLength("country", a.Country, maxCountryLength)
+
+	if len(a.Aliases) > maxAliases {
+		v.fail("aliases", "must have at most %d entries", maxAliases)
+	}
+	for i, alias := range a.Aliases {
+		v.maxLength(fmt.Sprintf("aliases[%d]", i), strings.TrimSpace(alias), maxNameLength)
+	}
+
+	latestYear := time.Now().Year() + 1
+	if a.ActiveFrom != nil && (*a.ActiveFrom < 1000 || *a.ActiveFrom > latestYear) {
+		v.fail("active_from", "must be a year between 1000 and %d", latestYear)
+	}
+	if a.ActiveTo != nil && (*a.ActiveTo < 1000 || *a.ActiveTo > latestYear) {
+		v.fail("active_to", "must be a year between 1000 and %d", latestYear)
+	}
+	if a.ActiveFrom != nil && a.ActiveTo != nil && *a.ActiveTo < *a.ActiveFrom {
+		v.fail("active_to", "must not be before active_from")
+	}
+
+	return v.err()
+}
+
+// Validate normalizes and checks a format payload
+func (f *Format) Validate() error {
+	var v validator
+
+	f.Name = strings.TrimSpace(f.Name)
+	f.Description = strings.TrimSpace(f.Description)
+
+	if v.required("name", f.Name) {
+		v.maxLength("name", f.Name, maxNameLength)
+	}
+	v.maxLength("description", f.Description, maxDescriptionLength)
+
+	return v.err()
+}
+
+// Validate normalizes and checks a label payload
+func (l *Label) Validate() error {
+	var v validator
+
+	l.Name = strings.TrimSpace(l.Name)
+
+	if v.required("name", l.Name) {
+		v.maxLength("name", l.Name, maxNameLength)
+	}
+	if l.ParentID != nil && *l.ParentID <= 0 {
+		v.fail("parent_id", "must be a positive ID")
+	}
+	for i, prefix := range l.CatalogPrefixes {
+		v.maxLength(fmt.Sprintf("catalog_prefixes[%d]", i), strings.TrimSpace(prefix), maxCatalogPrefixLength)
+	}
+
+	return v.err()
+}
+
+// Validate normalizes and checks a user payload
+func (u *User) Validate() error {
+	var v validator
+
+	u.FirstName = strings.TrimSpace(u.FirstName)
+	u.LastName = strings.TrimSpace(u.LastName)
+	u.Username = strings.TrimSpace(u.Username)
+	u.Email = strings.TrimSpace(u.Email)
+
+	if v.required("username", u.Username) && !usernamePattern.MatchString(u.Username) {
+		v.fail("username", "must be 3 to 32 letters, digits, dots, dashes or underscores, starting with a letter or digit")
+	}
+	if v.required("email", u.Email) {
+		// Reject display-name forms such as "Jo <jo@example.com>"; only a bare address is allowed
+		address, err := mail.ParseAddress(u.Email)
+		if err != nil || address.Address != u.Email || !strings.Contains(u.Email[strings.LastIndex(u.Email, "@")+1:], ".") {
+			v.fail("email", "must be a valid email address")
+		}
+		v.maxLength("email", u.Email, maxEmailLength)
+	}
+	v.maxLength("first_name", u.FirstName, maxNameLength)
+	v.maxLength("last_name", u.LastName, maxNameLength)
+	if u.Password != "" && utf8.RuneCountInString(u.Password) < minPasswordLength {
+		v.fail("password", "must be at least %d characters", minPasswordLength)
+	}
+
+	return v.err()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// jsonFieldNames returns the JSON names of the fields of struct v
+func jsonFieldNames(v interface{}) map[string]bool {
+	names := map[string]bool{}
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		if name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+func TestMediaValidate(t *testing.T) {
+	valid := func() Media {
+		return Media{Title: "Kind of Blue", ArtistID: 1, FormatID: 1, DatePublished: "1959-08-17", Tracks: []Track{{Position: "A1", Title: "So What"}}}
+	}
+	labelID := -1
+	tests := []struct {
+		name   string
+		change func(m *Media)
+		want   string // The field that should fail, or "" if none
+	}{
+		{"valid", func(m *Media) {}, ""},
+		{"artist and format by name", func(m *Media) { m.ArtistID, m.ArtistName, m.FormatID, m.FormatName = 0, "Miles Davis", 0, "LP" }, ""},
+		{"title missing", func(m *Media) { m.Title = " " }, "title"},
+		{"artist missing", func(m *Media) { m.ArtistID = 0 }, "artist"},
+		{"artist name too long", func(m *Media) { m.ArtistID, m.ArtistName = 0, strings.Repeat("m", maxNameLength+1) }, "artist"},
+		{"artist ID negative", func(m *Media) { m.ArtistID = -1 }, "artist_id"},
+		{"format missing", func(m *Media) { m.FormatID = 0 }, "format"},
+		{"format ID negative", func(m *Media) { m.FormatID = -1 }, "format_id"},
+		{"date malformed", func(m *Media) { m.DatePublished = "17/08/1959" }, "date_published"},
+		{"image URL relative", func(m *Media) { m.ImageURL = "/covers/kind-of-blue.jpg" }, "image_url"},
+		{"genre tag with comma", func(m *Media) { m.GenreTags = []string{"Jazz, Modal"} }, "genre_tags[0]"},
+		{"barcode with letters", func(m *Media) { m.Barcode = "07464X0355" }, "barcode"},
+		{"catalog number too long", func(m *Media) { m.CatalogNumber = strings.Repeat("C", maxCatalogNumberLength+1) }, "catalog_number"},
+		{"label name too long", func(m *Media) { m.LabelName = strings.Repeat("l", maxNameLength+1) }, "label"},
+		{"label ID negative", func(m *Media) { m.LabelID = &labelID }, "label_id"},
+		{"track title missing", func(m *Media) { m.Tracks[0].Title = "" }, "tracks[0].title"},
+	}
+	names := jsonFieldNames(Media{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := valid()
+			tt.change(&m)
+			fields := validationFields(m.Validate())
+			if tt.want == "" && len(fields) > 0 {
+				t.Errorf("Validate failed %v, want no errors", fields)
+			}
+			if tt.want != "" && (len(fields) != 1 || fields[0] != tt.want) {
+				t.Errorf("Validate failed %v, want only %s", fields, tt.want)
+			}
+			// Errors are reported under the name the client sent the field as
+			for _, field := range fields {
+				if name := strings.FieldsFunc(field, func(r rune) bool { return r == '[' || r == '.' })[0]; !names[name] {
+					t.Errorf("field %q is not a JSON field of Media", field)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiPrefix is the root of the versioned API paths
+const apiPrefix = "/api"
+
+// apiVersion is one version of the API mounted under its prefix. Each version
+// registers its own handlers, so a new version can change payloads without
+// affecting clients of the older ones.
+type apiVersion struct {
+	prefix   string
+	register func(*mux.Router)
+}
+
+var apiV1 = apiVersion{prefix: apiPrefix + "/v1", register: registerV1Routes}
+
+// apiVersions are the versions the server mounts, oldest first
+var apiVersions = []apiVersion{apiV1}
+
+// legacyVersion is the version the unprefixed root paths alias
+var legacyVersion = apiV1
+
+// versionRelativePath strips the version prefix from a route template, leaving
+// unversioned and legacy paths as they are
+func versionRelativePath(path string) string {
+	for _, version := range apiVersions {
+		if strings.HasPrefix(path, version.prefix+"/") {
+			return strings.TrimPrefix(path, version.prefix)
+		}
+	}
+	return path
+}
+
+// legacyDeprecatedAt is when the root paths were deprecated in favour of /api/v1
+var legacyDeprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// legacySunset is the date the root paths will be removed, "" if not yet
+// decided; run sets it from the config
+var legacySunset string
+
+// withDeprecation marks responses from the legacy root paths as deprecated
+// (RFC 9745), with their removal date (RFC 8594) and a link to the same path
+// under successorPrefix
+func withDeprecation(successorPrefix string) mux.MiddlewareFunc {
+	deprecation := "@" + strconv.FormatInt(legacyDeprecatedAt.Unix(), 10)
+	var sunset string
+	if date, err := time.Parse("2006-01-02", legacySunset); err == nil {
+		sunset = date.Format(http.TimeFormat)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", deprecation)
+			if sunset != "" {
+				w.Header().Set("Sunset", sunset)
+			}
+			w.Header().Add("Link", "<"+successorPrefix+r.URL.Path+`>; rel="successor-version"`)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Webhook deliveries are queued from the event feed, so a webhook receives the
+// same events as /events, and sent by startWebhookDispatcher. A delivery that
+// keeps failing is retried with exponential backoff until it has been tried
+// webhookSettings.MaxAttempts times, then left as a dead letter.
+
+// Webhook struct holds a subscription to change events
+type Webhook struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"` // Signs payloads; only returned when the webhook is created
+	EventTypes []string  `json:"event_types"`      // Entity types, such as media, or event types, such as media.create
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WebhookDelivery struct holds one event sent, or to be sent, to a webhook
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	WebhookID      int        `json:"webhook_id"`
+	EventID        int64      `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"` // pending, delivered or dead
+	Attempts       int        `json:"attempts"`
+	ResponseStatus int        `json:"response_status,omitempty"` // Status code of the last attempt
+	LastError      string     `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"` // Set while pending
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// Delivery statuses
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+)
+
+// webhookEventTypes are the event types a webhook can subscribe to
+var webhookEventTypes = map[string]bool{
+	"media": true, "media.create": true, "media.update": true, "media.delete": true,
+	"collection": true, "collection.create": true, "collection.update": true, "collection.delete": true,
+}
+
+// webhookSettings control delivery; run sets them from the config
+var webhookSettings = struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	Timeout     time.Duration
+	AllowLocal  bool // Let webhooks reach loopback and link-local addresses
+}{MaxAttempts: 8, Backoff: 30 * time.Second, Timeout: 10 * time.Second}
+
+// maxWebhookBackoff caps the wait between attempts
+const maxWebhookBackoff = 6 * time.Hour
+
+// webhookWorkers is how many deliveries are sent at once
+const webhookWorkers = 4
+
+// webhookClient sends deliveries; each request has its own timeout. It refuses
+// to connect to local addresses, which a public host name may resolve to.
+var webhookClient = newWebhookClient()
+
+// newWebhookClient returns a client like the default one whose connections
+// are checked by refuseLocalDial
+func newWebhookClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refuseLocalDial}
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport}
+}
+
+// refuseLocalDial stops webhooks connecting to a loopback or link-local
+// address unless webhookSettings.AllowLocal is set
+func refuseLocalDial(network, address string, _ syscall.RawConn) error {
+	if webhookSettings.AllowLocal {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && localAddress(ip) {
+		return fmt.Errorf("webhooks may not connect to %s", host)
+	}
+	return nil
+}
+
+// localAddress reports whether ip is unspecified, loopback or link-local, such
+// as a cloud metadata service
+func localAddress(ip net.IP) bool {
+	return ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+// localHost reports whether the host of a URL is this machine or a link-local address
+func localHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && localAddress(ip)
+}
+
+// normalize trims the URL and event types and drops blank ones
+func (wh *Webhook) normalize() {
+	wh.URL = strings.TrimSpace(wh.URL)
+	types := []string{}
+	for _, t := range wh.EventTypes {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	wh.EventTypes = types
+}
+
+// Validate normalizes and checks a webhook payload. The secret may be left
+// empty to have one generated, or on update to keep the current one.
+func (wh *Webhook) Validate() error {
+	var v validator
+
+	wh.normalize()
+
+	if v.required("url", wh.URL) {
+		if !validURL(wh.URL) {
+			v.fail("url", "must be an absolute http or https URL")
+		} else if u, _ := url.Parse(wh.URL); !webhookSettings.AllowLocal && localHost(u.Hostname()) {
+			v.fail("url", "must not be a loopback or link-local address")
+		}
+		v.maxLength("url", wh.URL, maxURLLength)
+	}
+	v.maxLength("secret", wh.Secret, maxNameLength)
+	if len(wh.EventTypes) == 0 {
+		v.fail("event_types", "is required")
+	}
+	for i, t := range wh.EventTypes {
+		if !webhookEventTypes[t] {
+			v.fail(fmt.Sprintf("event_types[%d]", i), "must be media or collection, optionally followed by .create, .update or .delete")
+		}
+	}
+
+	return v.err()
+}
+
+// newWebhookSecret returns a random secret for signing payloads
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// scanWebhook reads a single webhook row, leaving out the secret
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var wh Webhook
+	var eventTypes, createdAt string
+	if err := row.Scan(&wh.ID, &wh.URL, &eventTypes, &createdAt); err != nil {
+		return wh, err
+	}
+	wh.EventTypes = strings.Split(eventTypes, ",")
+	wh.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
+	return wh, nil
+}
+
+const selectWebhookQuery = `SELECT id, url, event_types, created_at FROM webhooks`
+
+// getWebhooks handles retrieving all webhooks
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(selectWebhookQuery + ` ORDER BY id`)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve webhooks", err)
+		return
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		wh, err := scanWebhook(rows)
+		if err != nil {
+			writeInternalError(w, r, "Failed to scan webhook", err)
+			return
+		}
+		webhooks = append(webhooks, wh)
+	}
+	if err := rows.Err(); err != nil {
+		writeInternalError(w, r, "Error iterating over webhooks", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+// getWebhookById handles retrieving a webhook by ID
+func getWebhookById(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	wh, err := scanWebhook(db.QueryRow(selectWebhookQuery+` WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Webhook not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to retrieve webhook", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wh)
+}
+
+// createWebhook handles subscribing a URL to change events. The response is
+// the only time the secret is returned.
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var wh Webhook
+	err := json.NewDecoder(r.Body).Decode(&wh)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if err := wh.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	if wh.Secret == "" {
+		wh.Secret, err = newWebhookSecret()
+		if err != nil {
+			writeInternalError(w, r, "Failed to create webhook", err)
+			return
+		}
+	}
+
+	result, err := db.Exec(`INSERT INTO webhooks (url, secret, event_types) VALUES (?, ?, ?)`,
+		wh.URL, wh.Secret, strings.Join(wh.EventTypes, ","))
+	if err != nil {
+		writeInternalError(w, r, "Failed to create webhook", err)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		writeInternalError(w, r, "Failed to create webhook", err)
+		return
+	}
+	wh.ID = int(id)
+	wh.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(wh)
+}
+
+// updateWebhook handles changing a webhook's URL, event types or secret. An
+// empty secret keeps the current one.
+func updateWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	var wh Webhook
+	err = json.NewDecoder(r.Body).Decode(&wh)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if err := wh.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	var exists int
+	err = db.QueryRow(`SELECT id FROM webhooks WHERE id = ?`, id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Webhook not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to update webhook", err)
+		return
+	}
+
+	_, err = db.Exec(`UPDATE webhooks SET url = ?, event_types = ?, secret = IF(? = '', secret, ?) WHERE id = ?`,
+		wh.URL, strings.Join(wh.EventTypes, ","), wh.Secret, wh.Secret, id)
+	if err != nil {
+		writeInternalError(w, r, "Failed to update webhook", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteWebhook handles unsubscribing a webhook, along with its delivery log
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	result, err := db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		writeInternalError(w, r, "Failed to delete webhook", err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		writeError(w, r, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// maxDeliveriesListed caps the delivery log and dead-letter responses
+const maxDeliveriesListed = 100
+
+// getWebhookDeliveries handles listing a webhook's most recent deliveries,
+// optionally only those with the given status
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	var exists int
+	err = db.QueryRow(`SELECT id FROM webhooks WHERE id = ?`, id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Webhook not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to retrieve webhook", err)
+		return
+	}
+
+	where := `WHERE webhook_id = ?`
+	args := []interface{}{id}
+	if status := r.URL.Query().Get("status"); status != "" {
+		where += ` AND status = ?`
+		args = append(args, status)
+	}
+	writeDeliveries(w, r, where, args...)
+}
+
+// getWebhookDeadLetters handles listing the most recent deliveries, across
+// all webhooks, that failed every attempt
+func getWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	writeDeliveries(w, r, `WHERE status = ?`, deliveryDead)
+}
+
+// writeDeliveries sends the most recent deliveries matching the WHERE clause
+func writeDeliveries(w http.ResponseWriter, r *http.Request, where string, args ...interface{}) {
+	rows, err := db.Query(`
+        SELECT id, webhook_id, event_id, event_type, status, attempts, response_status,
+            last_error, next_attempt_at, created_at, delivered_at
+        FROM webhook_deliveries `+where+`
+        ORDER BY id DESC
+        LIMIT `+strconv.Itoa(maxDeliveriesListed), args...)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retrieve deliveries", err)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			writeInternalError(w, r, "Failed to scan delivery", err)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		writeInternalError(w, r, "Error iterating over deliveries", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// scanWebhookDelivery reads a single delivery row
+func scanWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var responseStatus sql.NullInt64
+	var nextAttemptAt, createdAt string
+	var deliveredAt sql.NullString
+	err := row.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &responseStatus,
+		&d.LastError, &nextAttemptAt, &createdAt, &deliveredAt)
+	if err != nil {
+		return d, err
+	}
+	d.ResponseStatus = int(responseStatus.Int64)
+	if d.Status == deliveryPending {
+		t, _ := time.Parse("2006-01-02 15:04:05", nextAttemptAt)
+		d.NextAttemptAt = &t
+	}
+	d.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
+	if deliveredAt.Valid {
+		t, _ := time.Parse("2006-01-02 15:04:05", deliveredAt.String)
+		d.DeliveredAt = &t
+	}
+	return d, nil
+}
+
+// retryWebhookDelivery handles sending a dead letter again, with a fresh set of attempts
+func retryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid delivery ID")
+		return
+	}
+
+	var status string
+	err = db.QueryRow(`SELECT status FROM webhook_deliveries WHERE id = ?`, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "Delivery not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, "Failed to retrieve delivery", err)
+		return
+	}
+	if status != deliveryDead {
+		writeError(w, r, http.StatusConflict, "Only dead deliveries can be retried")
+		return
+	}
+
+	_, err = db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = NOW() WHERE id = ? AND status = ?`,
+		deliveryPending, id, deliveryDead)
+	if err != nil {
+		writeInternalError(w, r, "Failed to retry delivery", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// queueWebhookDeliveries records a pending delivery of each event to every
+// webhook subscribed to it. A delivery is only queued once per webhook and
+// event, even if several servers share the database.
+func queueWebhookDeliveries(q dbExecutor, events []ChangeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	rows, err := q.Query(`SELECT id, event_types FROM webhooks`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	filters := map[int]eventFilter{}
+	for rows.Next() {
+		var id int
+		var eventTypes string
+		if err := rows.Scan(&id, &eventTypes); err != nil {
+			return err
+		}
+		filter := eventFilter{types: map[string]bool{}}
+		for _, t := range strings.Split(eventTypes, ",") {
+			filter.types[t] = true
+		}
+		filters[id] = filter
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		var payload []byte
+		for id, filter := range filters {
+			if !filter.matches(e) {
+				continue
+			}
+			if payload == nil {
+				if payload, err = json.Marshal(e); err != nil {
+					return err
+				}
+			}
+			_, err := q.Exec(`INSERT IGNORE INTO webhook_deliveries (webhook_id, event_id, event_type, payload) VALUES (?, ?, ?, ?)`,
+				id, e.ID, e.Type, string(payload))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadWebhookCursor returns the audit ID the event feed has queued deliveries
+// up to, and false if the feed has never run
+func loadWebhookCursor(q dbExecutor) (int64, bool, error) {
+	var id int64
+	err := q.QueryRow(`SELECT last_event_id FROM webhook_cursor WHERE id = 1`).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return id, err == nil, err
+}
+
+// saveWebhookCursor records that deliveries are queued for every audit entry
+// up to id
+func saveWebhookCursor(q dbExecutor, id int64) error {
+	_, err := q.Exec(`INSERT INTO webhook_cursor (id, last_event_id) VALUES (1, ?)
+        ON DUPLICATE KEY UPDATE last_event_id = VALUES(last_event_id)`, id)
+	return err
+}
+
+// pendingDelivery is a delivery due to be sent, with its webhook
+type pendingDelivery struct {
+	id        int64
+	attempts  int
+	eventType string
+	payload   []byte
+	url       string
+	secret    string
+}
+
+// dispatchWebhooks sends the deliveries that are due and records the outcome
+func dispatchWebhooks() error {
+	rows, err := db.Query(`
+        SELECT d.id, d.attempts, d.event_type, d.payload, w.url, w.secret
+        FROM webhook_deliveries d
+        JOIN webhooks w ON d.webhook_id = w.id
+        WHERE d.status = ? AND d.next_attempt_at <= NOW()
+        ORDER BY d.id
+        LIMIT 100
+    `, deliveryPending)
+	if err != nil {
+		return err
+	}
+	var due []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		if err := rows.Scan(&d.id, &d.attempts, &d.eventType, &d.payload, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	deliveries := make(chan pendingDelivery)
+	var wg sync.WaitGroup
+	for i := 0; i < webhookWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range deliveries {
+				if err := attemptDelivery(d); err != nil {
+					log.Printf("Failed to record webhook delivery %d: %v", d.id, err)
+				}
+			}
+		}()
+	}
+	for _, d := range due {
+		deliveries <- d
+	}
+	close(deliveries)
+	wg.Wait()
+	return nil
+}
+
+// attemptDelivery claims a due delivery, sends it and records the outcome.
+// The claim pushes next_attempt_at past the request timeout, so a delivery
+// another server has already picked up is skipped.
+func attemptDelivery(d pendingDelivery) error {
+	lease := int(math.Ceil(webhookSettings.Timeout.Seconds())) + 60
+	result, err := db.Exec(`
+        UPDATE webhook_deliveries SET next_attempt_at = DATE_ADD(NOW(), INTERVAL ? SECOND)
+        WHERE id = ? AND status = ? AND attempts = ? AND next_attempt_at <= NOW()
+    `, lease, d.id, deliveryPending, d.attempts)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	responseStatus, err := sendWebhook(d)
+	var code interface{}
+	if responseStatus != 0 {
+		code = responseStatus
+	}
+	outcome := deliveryOutcome(d.attempts, err)
+	if outcome == deliveryDelivered {
+		webhookDeliveriesTotal.inc(deliveryDelivered)
+		_, err = db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = attempts + 1, response_status = ?, last_error = '', delivered_at = NOW() WHERE id = ?`,
+			deliveryDelivered, code, d.id)
+		return err
+	}
+
+	message := err.Error()
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	if outcome == deliveryDead {
+		webhookDeliveriesTotal.inc(deliveryDead)
+		log.Printf("Webhook delivery %d to %s failed %d times, giving up: %v", d.id, d.url, d.attempts+1, err)
+		_, err = db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = attempts + 1, response_status = ?, last_error = ? WHERE id = ?`,
+			deliveryDead, code, message, d.id)
+		return err
+	}
+	webhookDeliveriesTotal.inc("failed")
+	_, err = db.Exec(`UPDATE webhook_deliveries SET attempts = attempts + 1, response_status = ?, last_error = ?, next_attempt_at = DATE_ADD(NOW(), INTERVAL ? SECOND) WHERE id = ?`,
+		code, message, int(webhookBackoff(d.attempts).Seconds()), d.id)
+	return err
+}
+
+// deliveryOutcome returns the status of a delivery after an attempt that
+// followed the given number of earlier ones and failed with err, or not if
+// err is nil. A delivery whose last allowed attempt failed is dead.
+func deliveryOutcome(attempts int, err error) string {
+	switch {
+	case err == nil:
+		return deliveryDelivered
+	case attempts+1 >= webhookSettings.MaxAttempts:
+		return deliveryDead
+	default:
+		return deliveryPending
+	}
+}
+
+// webhookBackoff returns how long to wait after the given number of earlier
+// failed attempts: the configured backoff, doubling each time
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookSettings.Backoff
+	for i := 0; i < attempts && backoff < maxWebhookBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxWebhookBackoff {
+		backoff = maxWebhookBackoff
+	}
+	return backoff
+}
+
+// sendWebhook posts a delivery's payload, signed with the webhook's secret.
+// The X-Webhook-Signature header is "sha256=" and the hex HMAC-SHA256 of the
+// X-Webhook-Timestamp header, a dot and the body. Any 2xx response counts as
+// delivered.
+func sendWebhook(d pendingDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(d.secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(d.payload)
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookSettings.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "record-collection-webhooks")
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.id, 10))
+	req.Header.Set("X-Webhook-Event", d.eventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// startWebhookDispatcher sends due deliveries every interval until the
+// returned stop function is called
+func startWebhookDispatcher(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := dispatchWebhooks(); err != nil {
+				log.Printf("Webhook dispatch failed: %v", err)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
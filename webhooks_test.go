@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// allowLocalWebhooks lets webhooks reach httptest servers until the test ends
+func allowLocalWebhooks(t *testing.T) {
+	saved := webhookSettings
+	t.Cleanup(func() { webhookSettings = saved })
+	webhookSettings.AllowLocal = true
+}
+
+func TestSendWebhookSignature(t *testing.T) {
+	allowLocalWebhooks(t)
+	payload := []byte(`{"id":42,"type":"media.create"}`)
+	var got *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	before := time.Now().Unix()
+	status, err := sendWebhook(pendingDelivery{id: 7, eventType: "media.create", payload: payload, url: server.URL, secret: "s3cret"})
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("sendWebhook = %d, %v; want 204, nil", status, err)
+	}
+
+	if string(body) != string(payload) {
+		t.Errorf("body = %s, want %s", body, payload)
+	}
+	if got.Header.Get("X-Webhook-Delivery") != "7" || got.Header.Get("X-Webhook-Event") != "media.create" {
+		t.Errorf("delivery, event headers = %q, %q", got.Header.Get("X-Webhook-Delivery"), got.Header.Get("X-Webhook-Event"))
+	}
+	timestamp := got.Header.Get("X-Webhook-Timestamp")
+	if sent, err := strconv.ParseInt(timestamp, 10, 64); err != nil || sent < before || sent > time.Now().Unix() {
+		t.Errorf("X-Webhook-Timestamp = %q, want the current Unix time", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + string(payload)))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); got.Header.Get("X-Webhook-Signature") != want {
+		t.Errorf("X-Webhook-Signature = %q, want %q", got.Header.Get("X-Webhook-Signature"), want)
+	}
+}
+
+func TestSendWebhookStatus(t *testing.T) {
+	allowLocalWebhooks(t)
+	tests := []struct {
+		status int
+		ok     bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusAccepted, true},
+		{http.StatusNoContent, true},
+		{http.StatusNotModified, false},
+		{http.StatusBadRequest, false},
+		{http.StatusGone, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		status, err := sendWebhook(pendingDelivery{id: 1, payload: []byte(`{}`), url: server.URL})
+		server.Close()
+		if status != tt.status || (err == nil) != tt.ok {
+			t.Errorf("response %d: sendWebhook = %d, %v", tt.status, status, err)
+		}
+	}
+
+	// A webhook that can't be reached has no status
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	if status, err := sendWebhook(pendingDelivery{id: 1, payload: []byte(`{}`), url: server.URL}); status != 0 || err == nil {
+		t.Errorf("unreachable webhook: sendWebhook = %d, %v", status, err)
+	}
+}
+
+func TestWebhookLocalAddresses(t *testing.T) {
+	tests := []struct {
+		url   string
+		local bool
+	}{
+		{"https://example.com/hook", false},
+		{"http://192.0.2.10:8080/hook", false},
+		{"http://[2001:db8::1]/hook", false},
+		{"http://localhost:8080/hook", true},
+		{"http://LOCALHOST./hook", true},
+		{"http://api.localhost/hook", true},
+		{"http://127.0.0.1/hook", true},
+		{"http://127.8.9.10/hook", true},
+		{"http://[::1]/hook", true},
+		{"http://0.0.0.0/hook", true},
+		{"http://169.254.169.254/latest/meta-data", true},
+		{"http://[fe80::1]/hook", true},
+	}
+	for _, tt := range tests {
+		wh := Webhook{URL: tt.url, EventTypes: []string{"media"}}
+		if fields := validationFields(wh.Validate()); (len(fields) == 1 && fields[0] == "url") != tt.local || len(fields) > 1 {
+			t.Errorf("Validate(%s) failed %v, want a url error %v", tt.url, fields, tt.local)
+		}
+	}
+
+	allowLocalWebhooks(t)
+	wh := Webhook{URL: "http://localhost:8080/hook", EventTypes: []string{"media"}}
+	if err := wh.Validate(); err != nil {
+		t.Errorf("Validate with local webhooks allowed = %v", err)
+	}
+}
+
+func TestSendWebhookRefusesLocalAddress(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	// A host name that passes validation may still resolve to a local address
+	status, err := sendWebhook(pendingDelivery{id: 1, payload: []byte(`{}`), url: server.URL})
+	if status != 0 || err == nil || called {
+		t.Errorf("sendWebhook to %s = %d, %v; want it refused before connecting", server.URL, status, err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	saved := webhookSettings
+	defer func() { webhookSettings = saved }()
+	webhookSettings.Backoff = 30 * time.Second
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, maxWebhookBackoff},
+		{100, maxWebhookBackoff},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDeliveryOutcome(t *testing.T) {
+	saved := webhookSettings
+	defer func() { webhookSettings = saved }()
+	webhookSettings.MaxAttempts = 3
+	failed := errors.New("webhook responded 500 Internal Server Error")
+
+	tests := []struct {
+		attempts int
+		err      error
+		want     string
+	}{
+		{0, nil, deliveryDelivered},
+		{2, nil, deliveryDelivered},
+		{0, failed, deliveryPending},
+		{1, failed, deliveryPending},
+		{2, failed, deliveryDead},
+		{5, failed, deliveryDead},
+	}
+	for _, tt := range tests {
+		if got := deliveryOutcome(tt.attempts, tt.err); got != tt.want {
+			t.Errorf("deliveryOutcome(%d, %v) = %q, want %q", tt.attempts, tt.err, got, tt.want)
+		}
+	}
+}